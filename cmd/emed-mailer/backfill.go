@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+	"github.com/emed-appts/emed-mailer/internal/config"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// backfillCmd notifies the changes of an explicit range, e.g. after an outage
+var backfillCmd = &cli.Command{
+	Name:  "backfill",
+	Usage: "collect and send the changed appointments of a time range, skipping already notified ones",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "from",
+			Usage:    "start of the range, exclusive, e.g. 2020-03-01 08:00 or RFC 3339",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Usage:    "end of the range, inclusive, e.g. 2020-03-01 18:00 or RFC 3339",
+			Required: true,
+		},
+		// setup picks it up like the global flag
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "log messages instead of sending them",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		from, err := parseTimestamp(ctx.String("from"))
+		if err != nil {
+			return exitWithHelp(ctx, "Could not parse --from.", err)
+		}
+		to, err := parseTimestamp(ctx.String("to"))
+		if err != nil {
+			return exitWithHelp(ctx, "Could not parse --to.", err)
+		}
+
+		sigCtx, cancel := signalContext()
+		defer cancel()
+
+		s, err := newServices(sigCtx)
+		if err != nil {
+			log.Error().
+				Msgf("%+v\n", err)
+
+			fmt.Fprintf(ctx.App.Writer, "\nCould not start.\n%s\n\n", redacted(errors.Cause(err)))
+			return cli.Exit("", 1)
+		}
+		defer s.Close()
+
+		if err := s.job.Backfill(sigCtx, from, to); err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nBackfill failed.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		return nil
+	},
+}
+
+// timestampLayouts are accepted by parseTimestamp, layouts without zone are in the configured timezone
+var timestampLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseTimestamp parses a timestamp given on the command line
+func parseTimestamp(value string) (time.Time, error) {
+	loc := time.Local
+	if config.General.Timezone != "" {
+		var err error
+		if loc, err = tzinfo.LoadLocation(config.General.Timezone); err != nil {
+			return time.Time{}, errors.WithStack(err)
+		}
+	}
+
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid timestamp %q, expected e.g. 2020-03-01 08:00 or 2020-03-01T08:00:00+01:00", value)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/emed-appts/emed-mailer/internal/config"
+
+	"github.com/urfave/cli/v2"
+)
+
+// configCmd inspects the configuration
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "inspect the configuration",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "print",
+			Usage: "print the effective configuration of file, environment, flags and defaults as json, with masked secrets",
+			Action: func(ctx *cli.Context) error {
+				if err := config.Load(); err != nil {
+					return exitWithHelp(ctx, "Could not load configuration file.", err)
+				}
+				applyFlags(ctx)
+
+				enc := json.NewEncoder(ctx.App.Writer)
+				enc.SetIndent("", "  ")
+				return enc.Encode(config.Redacted())
+			},
+		},
+	},
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// listCmd prints the changes the next run would notify, the queued retries first
+var listCmd = &cli.Command{
+	Name:  "list",
+	Usage: "print the queued and the changed appointments the next run would notify, without sending",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the changes as json instead of a table",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		sigCtx, cancel := signalContext()
+		defer cancel()
+
+		s, err := newServices(sigCtx)
+		if err != nil {
+			log.Error().
+				Msgf("%+v\n", err)
+
+			fmt.Fprintf(ctx.App.Writer, "\nCould not start.\n%s\n\n", redacted(errors.Cause(err)))
+			return cli.Exit("", 1)
+		}
+		defer s.Close()
+
+		changes, err := s.job.Pending(sigCtx)
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not collect changes.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		if ctx.Bool("json") {
+			err = printChangesJSON(ctx.App.Writer, changes)
+		} else {
+			err = printChanges(ctx.App.Writer, changes)
+		}
+		return errors.WithStack(err)
+	},
+}
+
+// listedChange is a change as printed by the list command
+type listedChange struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	PatientID   int       `json:"patientId"`
+	PatientName string    `json:"patientName"`
+	Provider    string    `json:"provider,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Appointment time.Time `json:"appointment"`
+	// Previous is the start before the appointment got moved, if known
+	Previous *time.Time `json:"previous,omitempty"`
+	Changed  time.Time  `json:"changed"`
+	// Queued is the time of the first failed attempt of changes queued for a retry
+	Queued *time.Time `json:"queued,omitempty"`
+}
+
+func newListedChange(pending *job.QueuedChange) *listedChange {
+	change := pending.Change
+	c := &listedChange{
+		ID:          change.ID(),
+		Type:        change.ChangeType(),
+		PatientID:   change.PatientID,
+		PatientName: change.PatientName,
+		Provider:    change.Provider,
+		Location:    change.Location,
+		Appointment: change.Appointment,
+		Changed:     change.Time,
+	}
+	if !change.PreviousAppointment.IsZero() {
+		c.Previous = &change.PreviousAppointment
+	}
+	if !pending.Queued.IsZero() {
+		c.Queued = &pending.Queued
+	}
+	return c
+}
+
+// printChanges prints the changes as table
+func printChanges(w io.Writer, changes []*job.QueuedChange) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tPATIENT\tPROVIDER\tAPPOINTMENT\tPREVIOUS\tCHANGED\tQUEUED")
+	for _, change := range changes {
+		c := newListedChange(change)
+		fmt.Fprintf(tw, "%s\t%s\t%d %s\t%s\t%s\t%s\t%s\t%s\n",
+			c.ID,
+			c.Type,
+			c.PatientID,
+			c.PatientName,
+			orDash(c.Provider),
+			template.FormatTime(c.Appointment),
+			template.FormatTime(change.Change.PreviousAppointment),
+			template.FormatTime(c.Changed),
+			template.FormatTime(change.Queued),
+		)
+	}
+	return tw.Flush()
+}
+
+// orDash returns — for empty values like FormatTime for zero times, so the columns stay aligned
+func orDash(value string) string {
+	if value == "" {
+		return "—"
+	}
+	return value
+}
+
+// printChangesJSON prints the changes as json array
+func printChangesJSON(w io.Writer, changes []*job.QueuedChange) error {
+	listed := make([]*listedChange, len(changes))
+	for i, change := range changes {
+		listed[i] = newListedChange(change)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(listed)
+}
@@ -1,21 +1,17 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"os/signal"
-	"path"
 	"syscall"
 	"time"
 
-	"github.com/emed-appts/emed-mailer/internal/collector"
 	"github.com/emed-appts/emed-mailer/internal/config"
-	"github.com/emed-appts/emed-mailer/internal/job"
-	"github.com/emed-appts/emed-mailer/internal/mailer"
+	"github.com/emed-appts/emed-mailer/internal/server"
 	"github.com/emed-appts/emed-mailer/internal/version"
 
-	"github.com/pkg/errors"
-	"github.com/rs/zerolog"
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/robfig/cron.v2"
@@ -44,105 +40,129 @@ func main() {
 			&cli.StringFlag{
 				Name:        "config",
 				Value:       "conf/app.ini",
-				Usage:       "set config path",
+				Usage:       "set config path, .toml, .yaml and .yml files are read as toml and yaml, others as ini",
 				Destination: &config.Path,
 			},
+			&cli.StringFlag{
+				Name:        "env",
+				Usage:       "overlay the profile of the config path, e.g. staging reads conf/app.staging.ini after conf/app.ini",
+				EnvVars:     []string{"EMED_ENV"},
+				Destination: &config.Env,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "log messages instead of sending them",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "override the configured log level, e.g. debug for troubleshooting",
+			},
 		},
 
-		Action: func(ctx *cli.Context) error {
-			// load config
-			err := config.Load()
-			if err != nil {
-				fmt.Fprintf(ctx.App.Writer, "\nCould not load configuration file.\n%v\n\n", errors.Cause(err))
-
-				cli.ShowAppHelp(ctx)
-				return cli.Exit("", 128)
-			}
+		Commands: []*cli.Command{
+			runOnceCmd,
+			testSMTPCmd,
+			previewCmd,
+			sendCmd,
+			listCmd,
+			backfillCmd,
+			configCmd,
+			versionCmd,
+		},
 
-			// open logfile
-			logFile, err := os.OpenFile(path.Join(config.General.Root, "emed-mailer.log"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+		Action: func(ctx *cli.Context) error {
+			logFile, err := setup(ctx)
 			if err != nil {
-				fmt.Fprintf(ctx.App.Writer, "\nCould not open log file.\n%v\n\n", errors.Cause(err))
-
-				cli.ShowAppHelp(ctx)
-				return cli.Exit("", 128)
+				return err
 			}
 			defer logFile.Close()
 
-			// configure logger
-			if config.Log.Pretty {
-				log.Logger = log.Output(
-					zerolog.ConsoleWriter{
-						Out:     logFile,
-						NoColor: !config.Log.Colored,
-					},
-				)
-			} else {
-				log.Logger = log.Output(logFile)
+			if config.General.PIDFile != "" {
+				if err := writePIDFile(config.General.PIDFile); err != nil {
+					log.Error().
+						Msgf("%+v\n", err)
+
+					return err
+				}
+				defer func() {
+					if err := removePIDFile(config.General.PIDFile); err != nil {
+						log.Error().
+							Err(err).
+							Msg("could not remove pid file")
+					}
+				}()
 			}
 
-			// set configured log level
-			logLvl, err := zerolog.ParseLevel(config.Log.Level)
-			if err != nil {
-				fmt.Fprintf(ctx.App.Writer, "\nCould not parse Log Level.\n%v\n\n", errors.Cause(err))
+			sigCtx, cancel := signalContext()
+			defer cancel()
 
-				cli.ShowAppHelp(ctx)
-				return cli.Exit("", 128)
-			}
-			zerolog.SetGlobalLevel(logLvl)
-
-			stop := make(chan struct{}, 1)
-
-			// open database connection
-			db, err := collector.OpenSQL(collector.DBConfig{
-				Server:   config.DB.Server,
-				Port:     config.DB.Port,
-				User:     config.DB.User,
-				Password: config.DB.Password,
-				Database: config.DB.Database,
-			})
+			// errors get returned instead of exiting, so the deferred cleanup like removing the pid file runs
+			s, err := newServices(sigCtx)
 			if err != nil {
-				log.Fatal().
-					Msgf("%+v\n", errors.Wrap(err, "could not connect to db"))
-			}
-			defer db.Close()
-
-			// instantiate collector
-			c := collector.New(db)
-
-			// instantiate emed-mailer
-			m := mailer.New(mailer.Config{
-				Server:   config.Mail.Server,
-				Port:     config.Mail.Port,
-				User:     config.Mail.User,
-				Password: config.Mail.Password,
-
-				From:    config.Mail.From,
-				To:      config.Mail.To,
-				Subject: config.Mail.Subject,
-			})
-			// run emed-mailer daemon
-			err = m.Run(stop)
-			if err != nil {
-				log.Fatal().
-					Msgf("%+v\n", errors.Wrap(err, "could not run mailer daemon"))
-			}
+				log.Error().
+					Msgf("%+v\n", err)
 
-			// instantiate job
-			initialLastRun := config.General.Schedule.Next(time.Now()).Add(-config.General.Interval)
-			changedApptsJob := job.New(c, m, initialLastRun)
+				return err
+			}
+			defer s.Close()
 
 			cr := cron.New()
-			cr.Schedule(config.General.Schedule, cron.FuncJob(changedApptsJob.Run))
+			s.schedule(cr)
 			cr.Start()
+			if config.General.RunOnStart {
+				// runs share the overlap guard of the job, a tick during this run gets skipped or waits
+				go s.Run()
+			}
 
-			sigs := make(chan os.Signal, 1)
-			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-			<-sigs
+			var srv *server.Server
+			if config.General.HTTPAddr != "" {
+				srv = server.New(config.General.HTTPAddr, s.readinessChecks(), s.redact)
+				srv.EnableStatus(s.status)
+				if config.General.EnablePprof {
+					srv.EnablePprof()
+				}
+				if err := srv.Run(); err != nil {
+					log.Error().
+						Msgf("%+v\n", err)
+					cr.Stop()
+
+					return err
+				}
+			}
 
+			// database, mailer and scheduler are up, a no-op unless run by systemd with Type=notify
+			sdNotify(daemon.SdNotifyReady)
+
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+
+		loop:
+			for {
+				select {
+				case <-hup:
+					log.Info().
+						Msg("received reload signal")
+					sdNotify(daemon.SdNotifyReloading)
+					s.Reload(cr)
+					sdNotify(daemon.SdNotifyReady)
+				case <-sigCtx.Done():
+					break loop
+				}
+			}
+
+			sdNotify(daemon.SdNotifyStopping)
 			cr.Stop()
-			close(sigs)
-			close(stop)
+
+			if srv != nil {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), config.General.ShutdownTimeout)
+				if err := srv.Shutdown(shutdownCtx); err != nil {
+					log.Error().
+						Err(err).
+						Msg("could not stop http server")
+				}
+				cancel()
+			}
 
 			return nil
 		},
@@ -164,3 +184,13 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// sdNotify sends the state to systemd, NOTIFY_SOCKET being unset makes it a no-op
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Warn().
+			Err(err).
+			Str("state", state).
+			Msg("could not notify systemd")
+	}
+}
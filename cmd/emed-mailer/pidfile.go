@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writePIDFile writes the pid of the current process to path
+// it refuses to overwrite the pid file of a running process, so two instances never run at once
+func writePIDFile(path string) error {
+	// the stale pid file of a dead process gets replaced once, a second conflict means another instance won the race
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return errors.Wrap(err, "could not write pid file")
+		}
+		if !os.IsExist(err) || attempt > 0 {
+			return errors.Wrap(err, "could not create pid file")
+		}
+
+		if err := removeStalePIDFile(path); err != nil {
+			return err
+		}
+	}
+}
+
+// removeStalePIDFile removes the pid file, if the process it records is not running anymore
+func removeStalePIDFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read pid file")
+	}
+
+	// an instance creating the file has not written its pid yet, or the file got corrupted
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return errors.Errorf("pid file %s holds no pid, remove it if no other instance is running", path)
+	}
+	if pid != os.Getpid() && processRunning(pid) {
+		return errors.Errorf("pid file %s belongs to running process %d, is another instance running?", path, pid)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove stale pid file")
+	}
+	return nil
+}
+
+// removePIDFile removes the pid file on shutdown
+func removePIDFile(path string) error {
+	return errors.Wrap(os.Remove(path), "could not remove pid file")
+}
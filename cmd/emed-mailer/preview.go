@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/config"
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/mailer"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// previewCmd renders the templates and prints the messages instead of sending them
+var previewCmd = &cli.Command{
+	Name:  "preview",
+	Usage: "render the templates against sample data and print the mime messages, without sending",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "data",
+			Usage: "render a json fixture with LastRun and ChangedAppts instead of the sample data",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		data := sampleData()
+		if path := ctx.String("data"); path != "" {
+			if data, err = loadPreviewData(path); err != nil {
+				fmt.Fprintf(ctx.App.Writer, "\nCould not load preview data.\n%s\n\n", redacted(err))
+				return cli.Exit("", 1)
+			}
+		}
+
+		// messages are written one after another, in the order of the changes
+		config.Mail.Concurrency = 1
+		notifier, err := newMailNotifier(&previewMailer{mailer.New(mailerConfig()), ctx.App.Writer}, nil)
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not load templates.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		if err := notifier.Notify(context.Background(), data.LastRun, data.ChangedAppts); err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not render messages.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		return nil
+	},
+}
+
+// previewData is rendered by the preview command
+type previewData struct {
+	LastRun      time.Time
+	ChangedAppts []*job.ApptChange
+}
+
+// sampleData returns a booking and a cancellation since the previous scheduled run
+func sampleData() *previewData {
+	now := time.Now().Truncate(time.Minute)
+	appt := now.AddDate(0, 0, 7).Truncate(time.Hour)
+
+	return &previewData{
+		LastRun: now.Add(-config.General.Interval),
+		ChangedAppts: []*job.ApptChange{
+			{
+				Time:        now.Add(-10 * time.Minute),
+				Appointment: appt,
+				PatientID:   1001,
+				PatientName: "Maria Musterfrau",
+				IsBooking:   true,
+			},
+			{
+				Time:        now.Add(-5 * time.Minute),
+				Appointment: appt.Add(2 * time.Hour),
+				PatientID:   1002,
+				PatientName: "Max Mustermann",
+				IsBooking:   false,
+			},
+		},
+	}
+}
+
+// loadPreviewData reads a json fixture
+func loadPreviewData(path string) (*previewData, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", path)
+	}
+
+	data := &previewData{}
+	if err := json.Unmarshal(src, data); err != nil {
+		return nil, errors.Wrapf(err, "could not decode %s", path)
+	}
+	if data.LastRun.IsZero() {
+		data.LastRun = time.Now().Add(-config.General.Interval)
+	}
+	return data, nil
+}
+
+// previewMailer writes the messages instead of sending them
+type previewMailer struct {
+	mailer *mailer.TextMailer
+	w      io.Writer
+}
+
+func (m *previewMailer) Run(<-chan struct{}) error {
+	return nil
+}
+
+func (m *previewMailer) SendMessage(msg *job.Message) (*job.Receipt, error) {
+	if err := m.mailer.WriteMessage(m.w, msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err := fmt.Fprint(m.w, "\r\n\r\n")
+	return &job.Receipt{}, errors.WithStack(err)
+}
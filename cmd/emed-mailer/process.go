@@ -0,0 +1,14 @@
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// processRunning reports whether a process with the pid exists
+func processRunning(pid int) bool {
+	// signal 0 only checks for existence, EPERM means it exists but belongs to another user
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+)
+
+// processRunning reports whether a process with the pid exists
+func processRunning(pid int) bool {
+	const processQueryLimitedInformation = 0x1000
+	const stillActive = 259
+
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// runOnceCmd collects and sends changed appointments once without scheduler
+var runOnceCmd = &cli.Command{
+	Name:  "run-once",
+	Usage: "collect and send changed appointments and the due reminders once, then exit",
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		sigCtx, cancel := signalContext()
+		defer cancel()
+
+		s, err := newServices(sigCtx)
+		if err != nil {
+			log.Error().
+				Msgf("%+v\n", err)
+
+			fmt.Fprintf(ctx.App.Writer, "\nCould not start.\n%s\n\n", redacted(errors.Cause(err)))
+			return cli.Exit("", 1)
+		}
+		defer s.Close()
+
+		result := s.job.Execute(sigCtx)
+		fmt.Fprintf(ctx.App.Writer, "Collected %d changes, sent %d, failed %d in %s.\n",
+			result.Collected, result.Sent, result.Failed, result.Duration.Round(time.Millisecond))
+		if result.Err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nRun failed.\n%s\n\n", redacted(result.Err))
+			return cli.Exit("", 1)
+		}
+
+		if s.reminders != nil {
+			sent, err := s.reminders.Execute(sigCtx)
+			fmt.Fprintf(ctx.App.Writer, "Sent %d reminders.\n", sent)
+			if err != nil {
+				fmt.Fprintf(ctx.App.Writer, "\nReminders failed.\n%s\n\n", redacted(err))
+				return cli.Exit("", 1)
+			}
+		}
+
+		return nil
+	},
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// sendCmd resends the notification of a single change, e.g. after it got lost
+var sendCmd = &cli.Command{
+	Name:  "send",
+	Usage: "collect a single changed appointment again and send its notification, ignoring whether it got notified already",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "appointment-id",
+			Usage:    "id of the change as recorded in the audit trail and the state file, <patient id>/<time of change>/<appointment>/<is booking>",
+			Required: true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		sigCtx, cancel := signalContext()
+		defer cancel()
+
+		s, err := newServices(sigCtx)
+		if err != nil {
+			log.Error().
+				Msgf("%+v\n", err)
+
+			fmt.Fprintf(ctx.App.Writer, "\nCould not start.\n%s\n\n", redacted(errors.Cause(err)))
+			return cli.Exit("", 1)
+		}
+		defer s.Close()
+
+		change, err := job.FindChange(sigCtx, s.collector, ctx.String("appointment-id"))
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not find appointment.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		// the notifier is used directly, so the change is neither deduplicated nor remembered
+		notifier, err := newMailNotifier(s.mailer, s.audit)
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not load templates.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+		if err := notifier.Notify(sigCtx, change.Time, []*job.ApptChange{change}); err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nSending notification failed.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		fmt.Fprintf(ctx.App.Writer, "Notification sent for %s\n", change.ID())
+		return nil
+	},
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector"
+	"github.com/emed-appts/emed-mailer/internal/config"
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/mailer"
+	"github.com/emed-appts/emed-mailer/internal/redact"
+	"github.com/emed-appts/emed-mailer/internal/server"
+	"github.com/emed-appts/emed-mailer/internal/slack"
+	"github.com/emed-appts/emed-mailer/internal/template"
+	"github.com/emed-appts/emed-mailer/internal/webhook"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// logLevel is the level given by --log-level, it takes precedence over the config file also after a reload
+var logLevel string
+
+// applyFlags overrides the loaded config by the global flags, flags take precedence over the config file
+func applyFlags(ctx *cli.Context) {
+	if ctx.Bool("dry-run") {
+		config.General.DryRun = true
+	}
+	if logLevel = ctx.String("log-level"); logLevel != "" {
+		config.Log.Level = logLevel
+	}
+}
+
+// logWriter redacts the secrets from the log, the secrets of reloaded configurations get added
+var logWriter *redact.Writer
+
+// setup loads the configuration and configures the logger
+// the returned log file has to be closed by the caller
+func setup(ctx *cli.Context) (io.Closer, error) {
+	// load config
+	err := config.Load()
+	if err != nil {
+		return nil, exitWithHelp(ctx, "Could not load configuration file.", err)
+	}
+	applyFlags(ctx)
+
+	// open logfile
+	logFile, err := openLog()
+	if err != nil {
+		return nil, exitWithHelp(ctx, "Could not open log file.", err)
+	}
+
+	// configure logger, secrets never make it into the log
+	logWriter = redact.NewWriter(logFile, config.Secrets()...)
+	if config.Log.Pretty {
+		log.Logger = log.Output(
+			zerolog.ConsoleWriter{
+				Out:     logWriter,
+				NoColor: !config.Log.Colored,
+			},
+		)
+	} else {
+		log.Logger = log.Output(logWriter)
+	}
+
+	// set configured log level
+	logLvl, err := zerolog.ParseLevel(config.Log.Level)
+	if err != nil {
+		logFile.Close()
+		return nil, exitWithHelp(ctx, "Could not parse Log Level.", err)
+	}
+	zerolog.SetGlobalLevel(logLvl)
+	template.SetTimeFormat(config.General.TimeLayout, config.General.Location)
+
+	for _, warning := range config.Warnings {
+		log.Warn().
+			Msg(warning)
+	}
+
+	log.Debug().
+		Interface("config", config.Redacted()).
+		Msg("effective configuration")
+
+	return logFile, nil
+}
+
+// openLog opens the configured log output
+// the log file is rotated if any rotation option is set
+func openLog() (io.WriteCloser, error) {
+	switch config.Log.Output {
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+
+	filename := config.Log.File
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create log directory")
+	}
+	if config.Log.MaxSizeMB == 0 && config.Log.MaxBackups == 0 && config.Log.MaxAgeDays == 0 {
+		return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+	}
+
+	// lumberjack opens the file on the first write
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    config.Log.MaxSizeMB,
+		MaxBackups: config.Log.MaxBackups,
+		MaxAge:     config.Log.MaxAgeDays,
+	}, nil
+}
+
+// nopCloser keeps the standard streams open when the log gets closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// signalContext returns a context which gets cancelled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			log.Info().
+				Msg("received shutdown signal")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+
+	return ctx, cancel
+}
+
+// exitWithHelp prints the error followed by the app help
+func exitWithHelp(ctx *cli.Context, msg string, err error) error {
+	fmt.Fprintf(ctx.App.Writer, "\n%s\n%s\n\n", msg, redacted(errors.Cause(err)))
+
+	cli.ShowAppHelp(ctx)
+	return cli.Exit("", 128)
+}
+
+// redacted formats the error with all configured secrets masked
+func redacted(err error) string {
+	return redact.String(err.Error(), config.Secrets()...)
+}
+
+// services bundles everything a job run depends on
+type services struct {
+	// ctx gets cancelled on shutdown, aborting running jobs
+	ctx    context.Context
+	db     *sql.DB
+	mailer *mailer.TextMailer
+	job    job.Job
+	stop   chan struct{}
+	// collector is shared with job, e.g. to resend a single change
+	collector job.Collector
+	// audit is passed on to the notifiers, which get replaced on reload
+	audit job.AuditLog
+	// heartbeat reports the stats of job, scheduled if configured
+	heartbeat *job.Heartbeat
+	// reminders remind patients of their appointments, scheduled with job if enabled
+	reminders *job.Reminders
+	// tracing exports the spans of runs, nil if disabled
+	tracing *sdktrace.TracerProvider
+	// entries are the scheduled cron entries, replaced on reload
+	entries []cron.EntryID
+	// templates detects changed template files before each run
+	templates *template.Watch
+	// reloadMu serializes reloading the configuration and the templates
+	reloadMu sync.Mutex
+	// running tracks scheduled job runs in progress
+	running sync.WaitGroup
+	// closingMu guards closing, so no run gets added to running while Close waits for it
+	closingMu sync.Mutex
+	closing   bool
+	// started is when the services got created, the age of the status until the first run finishes
+	started time.Time
+}
+
+// newServices connects to the database, starts the mailer daemon and instantiates the job
+func newServices(ctx context.Context) (*services, error) {
+	var err error
+
+	// resume from persisted state, fall back to the last scheduled run
+	state := &job.State{}
+	var stateStore job.StateStore
+	if config.General.StatePath != "" {
+		stateStore = collector.NewStateFile(config.General.StatePath)
+
+		state, err = stateStore.LoadState()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load state")
+		}
+	}
+	var queue job.Queue
+	if config.General.QueuePath != "" {
+		queue = collector.NewQueueFile(config.General.QueuePath)
+	}
+	if state.LastRun.IsZero() {
+		state.LastRun = config.General.Schedule.Next(time.Now()).Add(-config.General.Interval)
+	}
+
+	// open database connection
+	dbConfig := collector.DBConfig{
+		Driver:   config.DB.Driver,
+		Server:   config.DB.Server,
+		Port:     config.DB.Port,
+		Instance: config.DB.Instance,
+		User:     config.DB.User,
+		Password: config.DB.Password,
+		Database: config.DB.Database,
+
+		Encrypt:                config.DB.Encrypt,
+		TrustServerCertificate: config.DB.TrustServerCertificate,
+
+		MaxOpenConns:    config.DB.MaxOpenConns,
+		MaxIdleConns:    config.DB.MaxIdleConns,
+		ConnMaxLifetime: config.DB.ConnMaxLifetime,
+
+		ConnectRetries:    config.DB.ConnectRetries,
+		ConnectRetryDelay: config.DB.ConnectRetryDelay,
+
+		QueryTimeout: config.DB.QueryTimeout,
+		PageSize:     config.DB.PageSize,
+	}
+	db, err := collector.OpenSQL(ctx, dbConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to db")
+	}
+
+	// instantiate collector
+	c := collector.New(db, dbConfig, config.DB.Query)
+
+	// dry runs send nothing, so there is nothing to audit
+	var audit job.AuditLog
+	if config.DB.AuditTable != "" && !config.General.DryRun {
+		audit, err = collector.NewAuditLog(ctx, db, config.DB.Driver, config.DB.AuditTable)
+		if err != nil {
+			db.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	// instantiate emed-mailer
+	m := mailer.New(mailerConfig())
+
+	// run emed-mailer daemon
+	stop := make(chan struct{}, 1)
+	err = m.Run(stop)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not run mailer daemon")
+	}
+
+	// instantiate notifiers
+	notifiers, err := newNotifiers(m, audit)
+	if err != nil {
+		close(stop)
+		db.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	// instantiate job
+	var alerter job.Alerter
+	if len(config.General.AdminEmail) > 0 {
+		if alerter, err = newAlerter(m); err != nil {
+			close(stop)
+			db.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	changedApptsJob := job.New(job.Config{
+		StateStore:      stateStore,
+		DedupeRetention: config.General.DedupeRetention,
+		LookbackWindow:  config.General.LookbackWindow,
+		SkipIfRunning:   config.General.SkipIfRunning,
+		DryRun:          config.General.DryRun,
+		DryRunCommit:    config.General.DryRunCommit,
+		Alerter:         alerter,
+		Queue:           queue,
+		QueueMaxAge:     config.General.QueueMaxAge,
+		// a database going away between or during runs is reconnected like on startup
+		CollectRetries:    config.DB.ConnectRetries,
+		CollectRetryDelay: config.DB.ConnectRetryDelay,
+	}, c, notifiers, state)
+
+	var reminders *job.Reminders
+	if config.Reminder.Enabled {
+		if reminders, err = newReminders(db, dbConfig, m); err != nil {
+			close(stop)
+			db.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	tracing, err := newTracerProvider(ctx)
+	if err != nil {
+		close(stop)
+		db.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return &services{
+		ctx:    ctx,
+		db:     db,
+		mailer: m,
+		job:    changedApptsJob,
+		stop:   stop,
+		audit:  audit,
+
+		collector: c,
+		templates: template.NewWatch(templatePaths()...),
+		heartbeat: job.NewHeartbeat(changedApptsJob, config.General.AdminEmail, m),
+		reminders: reminders,
+		tracing:   tracing,
+		started:   time.Now(),
+	}, nil
+}
+
+// newAlerter parses the optional alert templates and instantiates the alerter of failed runs
+func newAlerter(m job.Mailer) (job.Alerter, error) {
+	cfg := job.AlertConfig{
+		To:       config.General.AdminEmail,
+		Interval: config.General.AlertInterval,
+	}
+
+	var err error
+	if config.General.AdminSubject != "" {
+		if cfg.SubjectTemplate, err = template.Inline("alert subject", config.General.AdminSubject); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if config.General.AdminTemplate != "" {
+		if cfg.TextTemplate, err = template.Text("alert", config.General.AdminTemplate); err != nil {
+			return nil, errors.Wrap(err, "could not load alert template")
+		}
+	}
+
+	return job.NewMailAlerter(cfg, m), nil
+}
+
+// newReminders parses the reminder templates and instantiates the reminders resuming from their state file
+func newReminders(db *sql.DB, dbConfig collector.DBConfig, m job.Mailer) (*job.Reminders, error) {
+	state, err := collector.NewStateFile(config.Reminder.StatePath).LoadState()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load reminder state")
+	}
+
+	subjectTmpl, err := template.Inline("reminder subject", config.Reminder.Subject)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse reminder subject template")
+	}
+	textTmpl, err := template.Text("reminder.txt.tmpl", config.Reminder.TemplateText)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load reminder text template")
+	}
+	htmlTmpl, err := template.HTML("reminder.tmpl", config.Reminder.TemplateHTML)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load reminder html template")
+	}
+
+	return job.NewReminders(job.ReminderConfig{
+		LeadTime:        config.Reminder.LeadTime,
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		HTMLTemplate:    htmlTmpl,
+		StateStore:      collector.NewStateFile(config.Reminder.StatePath),
+		DryRun:          config.General.DryRun,
+	}, collector.NewReminderCollector(db, dbConfig, config.Reminder.Query), m, state), nil
+}
+
+// newNotifiers parses the templates and instantiates the configured notifiers
+// templates are parsed once, so broken templates fail at startup or reload
+func newNotifiers(m *mailer.TextMailer, audit job.AuditLog) ([]job.Notifier, error) {
+	mailNotifier, err := newMailNotifier(m, audit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	notifiers := []job.Notifier{mailNotifier}
+	if config.Webhook.URL != "" {
+		notifiers = append(notifiers, webhook.New(webhook.Config{
+			URL:          config.Webhook.URL,
+			Timeout:      config.Webhook.Timeout,
+			MaxRetries:   config.Webhook.MaxRetries,
+			RetryBackoff: config.Webhook.RetryBackoff,
+			DryRun:       config.General.DryRun,
+		}))
+	}
+	if config.Slack.WebhookURL != "" {
+		notifiers = append(notifiers, slack.New(slack.Config{
+			WebhookURL:   config.Slack.WebhookURL,
+			Timeout:      config.Slack.Timeout,
+			MaxRetries:   config.Slack.MaxRetries,
+			RetryBackoff: config.Slack.RetryBackoff,
+			Interval:     config.Slack.Interval,
+			DryRun:       config.General.DryRun,
+		}))
+	}
+
+	return notifiers, nil
+}
+
+// newMailNotifier parses the templates and instantiates the mail notifier sending through m
+func newMailNotifier(m job.Mailer, audit job.AuditLog) (job.Notifier, error) {
+	subjectTmpl, err := template.Inline("subject", config.Mail.Subject)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse subject template")
+	}
+	textTmpl, err := template.Text("changedappts.txt.tmpl", config.Mail.TemplateText)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load text template")
+	}
+	htmlTmpl, err := template.HTML("changedappts.tmpl", config.Mail.TemplateHTML)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load html template")
+	}
+	booked, err := route("booked", config.MailBooked)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cancelled, err := route("cancelled", config.MailCancelled)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var calendar *job.CalendarConfig
+	if config.Mail.Calendar {
+		calendar = &job.CalendarConfig{
+			Duration: config.Mail.CalendarDuration,
+		}
+		if from, err := netmail.ParseAddress(config.Mail.From); err == nil {
+			calendar.Organizer = from.Address
+		}
+	}
+
+	return job.NewMailNotifier(job.MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		HTMLTemplate:    htmlTmpl,
+		Digest:          config.Mail.Digest,
+		Booked:          booked,
+		Cancelled:       cancelled,
+		ProviderTo:      config.Mail.Routing,
+		Calendar:        calendar,
+		Concurrency:     config.Mail.Concurrency,
+		Audit:           audit,
+		Recipients:      defaultRecipients(),
+		CC:              config.Mail.CC,
+		BCC:             config.Mail.BCC,
+
+		SubjectPrefixBooked:    config.Mail.SubjectPrefixBooked,
+		SubjectPrefixCancelled: config.Mail.SubjectPrefixCancelled,
+	}, m), nil
+}
+
+// Run executes the job once, tracking it for shutdown
+func (s *services) Run() {
+	if !s.track() {
+		return
+	}
+	defer s.running.Done()
+
+	s.reloadTemplates()
+	s.job.Run(s.ctx)
+}
+
+// Remind sends the due reminders once, tracking it for shutdown
+func (s *services) Remind() {
+	if !s.track() {
+		return
+	}
+	defer s.running.Done()
+
+	s.reminders.Run(s.ctx)
+}
+
+// track adds a run to running, it refuses runs once Close started
+func (s *services) track() bool {
+	s.closingMu.Lock()
+	defer s.closingMu.Unlock()
+
+	if s.closing {
+		log.Debug().
+			Msg("shutting down, skipping run")
+
+		return false
+	}
+	s.running.Add(1)
+	return true
+}
+
+// reloadTemplates replaces the notifiers if a template file changed
+// templates failing to parse are logged and the last good ones stay in effect
+func (s *services) reloadTemplates() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if !s.templates.Changed() {
+		return
+	}
+
+	notifiers, err := newNotifiers(s.mailer, s.audit)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not reload templates, keeping the previous ones")
+
+		return
+	}
+	s.job.SetNotifiers(notifiers)
+
+	log.Info().
+		Msg("reloaded templates")
+}
+
+// schedule replaces the cron entries of the job and the heartbeat by the configured schedules
+func (s *services) schedule(cr *cron.Cron) {
+	for _, id := range s.entries {
+		cr.Remove(id)
+	}
+
+	s.entries = []cron.EntryID{cr.Schedule(config.General.Schedule, cron.FuncJob(s.Run))}
+	if s.reminders != nil {
+		s.entries = append(s.entries, cr.Schedule(config.General.Schedule, cron.FuncJob(s.Remind)))
+	}
+	if config.General.HeartbeatSchedule != nil {
+		s.entries = append(s.entries, cr.Schedule(config.General.HeartbeatSchedule, cron.FuncJob(s.heartbeat.Run)))
+	}
+}
+
+// Reload loads the configuration again and applies the settings which can change at runtime:
+// the schedules, the log level, the time format, the recipients, the templates and the secrets redacted from the log
+// an invalid configuration is logged and the previous one stays in effect
+func (s *services) Reload(cr *cron.Cron) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	// dry run requires a restart, it also keeps a --dry-run flag in effect
+	dryRun := config.General.DryRun
+	if err := config.Reload(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not reload configuration, keeping the previous one")
+
+		return
+	}
+	config.General.DryRun = dryRun
+	logWriter.AddSecrets(config.Secrets()...)
+	if logLevel != "" {
+		config.Log.Level = logLevel
+	}
+
+	notifiers, err := newNotifiers(s.mailer, s.audit)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not reload templates, keeping the previous ones")
+	} else {
+		s.job.SetNotifiers(notifiers)
+	}
+	// template paths may have changed as well
+	s.templates = template.NewWatch(templatePaths()...)
+
+	if logLvl, err := zerolog.ParseLevel(config.Log.Level); err == nil {
+		zerolog.SetGlobalLevel(logLvl)
+	}
+	template.SetTimeFormat(config.General.TimeLayout, config.General.Location)
+	s.mailer.SetRecipients(config.Mail.To, config.Mail.CC, config.Mail.BCC)
+	s.schedule(cr)
+
+	for _, warning := range config.Warnings {
+		log.Warn().
+			Msg(warning)
+	}
+
+	log.Info().
+		Msg("reloaded configuration")
+}
+
+// Close waits for running jobs and pending messages, stops the mailer daemon
+// and closes the database connection
+// waiting is bounded by the configured shutdown timeout
+func (s *services) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), config.General.ShutdownTimeout)
+	defer cancel()
+
+	s.closingMu.Lock()
+	s.closing = true
+	s.closingMu.Unlock()
+
+	jobsDone := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(jobsDone)
+	}()
+
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		log.Warn().
+			Msg("shutdown timeout elapsed while waiting for running job")
+	}
+
+	close(s.stop)
+
+	select {
+	case <-s.mailer.Done():
+	case <-ctx.Done():
+		log.Error().
+			Int("dropped", s.mailer.Pending()).
+			Msg("shutdown timeout elapsed, dropping pending messages")
+	}
+
+	if s.tracing != nil {
+		// export the spans of the last runs
+		if err := s.tracing.Shutdown(ctx); err != nil {
+			log.Error().
+				Err(err).
+				Msg("could not export pending spans")
+		}
+	}
+
+	s.db.Close()
+}
+
+// route parses the templates of a mail route, it returns nil if nothing is overridden
+func route(name string, cfg *config.MailRoute) (*job.Route, error) {
+	r := &job.Route{
+		To:  cfg.To,
+		CC:  cfg.CC,
+		BCC: cfg.BCC,
+	}
+
+	var err error
+	if cfg.Subject != "" {
+		if r.SubjectTemplate, err = template.Inline(name+" subject", cfg.Subject); err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s subject template", name)
+		}
+	}
+	if cfg.TemplateText != "" {
+		if r.TextTemplate, err = template.Text(name+".txt.tmpl", cfg.TemplateText); err != nil {
+			return nil, errors.Wrapf(err, "could not load %s text template", name)
+		}
+	}
+	if cfg.TemplateHTML != "" {
+		if r.HTMLTemplate, err = template.HTML(name+".tmpl", cfg.TemplateHTML); err != nil {
+			return nil, errors.Wrapf(err, "could not load %s html template", name)
+		}
+	}
+
+	if len(r.To) == 0 && r.SubjectTemplate == nil && r.TextTemplate == nil && r.HTMLTemplate == nil {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// templatePaths returns the configured template files
+func templatePaths() []string {
+	return []string{
+		config.Mail.TemplateText,
+		config.Mail.TemplateHTML,
+		config.MailBooked.TemplateText,
+		config.MailBooked.TemplateHTML,
+		config.MailCancelled.TemplateText,
+		config.MailCancelled.TemplateHTML,
+	}
+}
+
+// defaultRecipients returns all recipients configured in [mail]
+func defaultRecipients() []string {
+	recipients := make([]string, 0, len(config.Mail.To)+len(config.Mail.CC)+len(config.Mail.BCC))
+	recipients = append(recipients, config.Mail.To...)
+	recipients = append(recipients, config.Mail.CC...)
+	return append(recipients, config.Mail.BCC...)
+}
+
+// mailerFallbacks maps the configured fallback servers
+func mailerFallbacks() []mailer.Fallback {
+	fallbacks := make([]mailer.Fallback, 0, len(config.Mail.Fallbacks))
+	for _, f := range config.Mail.Fallbacks {
+		fallbacks = append(fallbacks, mailer.Fallback{
+			Server:   f.Server,
+			Port:     f.Port,
+			User:     f.User,
+			Password: f.Password,
+		})
+	}
+	return fallbacks
+}
+
+// mailerConfig maps the loaded configuration to the mailer configuration
+func mailerConfig() mailer.Config {
+	return mailer.Config{
+		Server:   config.Mail.Server,
+		Port:     config.Mail.Port,
+		User:     config.Mail.User,
+		Password: config.Mail.Password,
+		AuthType: config.Mail.AuthType,
+
+		Fallbacks: mailerFallbacks(),
+
+		OAuthTokenURL:     config.Mail.OAuthTokenURL,
+		OAuthClientID:     config.Mail.OAuthClientID,
+		OAuthClientSecret: config.Mail.OAuthClientSecret,
+		OAuthScope:        config.Mail.OAuthScope,
+
+		Encryption:         config.Mail.Encryption,
+		InsecureSkipVerify: config.Mail.InsecureSkipVerify,
+		HeloHost:           config.Mail.HeloHost,
+		Proxy:              config.Mail.Proxy,
+		DialTimeout:        config.Mail.DialTimeout,
+		Timeout:            config.Mail.Timeout,
+
+		ConnectRetries: config.Mail.ConnectRetries,
+		SendRetries:    config.Mail.SendRetries,
+		RetryBackoff:   config.Mail.RetryBackoff,
+		IdleTimeout:    config.Mail.IdleTimeout,
+		KeepAlive:      config.Mail.KeepAlive,
+		Concurrency:    config.Mail.Concurrency,
+		RateLimit:      config.Mail.RateLimit,
+		Burst:          config.Mail.Burst,
+
+		BreakerThreshold: config.Mail.BreakerThreshold,
+		BreakerCooldown:  config.Mail.BreakerCooldown,
+
+		DryRun: config.General.DryRun,
+
+		From:    config.Mail.From,
+		To:      config.Mail.To,
+		CC:      config.Mail.CC,
+		BCC:     config.Mail.BCC,
+		Subject: config.Mail.Subject,
+		ReplyTo: config.Mail.ReplyTo,
+		Headers: config.Mail.Headers,
+
+		FromName:         config.Mail.FromName,
+		MessageIDDomain:  config.Mail.MessageIDDomain,
+		Charset:          config.Mail.Charset,
+		TransferEncoding: config.Mail.TransferEncoding,
+	}
+}
+
+// status returns the status of the last run, unhealthy if it failed or is older than STATUS_MAX_AGE
+func (s *services) status() (interface{}, error) {
+	// the handler runs concurrently to reloads, which replace the configuration under reloadMu
+	s.reloadMu.Lock()
+	maxAge := config.General.StatusMaxAge
+	s.reloadMu.Unlock()
+
+	return server.NewRunStatus(s.job.Stats(), s.started, maxAge, s.redact)
+}
+
+// redact returns the message of the error without the configured secrets
+// the http handlers run concurrently to reloads, which replace the configuration under reloadMu
+func (s *services) redact(err error) string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	return redacted(err)
+}
+
+// readinessChecks returns the checks run by the readiness endpoint
+func (s *services) readinessChecks() map[string]server.Check {
+	checks := map[string]server.Check{
+		"db": func(ctx context.Context) error {
+			return errors.Wrap(s.db.PingContext(ctx), "could not ping db")
+		},
+	}
+
+	if config.General.ReadyCheckSMTP {
+		// authenticates like sending does, so a wrong password fails the check
+		checks["smtp"] = s.mailer.Probe
+	}
+
+	return checks
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/mailer"
+
+	"github.com/urfave/cli/v2"
+)
+
+// testSMTPCmd sends a test message to verify the mail settings
+var testSMTPCmd = &cli.Command{
+	Name:  "test-smtp",
+	Usage: "send a test message using the configured mail settings",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "send the test message to this address instead of the configured recipients",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		logFile, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		cfg := mailerConfig()
+		if to := ctx.String("to"); to != "" {
+			cfg.To = []string{to}
+			cfg.CC = nil
+			cfg.BCC = nil
+		}
+
+		m := mailer.New(cfg)
+		stop := make(chan struct{})
+		if err := m.Run(stop); err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nCould not run mailer daemon.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+		defer close(stop)
+
+		receipt, err := m.SendMessage(&job.Message{
+			Subject: "emed-mailer test message",
+			Text:    fmt.Sprintf("This is a test message sent by emed-mailer at %s.\n", time.Now().Format(time.RFC1123)),
+		})
+		if err != nil {
+			fmt.Fprintf(ctx.App.Writer, "\nSending test message failed.\n%s\n\n", redacted(err))
+			return cli.Exit("", 1)
+		}
+
+		fmt.Fprintf(ctx.App.Writer, "Test message %s sent to %s\n", receipt.MessageID, strings.Join(append(append(cfg.To, cfg.CC...), cfg.BCC...), ", "))
+		if receipt.Response != "" {
+			fmt.Fprintf(ctx.App.Writer, "Server replied: %s\n", receipt.Response)
+		}
+		return nil
+	},
+}
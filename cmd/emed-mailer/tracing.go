@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/emed-appts/emed-mailer/internal/config"
+	"github.com/emed-appts/emed-mailer/internal/version"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// newTracerProvider registers a tracer provider exporting the spans to the OTLP endpoint
+// it returns nil if tracing is disabled, spans are no-ops then
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if config.Tracing.Endpoint == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.Tracing.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse tracing endpoint")
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	// the exporter connects on export, an unreachable collector does not fail startup
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create trace exporter")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("emed-mailer"),
+			semconv.ServiceVersionKey.String(version.Version.String()),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/emed-appts/emed-mailer/internal/version"
+
+	"github.com/urfave/cli/v2"
+)
+
+// versionCmd prints the build metadata, e.g. for support tickets
+var versionCmd = &cli.Command{
+	Name:  "version",
+	Usage: "print the version, commit, build time and go version",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the build metadata as json",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		info := version.Get()
+
+		if ctx.Bool("json") {
+			enc := json.NewEncoder(ctx.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+
+		buildTime := info.BuildTime
+		if buildTime == "" {
+			buildTime = "unknown"
+		}
+		fmt.Fprintf(ctx.App.Writer, "version:    %s\n", info.Version)
+		fmt.Fprintf(ctx.App.Writer, "commit:     %s\n", info.Commit)
+		fmt.Fprintf(ctx.App.Writer, "build time: %s\n", buildTime)
+		fmt.Fprintf(ctx.App.Writer, "go version: %s\n", info.GoVersion)
+		return nil
+	},
+}
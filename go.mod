@@ -4,18 +4,31 @@ go 1.13
 
 require (
 	4d63.com/tz v1.0.0
+	github.com/BurntSushi/toml v0.3.1
 	github.com/coreos/go-semver v0.3.0
+	github.com/coreos/go-systemd/v22 v22.1.0
 	github.com/denisenkom/go-mssqldb v0.0.0-20190515213511-eb9f6a1743f3
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gobuffalo/packr v1.30.1
 	github.com/gobuffalo/syncx v0.0.0-20190224160051-33c29581e754 // indirect
 	github.com/kardianos/minwinsvc v0.0.0-20151122163309-cad6b2b879b0
-	github.com/pkg/errors v0.8.1
+	github.com/lib/pq v1.3.0
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/rs/zerolog v1.14.3
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli/v2 v2.0.0
-	golang.org/x/sys v0.0.0-20190516110030-61b9204099cb // indirect
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/ini.v1 v1.51.0
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5
+	gopkg.in/yaml.v2 v2.2.5
+	honnef.co/go/netdb v0.0.0-20150201073656-a416d700ae39 // indirect
+	modernc.org/sqlite v1.10.8
 )
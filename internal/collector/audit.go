@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+)
+
+type auditLog struct {
+	db     *sql.DB
+	insert string
+}
+
+// NewAuditLog creates an audit log writing to the given table, which is created if missing
+func NewAuditLog(ctx context.Context, db *sql.DB, driver, table string) (job.AuditLog, error) {
+	if _, err := db.ExecContext(ctx, auditSchema(driver, table)); err != nil {
+		return nil, errors.Wrapf(err, "could not create audit table %s", table)
+	}
+
+	return &auditLog{
+		db:     db,
+		insert: auditInsert(driver, table),
+	}, nil
+}
+
+// Record inserts the entries within one transaction
+func (audit *auditLog) Record(ctx context.Context, entries []*job.AuditEntry) error {
+	tx, err := audit.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin audit transaction")
+	}
+
+	for _, entry := range entries {
+		changeType := "cancelled"
+		if entry.IsBooking {
+			changeType = "booked"
+		}
+		var failure sql.NullString
+		if entry.Err != nil {
+			failure = sql.NullString{String: entry.Err.Error(), Valid: true}
+		}
+
+		if _, err := tx.ExecContext(ctx, audit.insert,
+			entry.ApptID,
+			changeType,
+			strings.Join(entry.Recipients, ", "),
+			entry.Time,
+			entry.Err == nil,
+			failure,
+		); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "could not insert audit entry")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "could not commit audit entries")
+}
+
+// auditSchema returns the statement creating the audit table in the dialect of the driver
+func auditSchema(driver, table string) string {
+	switch driver {
+	case DriverPostgres:
+		return "CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"appt_id VARCHAR(255) NOT NULL, change_type VARCHAR(16) NOT NULL, recipients TEXT NOT NULL, " +
+			"sent_at TIMESTAMPTZ NOT NULL, success BOOLEAN NOT NULL, error TEXT NULL)"
+	case DriverMySQL:
+		return "CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"appt_id VARCHAR(255) NOT NULL, change_type VARCHAR(16) NOT NULL, recipients TEXT NOT NULL, " +
+			"sent_at DATETIME(6) NOT NULL, success BOOLEAN NOT NULL, error TEXT NULL)"
+	case DriverSQLite:
+		return "CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"appt_id TEXT NOT NULL, change_type TEXT NOT NULL, recipients TEXT NOT NULL, " +
+			"sent_at DATETIME NOT NULL, success BOOLEAN NOT NULL, error TEXT NULL)"
+	}
+	return "IF OBJECT_ID(N'" + table + "', N'U') IS NULL CREATE TABLE " + table + " (" +
+		"appt_id NVARCHAR(255) NOT NULL, change_type NVARCHAR(16) NOT NULL, recipients NVARCHAR(MAX) NOT NULL, " +
+		"sent_at DATETIME2 NOT NULL, success BIT NOT NULL, error NVARCHAR(MAX) NULL)"
+}
+
+// auditInsert returns the statement inserting an audit entry in the dialect of the driver
+func auditInsert(driver, table string) string {
+	params := make([]string, 6)
+	for i := range params {
+		params[i] = placeholder(driver, i+1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (appt_id, change_type, recipients, sent_at, success, error) VALUES (%s)",
+		table, strings.Join(params, ", "))
+}
@@ -0,0 +1,19 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditInsert(t *testing.T) {
+	assert.Equal(t,
+		"INSERT INTO audit (appt_id, change_type, recipients, sent_at, success, error) VALUES (@p1, @p2, @p3, @p4, @p5, @p6)",
+		auditInsert(DriverMSSQL, "audit"))
+	assert.Equal(t,
+		"INSERT INTO audit (appt_id, change_type, recipients, sent_at, success, error) VALUES ($1, $2, $3, $4, $5, $6)",
+		auditInsert(DriverPostgres, "audit"))
+	assert.Equal(t,
+		"INSERT INTO audit (appt_id, change_type, recipients, sent_at, success, error) VALUES (?, ?, ?, ?, ?, ?)",
+		auditInsert(DriverMySQL, "audit"))
+}
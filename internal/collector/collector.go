@@ -1,12 +1,15 @@
 package collector
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
 	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/metrics"
 
 	"github.com/pkg/errors"
 )
@@ -18,57 +21,281 @@ type logEntry struct {
 	time    string
 	pid     int
 	txt     string
+
+	// optional columns of custom queries
+	provider sql.NullString
+	location sql.NullString
+	previous sql.NullTime
+	apptID   sql.NullString
+}
+
+// requiredColumns is the number of columns every query selects
+const requiredColumns = 6
+
+// dest returns the scan destinations of the first n columns of the query
+// custom queries may select provider, location, the previous appointment and the appointment id after the required columns, in this order
+func (entry *logEntry) dest(n int) ([]interface{}, error) {
+	dest := []interface{}{
+		&entry.logTime, &entry.action, &entry.date, &entry.time, &entry.pid, &entry.txt,
+		&entry.provider, &entry.location, &entry.previous, &entry.apptID,
+	}
+	if n < requiredColumns || n > len(dest) {
+		return nil, errors.Errorf("query selects %d columns, expected %d to %d", n, requiredColumns, len(dest))
+	}
+	return dest[:n], nil
 }
 
 type dbCollector struct {
-	db *sql.DB
+	db    *sql.DB
+	cfg   DBConfig
+	query string
+	// pageQuery limits query to a page of DBConfig.PageSize rows
+	pageQuery string
 }
 
-// New creates a collector instance
-func New(db *sql.DB) job.Collector {
-	return &dbCollector{db}
+// New creates a collector instance querying the database opened by OpenSQL with the same config
+// the driver of the config defines the sql dialect, an empty query uses DefaultQuery of the driver
+func New(db *sql.DB, cfg DBConfig, query string) job.Collector {
+	if query == "" {
+		query = DefaultQuery(cfg.Driver)
+	}
+	return &dbCollector{
+		db:    db,
+		cfg:   cfg,
+		query: query,
+
+		pageQuery: pageQuery(cfg.Driver, query, cfg.PageSize),
+	}
+}
+
+// pageQuery appends the row limit of a page to the query, which has to end with its ORDER BY clause
+func pageQuery(driver, query string, size int) string {
+	query = strings.TrimRight(query, "; \t\r\n")
+	switch driver {
+	case DriverMSSQL, "":
+		return fmt.Sprintf("%s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", query, size)
+	}
+	return fmt.Sprintf("%s LIMIT %d", query, size)
+}
+
+// DefaultQuery returns the built-in query for the pds6 schema
+// custom queries must select the same columns in the same order and take the last run as first parameter
+// they may select provider, location, the previous appointment and the appointment id as additional columns
+func DefaultQuery(driver string) string {
+	return "SELECT datlog, action, datum, zeit, pid, txt FROM pds6_kallog WHERE usc = 'eT' AND datlog > " + placeholder(driver, 1) + " ORDER BY datlog ASC"
 }
 
 // CollectChangedAppts gathers changed appointments since `lastRun`
-func (collector *dbCollector) CollectChangedAppts(lastRun time.Time) ([]*job.ApptChange, error) {
-	// fetch all changed appointments since `lastRun`
-	rows, err := collector.db.Query("SELECT datlog, action, datum, zeit, pid, txt FROM pds6_kallog WHERE usc = 'eT' AND datlog > @p1 ORDER BY datlog ASC", lastRun)
+// after a connection failure, e.g. a database failover or restart, the next collection connects again
+func (collector *dbCollector) CollectChangedAppts(ctx context.Context, lastRun time.Time) ([]*job.ApptChange, error) {
+	p, err := collector.run(ctx, collector.query, lastRun)
+	if err != nil {
+		return nil, err
+	}
+	return p.changes, nil
+}
+
+// CollectChangedApptsPage gathers up to DBConfig.PageSize changed appointments since `lastRun` like CollectChangedAppts
+// without a page size the page holds all of them
+func (collector *dbCollector) CollectChangedApptsPage(ctx context.Context, lastRun time.Time) ([]*job.ApptChange, bool, error) {
+	if collector.cfg.PageSize <= 0 {
+		changedAppts, err := collector.CollectChangedAppts(ctx, lastRun)
+		return changedAppts, false, err
+	}
+
+	p, err := collector.run(ctx, collector.pageQuery, lastRun)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.rows < collector.cfg.PageSize {
+		return p.changes, false, nil
+	}
+
+	// the next page starts after the time of the last change, so changes logged at the same time
+	// as the last row are left to it, they may continue beyond the limit
+	changedAppts := p.changes
+	for len(changedAppts) > 0 && !changedAppts[len(changedAppts)-1].Time.Before(p.last) {
+		changedAppts = changedAppts[:len(changedAppts)-1]
+	}
+	if len(changedAppts) == 0 {
+		job.Logger(ctx).Warn().
+			Int("pageSize", collector.cfg.PageSize).
+			Time("logTime", p.last).
+			Msg("page only holds changes logged at the same time, collecting all changes at once")
+
+		changedAppts, err := collector.CollectChangedAppts(ctx, lastRun)
+		return changedAppts, false, err
+	}
+	return changedAppts, true, nil
+}
+
+// page holds the changes of a query, rows counts the rows including malformed ones and last is the time of the last row
+type page struct {
+	changes []*job.ApptChange
+	rows    int
+	last    time.Time
+}
+
+// run runs the query limited by the query timeout
+func (collector *dbCollector) run(ctx context.Context, query string, lastRun time.Time) (*page, error) {
+	ctx, span := startQuerySpan(ctx, "collector.changed_appts", collector.cfg)
+	var p *page
+	timedOut, err := withQueryTimeout(ctx, collector.cfg, func(ctx context.Context) error {
+		var err error
+		p, err = collector.collect(ctx, query, lastRun)
+		return err
+	})
+	var count int
+	if p != nil {
+		count = len(p.changes)
+	}
+	endQuerySpan(span, count, err)
+	// a slow query says nothing about the connections
+	if errors.Is(err, job.ErrUnavailable) && !timedOut {
+		// the idle connections are most likely broken by the same cause
+		job.Logger(ctx).Warn().
+			Err(err).
+			Msg("database connection failed, reconnecting on next collection")
+
+		resetPool(collector.db, collector.cfg)
+	}
+	return p, err
+}
+
+// collect queries and converts the changed appointments
+func (collector *dbCollector) collect(ctx context.Context, query string, lastRun time.Time) (*page, error) {
+	loc, err := tzinfo.LoadLocation("Europe/Vienna")
 	if err != nil {
-		return nil, errors.Wrap(err, "could not query database")
+		return nil, errors.Wrap(err, "could not load location \"Europe/Vienna\"")
+	}
+
+	// fetch all changed appointments since `lastRun`, compared with the wall clock pds6 logs
+	rows, err := collector.db.QueryContext(ctx, query, wallClock(lastRun, loc))
+	if err != nil {
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "could not query database")
 	}
 	defer rows.Close()
 
-	var changedAppts []*job.ApptChange
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "could not get columns")
+	}
+
+	p := &page{}
+	var scanned, skipped int
+	var scanErr error
 	for rows.Next() {
 		entry := &logEntry{}
-		err := rows.Scan(&entry.logTime, &entry.action, &entry.date, &entry.time, &entry.pid, &entry.txt)
+		dest, err := entry.dest(len(columns))
 		if err != nil {
-			return nil, errors.Wrap(err, "could not scan database row")
+			return nil, errors.WithStack(&job.CollectError{Kind: job.ErrScanFailed, Err: err})
 		}
+		p.rows++
 
-		// txt contains <name>, <anything>
-		name := strings.SplitN(entry.txt, ",", 2)[0]
+		// a malformed row could never be notified, so it must not hold back the others
+		// the columns before a failing one are scanned, so the row can usually be identified
+		if err := rows.Scan(dest...); err != nil {
+			job.Logger(ctx).Error().
+				Err(err).
+				Int("patientID", entry.pid).
+				Time("logTime", entry.logTime).
+				Msg("skipping unscannable appointment row")
 
-		// string -> time.Time
-		t, err := parseTime(entry.time)
-		if err != nil {
-			return nil, errors.WithStack(err)
+			scanErr = err
+			skipped++
+			continue
 		}
+		scanned++
+		p.last = inLocation(entry.logTime, loc)
+
+		change, err := entry.change(loc)
+		if err != nil {
+			job.Logger(ctx).Error().
+				Err(err).
+				Int("patientID", entry.pid).
+				Time("logTime", entry.logTime).
+				Msg("skipping malformed appointment")
 
-		changedAppts = append(changedAppts, &job.ApptChange{
-			Time:        entry.logTime,
-			Appointment: entry.date.Add(timeDuration(t)),
-			PatientID:   entry.pid,
-			PatientName: name,
-			IsBooking:   entry.action == "eFill",
-		})
+			skipped++
+			continue
+		}
+		p.changes = append(p.changes, change)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, errors.Wrap(err, "row got an error")
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "row got an error")
+	}
+	if scanErr != nil && scanned == 0 {
+		// no row scans, so the query rather than the data is broken, e.g. a column of the wrong type
+		return nil, errors.Wrap(collectError(scanErr, job.ErrScanFailed), "could not scan any database row")
+	}
+	if skipped > 0 {
+		metrics.RowsSkipped.Add(float64(skipped))
+		job.Logger(ctx).Warn().
+			Int("collected", len(p.changes)).
+			Int("skipped", skipped).
+			Msg("skipped malformed appointments")
+	}
+
+	return p, nil
+}
+
+// withQueryTimeout runs the query limited by the query timeout of the config and reports whether it timed out
+// a timed out query fails with job.ErrUnavailable, so it gets retried
+func withQueryTimeout(ctx context.Context, cfg DBConfig, query func(context.Context) error) (bool, error) {
+	if cfg.QueryTimeout <= 0 {
+		return false, query(ctx)
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+	defer cancel()
+
+	err := query(queryCtx)
+	// drivers report the canceled query differently, e.g. as interrupted or canceled statement
+	if err != nil && queryCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return true, errors.Wrapf(&job.CollectError{Kind: job.ErrUnavailable, Err: err}, "query timed out after %s", cfg.QueryTimeout)
+	}
+	return false, err
+}
+
+// collectError classifies a database failure, connection failures are reported as job.ErrUnavailable regardless of the step
+func collectError(err error, kind error) error {
+	if unavailable(err) {
+		kind = job.ErrUnavailable
+	}
+	return &job.CollectError{Kind: kind, Err: err}
+}
+
+// change converts the row into a change, the times of the row are the wall clock of loc
+func (entry *logEntry) change(loc *time.Location) (*job.ApptChange, error) {
+	// txt contains <name>, <anything>
+	name := strings.SplitN(entry.txt, ",", 2)[0]
+
+	// string -> time.Time
+	t, err := parseTime(entry.time)
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
+	// the times get written to calendars and formatted in the configured timezone,
+	// so they have to be the actual instants in the timezone of pds6 like the start of reminders
+	appointment := time.Date(entry.date.Year(), entry.date.Month(), entry.date.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	var previous time.Time
+	if entry.previous.Valid {
+		previous = inLocation(entry.previous.Time, loc)
+	}
+
+	return &job.ApptChange{
+		Time:        inLocation(entry.logTime, loc),
+		Appointment: appointment,
+		PatientID:   entry.pid,
+		PatientName: name,
+		IsBooking:   entry.action == "eFill",
 
-	return changedAppts, nil
+		Provider:            strings.TrimSpace(entry.provider.String),
+		Location:            strings.TrimSpace(entry.location.String),
+		PreviousAppointment: previous,
+		ApptID:              strings.TrimSpace(entry.apptID.String),
+	}, nil
 }
 
 // parseTime parses Time expected to be in Timezone Europe/Vienna
@@ -82,6 +309,15 @@ func parseTime(value string) (time.Time, error) {
 	return t, errors.Wrap(err, "could not parse time")
 }
 
-func timeDuration(t time.Time) time.Duration {
-	return time.Hour*time.Duration(t.Hour()) + time.Minute*time.Duration(t.Minute())
+// inLocation returns the instant of the wall clock time in loc
+// the drivers return the date and time columns of pds6 as UTC, though they hold the wall clock of Europe/Vienna
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// wallClock returns the wall clock of the instant in loc as UTC, the reverse of inLocation
+// so a time like the last run compares to the columns of pds6 as they are stored
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
 }
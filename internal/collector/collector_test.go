@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEntry_Dest(t *testing.T) {
+	entry := &logEntry{}
+
+	dest, err := entry.dest(6)
+	assert.NoError(t, err)
+	assert.Len(t, dest, 6)
+
+	// the optional columns are scanned in order
+	dest, err = entry.dest(8)
+	assert.NoError(t, err)
+	assert.Equal(t, &entry.location, dest[7])
+	dest, err = entry.dest(10)
+	assert.NoError(t, err)
+	assert.Equal(t, &entry.apptID, dest[9])
+
+	_, err = entry.dest(5)
+	assert.EqualError(t, err, "query selects 5 columns, expected 6 to 10")
+	_, err = entry.dest(11)
+	assert.Error(t, err)
+}
+
+func TestLogEntry_Change(t *testing.T) {
+	date := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	entry := &logEntry{logTime: date, action: "eFill", date: date, time: "09:30", pid: 7, txt: "Lastname Firstname, Kontrolle"}
+	entry.apptID = sql.NullString{String: " 4711 ", Valid: true}
+	entry.previous = sql.NullTime{Time: date.Add(8 * time.Hour), Valid: true}
+	loc, err := tzinfo.LoadLocation("Europe/Vienna")
+	assert.NoError(t, err)
+
+	change, err := entry.change(loc)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "4711", change.ApptID)
+		assert.Equal(t, "Lastname Firstname", change.PatientName)
+		// the date and time of pds6 are the wall clock of Europe/Vienna
+		assert.True(t, time.Date(2026, 10, 5, 9, 30, 0, 0, loc).Equal(change.Appointment), change.Appointment)
+		assert.True(t, time.Date(2026, 10, 5, 8, 0, 0, 0, loc).Equal(change.PreviousAppointment), change.PreviousAppointment)
+		assert.True(t, change.IsBooking)
+	}
+
+	// malformed rows are reported, so the collector can skip them
+	entry.time = "9.30 Uhr"
+	_, err = entry.change(loc)
+	assert.Error(t, err)
+}
+
+func TestPageQuery(t *testing.T) {
+	assert.Equal(t,
+		"SELECT datlog FROM pds6_kallog WHERE datlog > @p1 ORDER BY datlog ASC OFFSET 0 ROWS FETCH NEXT 100 ROWS ONLY",
+		pageQuery(DriverMSSQL, "SELECT datlog FROM pds6_kallog WHERE datlog > @p1 ORDER BY datlog ASC;\n", 100))
+	assert.Equal(t,
+		"SELECT datlog FROM pds6_kallog WHERE datlog > $1 ORDER BY datlog ASC LIMIT 100",
+		pageQuery(DriverPostgres, "SELECT datlog FROM pds6_kallog WHERE datlog > $1 ORDER BY datlog ASC", 100))
+}
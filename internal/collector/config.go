@@ -1,10 +1,41 @@
 package collector
 
+import "time"
+
 // DBConfig struct encapsulate all settings for dbCollector
 type DBConfig struct {
+	// Driver selects the database, one of DriverMSSQL, DriverPostgres, DriverMySQL or DriverSQLite
+	Driver   string
 	Server   string
 	Port     int
 	User     string
 	Password string
+	// Database is the database name, or the path of the database file for DriverSQLite
 	Database string
+
+	// Instance is the named instance of DriverMSSQL, the SQL Server Browser resolves its port
+	// so Port is not used then
+	Instance string
+	// Encrypt encrypts the connection to DriverMSSQL, TrustServerCertificate skips the
+	// verification of the server certificate, e.g. for self-signed certificates
+	Encrypt                bool
+	TrustServerCertificate bool
+
+	// connection pool limits, zero keeps the default of database/sql
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// ConnectRetries is the number of additional pings on startup, waiting
+	// ConnectRetryDelay before the first retry and doubling it afterwards
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+
+	// QueryTimeout limits a collection including reading the rows, zero disables the limit
+	// a timed out collection fails with job.ErrUnavailable, so it gets retried
+	QueryTimeout time.Duration
+
+	// PageSize limits the rows of a collection, the following pages are collected after the time of the last change
+	// zero collects all changes at once
+	PageSize int
 }
@@ -1,35 +1,192 @@
 package collector
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
+	"time"
 
 	_ "github.com/denisenkom/go-mssqldb" // import mssql for database connection
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite" // import sqlite for database connection
 )
 
-// OpenSQL opens a mssql database connection by given config
-func OpenSQL(cfg DBConfig) (*sql.DB, error) {
-	query := url.Values{}
-	query.Add("database", cfg.Database)
-	query.Add("encrypt", "disable")
+const (
+	// DriverMSSQL connects to Microsoft SQL Server
+	DriverMSSQL = "mssql"
+	// DriverPostgres connects to PostgreSQL
+	DriverPostgres = "postgres"
+	// DriverMySQL connects to MySQL or MariaDB
+	DriverMySQL = "mysql"
+	// DriverSQLite opens the database file given by DBConfig.Database, e.g. for development or small installs
+	DriverSQLite = "sqlite"
+)
 
-	u := &url.URL{
-		Scheme:   "sqlserver",
-		User:     url.UserPassword(cfg.User, cfg.Password),
-		Host:     fmt.Sprintf("%s:%d", cfg.Server, cfg.Port),
-		RawQuery: query.Encode(),
+// OpenSQL opens a database connection by given config
+// an unreachable database is retried as configured, e.g. while it is still starting
+func OpenSQL(ctx context.Context, cfg DBConfig) (*sql.DB, error) {
+	driverName, dsn, err := dataSource(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	db, err := sql.Open("sqlserver", u.String())
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
-		return nil, errors.Wrap(err,"could not open db connection pool")
+		return nil, errors.Wrap(err, "could not open db connection pool")
 	}
+	configurePool(db, cfg)
 
-	if err := db.Ping(); err != nil {
+	if err := ping(ctx, db, cfg); err != nil {
 		db.Close()
-		return nil, errors.Wrap(err, "could not connect to sqlserver")
+		return nil, errors.Wrapf(err, "could not connect to %s", cfg.Driver)
 	}
 	return db, nil
 }
+
+// ping pings the database until it answers or the retries are used up
+func ping(ctx context.Context, db *sql.DB, cfg DBConfig) error {
+	delay := cfg.ConnectRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt > cfg.ConnectRetries {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Dur("delay", delay).
+			Msg("could not connect to database, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// unavailable reports whether err is caused by the connection to the database rather than by the query
+func unavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection exception or the server shutting down
+		return pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57"
+	}
+
+	for _, connErr := range []error{driver.ErrBadConn, sql.ErrConnDone, mysql.ErrInvalidConn, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded} {
+		if errors.Is(err, connErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetPool closes the idle connections of the pool, so later queries connect again
+func resetPool(db *sql.DB, cfg DBConfig) {
+	db.SetMaxIdleConns(0)
+
+	// 2 is the default of database/sql
+	idle := 2
+	if cfg.MaxIdleConns > 0 {
+		idle = cfg.MaxIdleConns
+	}
+	db.SetMaxIdleConns(idle)
+}
+
+// configurePool applies the configured connection pool limits
+// zero values keep the defaults of database/sql
+func configurePool(db *sql.DB, cfg DBConfig) {
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+}
+
+// dataSource returns the sql driver name and connection string of the configured driver
+func dataSource(cfg DBConfig) (string, string, error) {
+	switch cfg.Driver {
+	case DriverMSSQL, "":
+		query := url.Values{}
+		query.Add("database", cfg.Database)
+		if cfg.Encrypt {
+			query.Add("encrypt", "true")
+		} else {
+			query.Add("encrypt", "disable")
+		}
+		if cfg.TrustServerCertificate {
+			query.Add("TrustServerCertificate", "true")
+		}
+
+		u := &url.URL{
+			Scheme:   "sqlserver",
+			User:     url.UserPassword(cfg.User, cfg.Password),
+			Host:     fmt.Sprintf("%s:%d", cfg.Server, cfg.Port),
+			RawQuery: query.Encode(),
+		}
+		if cfg.Instance != "" {
+			// the port of named instances is resolved by the SQL Server Browser
+			u.Host = cfg.Server
+			u.Path = "/" + cfg.Instance
+		}
+		return "sqlserver", u.String(), nil
+	case DriverPostgres:
+		query := url.Values{}
+		query.Add("sslmode", "disable")
+
+		u := &url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(cfg.User, cfg.Password),
+			Host:     fmt.Sprintf("%s:%d", cfg.Server, cfg.Port),
+			Path:     "/" + cfg.Database,
+			RawQuery: query.Encode(),
+		}
+		return "postgres", u.String(), nil
+	case DriverMySQL:
+		mysqlCfg := mysql.NewConfig()
+		mysqlCfg.User = cfg.User
+		mysqlCfg.Passwd = cfg.Password
+		mysqlCfg.Net = "tcp"
+		mysqlCfg.Addr = fmt.Sprintf("%s:%d", cfg.Server, cfg.Port)
+		mysqlCfg.DBName = cfg.Database
+		// scan DATETIME columns into time.Time
+		mysqlCfg.ParseTime = true
+
+		return "mysql", mysqlCfg.FormatDSN(), nil
+	case DriverSQLite:
+		return "sqlite", cfg.Database, nil
+	}
+
+	return "", "", errors.Errorf("unknown database driver %q", cfg.Driver)
+}
+
+// placeholder returns the n-th positional query parameter in the syntax of the driver
+func placeholder(driver string, n int) string {
+	switch driver {
+	case DriverPostgres:
+		return fmt.Sprintf("$%d", n)
+	case DriverMySQL, DriverSQLite:
+		return "?"
+	}
+	return fmt.Sprintf("@p%d", n)
+}
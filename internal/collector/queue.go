@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+)
+
+type fileQueue struct {
+	path string
+}
+
+// NewQueueFile creates a Queue persisting the queued changes as json file at `path`
+func NewQueueFile(path string) job.Queue {
+	return &fileQueue{path}
+}
+
+// LoadQueue reads the queue file
+// a missing queue file results in an empty queue
+func (queue *fileQueue) LoadQueue() ([]*job.QueuedChange, error) {
+	data, err := ioutil.ReadFile(queue.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read queue file")
+	}
+
+	var changes []*job.QueuedChange
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, errors.Wrap(err, "could not decode queue file")
+	}
+	return changes, nil
+}
+
+// SaveQueue writes the queue file
+func (queue *fileQueue) SaveQueue(changes []*job.QueuedChange) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return errors.Wrap(err, "could not encode queue")
+	}
+
+	return errors.Wrap(replaceFile(queue.path, data), "could not write queue file")
+}
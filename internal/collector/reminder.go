@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/metrics"
+
+	"github.com/pkg/errors"
+)
+
+type apptEntry struct {
+	date  time.Time
+	time  string
+	pid   int
+	txt   string
+	email sql.NullString
+
+	// optional columns
+	provider sql.NullString
+	location sql.NullString
+}
+
+// requiredReminderColumns is the number of columns every reminder query selects
+const requiredReminderColumns = 5
+
+// dest returns the scan destinations of the first n columns of the query
+// queries may select provider and location after the required columns, in this order
+func (entry *apptEntry) dest(n int) ([]interface{}, error) {
+	dest := []interface{}{
+		&entry.date, &entry.time, &entry.pid, &entry.txt, &entry.email,
+		&entry.provider, &entry.location,
+	}
+	if n < requiredReminderColumns || n > len(dest) {
+		return nil, errors.Errorf("reminder query selects %d columns, expected %d to %d", n, requiredReminderColumns, len(dest))
+	}
+	return dest[:n], nil
+}
+
+type reminderCollector struct {
+	db    *sql.DB
+	cfg   DBConfig
+	query string
+}
+
+// NewReminderCollector creates a collector of upcoming appointments querying the database opened by OpenSQL
+// the query selects date, time, patient id, patient text and email of the patient like the pds6 schema, optionally followed by provider and location
+// it takes the start and the end of the window as first and second parameter and may select whole days, appointments outside the window are skipped
+func NewReminderCollector(db *sql.DB, cfg DBConfig, query string) job.ReminderCollector {
+	return &reminderCollector{
+		db:    db,
+		cfg:   cfg,
+		query: query,
+	}
+}
+
+// CollectUpcomingAppts gathers the appointments starting after `from` until `to`
+func (collector *reminderCollector) CollectUpcomingAppts(ctx context.Context, from, to time.Time) ([]*job.Appointment, error) {
+	ctx, span := startQuerySpan(ctx, "collector.upcoming_appts", collector.cfg)
+	var appts []*job.Appointment
+	_, err := withQueryTimeout(ctx, collector.cfg, func(ctx context.Context) error {
+		var err error
+		appts, err = collector.collect(ctx, from, to)
+		return err
+	})
+	endQuerySpan(span, len(appts), err)
+	return appts, err
+}
+
+// collect queries and converts the upcoming appointments
+func (collector *reminderCollector) collect(ctx context.Context, from, to time.Time) ([]*job.Appointment, error) {
+	rows, err := collector.db.QueryContext(ctx, collector.query, from, to)
+	if err != nil {
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "could not query database")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "could not get columns")
+	}
+
+	var appts []*job.Appointment
+	var scanned, skipped int
+	var scanErr error
+	for rows.Next() {
+		entry := &apptEntry{}
+		dest, err := entry.dest(len(columns))
+		if err != nil {
+			return nil, errors.WithStack(&job.CollectError{Kind: job.ErrScanFailed, Err: err})
+		}
+		if err := rows.Scan(dest...); err != nil {
+			job.Logger(ctx).Error().
+				Err(err).
+				Int("patientID", entry.pid).
+				Msg("skipping unscannable appointment row")
+
+			scanErr = err
+			skipped++
+			continue
+		}
+		scanned++
+
+		appt, err := entry.appointment()
+		if err != nil {
+			job.Logger(ctx).Error().
+				Err(err).
+				Int("patientID", entry.pid).
+				Msg("skipping malformed appointment")
+
+			continue
+		}
+		if !appt.Start.After(from) || appt.Start.After(to) {
+			continue
+		}
+		appts = append(appts, appt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(collectError(err, job.ErrQueryFailed), "row got an error")
+	}
+	if scanErr != nil && scanned == 0 {
+		return nil, errors.Wrap(collectError(scanErr, job.ErrScanFailed), "could not scan any database row")
+	}
+	if skipped > 0 {
+		metrics.RowsSkipped.Add(float64(skipped))
+		job.Logger(ctx).Warn().
+			Int("collected", len(appts)).
+			Int("skipped", skipped).
+			Msg("skipped unscannable appointments")
+	}
+
+	return appts, nil
+}
+
+// appointment converts the row into an appointment
+func (entry *apptEntry) appointment() (*job.Appointment, error) {
+	t, err := parseTime(entry.time)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	loc, err := tzinfo.LoadLocation("Europe/Vienna")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load location \"Europe/Vienna\"")
+	}
+
+	// the start is compared against the window, so it has to be the actual instant in the timezone of pds6
+	start := time.Date(entry.date.Year(), entry.date.Month(), entry.date.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+
+	return &job.Appointment{
+		Start:       start,
+		PatientID:   entry.pid,
+		PatientName: strings.SplitN(entry.txt, ",", 2)[0],
+		Email:       strings.TrimSpace(entry.email.String),
+
+		Provider: strings.TrimSpace(entry.provider.String),
+		Location: strings.TrimSpace(entry.location.String),
+	}, nil
+}
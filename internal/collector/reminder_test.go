@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectUpcomingAppts_SQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db")}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kal (datum DATE, zeit TEXT, pid INTEGER, txt TEXT, email TEXT, provider TEXT)")
+	assert.NoError(t, err)
+
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for _, row := range []struct {
+		zeit  string
+		pid   int
+		email interface{}
+	}{
+		// before the window
+		{"07:30", 1, "one@example.com"},
+		{"09:30", 2, "two@example.com"},
+		{"10:00", 3, nil},
+		// after the window
+		{"17:00", 4, "four@example.com"},
+	} {
+		_, err = db.Exec("INSERT INTO pds6_kal VALUES (?, ?, ?, ?, ?, ?)", day, row.zeit, row.pid, "Lastname Firstname, Kontrolle", row.email, " Dr. Huber ")
+		assert.NoError(t, err)
+	}
+
+	vienna, err := tzinfo.LoadLocation("Europe/Vienna")
+	if !assert.NoError(t, err) {
+		return
+	}
+	from := time.Date(2026, 10, 12, 8, 0, 0, 0, vienna)
+	to := from.Add(8 * time.Hour)
+
+	// selects the whole day, the window is applied after the query
+	query := "SELECT datum, zeit, pid, txt, email, provider FROM pds6_kal WHERE ? IS NOT NULL AND ? IS NOT NULL ORDER BY zeit"
+	appts, err := NewReminderCollector(db, cfg, query).CollectUpcomingAppts(ctx, from, to)
+	if assert.NoError(t, err) && assert.Len(t, appts, 2) {
+		assert.Equal(t, 2, appts[0].PatientID)
+		assert.True(t, time.Date(2026, 10, 12, 9, 30, 0, 0, vienna).Equal(appts[0].Start))
+		assert.Equal(t, "Lastname Firstname", appts[0].PatientName)
+		assert.Equal(t, "two@example.com", appts[0].Email)
+		assert.Equal(t, "Dr. Huber", appts[0].Provider)
+		assert.Empty(t, appts[0].Location)
+		assert.Equal(t, 3, appts[1].PatientID)
+		assert.Empty(t, appts[1].Email)
+	}
+
+	_, err = NewReminderCollector(db, cfg, "SELECT datum, zeit, pid FROM pds6_kal WHERE ? IS NOT NULL AND ? IS NOT NULL").CollectUpcomingAppts(ctx, from, to)
+	assert.Error(t, err)
+}
@@ -0,0 +1,341 @@
+package collector
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// pds6Location returns the timezone of the times pds6 stores
+func pds6Location(t *testing.T) *time.Location {
+	loc, err := tzinfo.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestCollectChangedAppts_SQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db")}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kallog (datlog DATETIME, action TEXT, datum DATE, zeit TEXT, pid INTEGER, txt TEXT, usc TEXT)")
+	assert.NoError(t, err)
+
+	// datlog holds the wall clock of Europe/Vienna
+	loc := pds6Location(t)
+	lastRun := time.Date(2026, 10, 5, 8, 0, 0, 0, loc)
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for _, row := range []struct {
+		logTime time.Time
+		action  string
+		pid     int
+		usc     string
+	}{
+		{lastRun.Add(-time.Minute), "eFill", 1, "eT"},
+		{lastRun.Add(time.Minute), "eFill", 2, "eT"},
+		{lastRun.Add(2 * time.Minute), "eDel", 3, "eT"},
+		// changed by the practice itself
+		{lastRun.Add(3 * time.Minute), "eFill", 4, "xx"},
+	} {
+		_, err = db.Exec("INSERT INTO pds6_kallog VALUES (?, ?, ?, ?, ?, ?, ?)", wallClock(row.logTime, loc), row.action, day, "09:30", row.pid, "Lastname Firstname, Kontrolle", row.usc)
+		assert.NoError(t, err)
+	}
+
+	changes, err := New(db, cfg, "").CollectChangedAppts(ctx, lastRun)
+	if assert.NoError(t, err) && assert.Len(t, changes, 2) {
+		assert.Equal(t, 2, changes[0].PatientID)
+		assert.True(t, changes[0].IsBooking)
+		assert.True(t, lastRun.Add(time.Minute).Equal(changes[0].Time))
+		assert.Equal(t, "Lastname Firstname", changes[0].PatientName)
+		assert.Equal(t, 3, changes[1].PatientID)
+		assert.False(t, changes[1].IsBooking)
+	}
+}
+
+func TestCollectChangedAppts_SQLite_Calendar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db")}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kallog (datlog DATETIME, action TEXT, datum DATE, zeit TEXT, pid INTEGER, txt TEXT, usc TEXT)")
+	assert.NoError(t, err)
+
+	// 09:30 in summer time is 07:30 UTC
+	loc := pds6Location(t)
+	lastRun := time.Date(2026, 7, 1, 8, 0, 0, 0, loc)
+	day := time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC)
+	_, err = db.Exec("INSERT INTO pds6_kallog VALUES (?, ?, ?, ?, ?, ?, ?)", wallClock(lastRun.Add(time.Minute), loc), "eFill", day, "09:30", 1, "Lastname Firstname", "eT")
+	assert.NoError(t, err)
+
+	changes, err := New(db, cfg, "").CollectChangedAppts(ctx, lastRun)
+	if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+		return
+	}
+
+	var msg *job.Message
+	m := &job.MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { msg = args.Get(0).(*job.Message) }).
+		Return(&job.Receipt{}, nil).
+		Once()
+	textTmpl, err := template.Inline("text", "{{ len .ChangedAppts }}")
+	assert.NoError(t, err)
+	notifier := job.NewMailNotifier(job.MailConfig{TextTemplate: textTmpl, Digest: true, Calendar: &job.CalendarConfig{Duration: 15 * time.Minute}}, m)
+	if !assert.NoError(t, notifier.Notify(ctx, lastRun, changes)) || !assert.Len(t, msg.Attachments, 1) {
+		return
+	}
+
+	ics := string(msg.Attachments[0].Data)
+	assert.Contains(t, ics, "DTSTART:20260715T073000Z\r\n")
+	assert.Contains(t, ics, "DTEND:20260715T074500Z\r\n")
+}
+
+func TestCollectChangedAppts_SQLite_FormatTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db")}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kallog (datlog DATETIME, action TEXT, datum DATE, zeit TEXT, pid INTEGER, txt TEXT, usc TEXT)")
+	assert.NoError(t, err)
+
+	loc := pds6Location(t)
+	lastRun := time.Date(2026, 7, 1, 8, 0, 0, 0, loc)
+	day := time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC)
+	_, err = db.Exec("INSERT INTO pds6_kallog VALUES (?, ?, ?, ?, ?, ?, ?)", wallClock(lastRun.Add(time.Minute), loc), "eFill", day, "09:30", 1, "Lastname Firstname", "eT")
+	assert.NoError(t, err)
+
+	changes, err := New(db, cfg, "").CollectChangedAppts(ctx, lastRun)
+	if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+		return
+	}
+
+	// the configured timezone shows the wall clock pds6 stored, not shifted by its offset
+	defer template.SetTimeFormat("02.01.2006 15:04", nil)
+	template.SetTimeFormat("02.01.2006 15:04", loc)
+	assert.Equal(t, "15.07.2026 09:30", template.FormatTime(changes[0].Appointment))
+	assert.Equal(t, "01.07.2026 08:01", template.FormatTime(changes[0].Time))
+
+	template.SetTimeFormat("02.01.2006 15:04", time.UTC)
+	assert.Equal(t, "15.07.2026 07:30", template.FormatTime(changes[0].Appointment))
+}
+
+func TestCollectChangedApptsPage_SQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db"), PageSize: 2}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kallog (datlog DATETIME, action TEXT, datum DATE, zeit TEXT, pid INTEGER, txt TEXT, usc TEXT)")
+	assert.NoError(t, err)
+
+	// datlog holds the wall clock of Europe/Vienna
+	loc := pds6Location(t)
+	lastRun := time.Date(2026, 10, 5, 8, 0, 0, 0, loc)
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for pid, logTime := range []time.Time{
+		lastRun.Add(time.Minute),
+		lastRun.Add(2 * time.Minute),
+		lastRun.Add(3 * time.Minute),
+		// logged at the same time
+		lastRun.Add(3 * time.Minute),
+		lastRun.Add(4 * time.Minute),
+	} {
+		_, err = db.Exec("INSERT INTO pds6_kallog VALUES (?, ?, ?, ?, ?, ?, ?)", wallClock(logTime, loc), "eFill", day, "09:30", pid+1, "Lastname Firstname", "eT")
+		assert.NoError(t, err)
+	}
+
+	c := New(db, cfg, "").(job.PageCollector)
+	collect := func(since time.Time) ([]int, bool) {
+		changes, more, err := c.CollectChangedApptsPage(ctx, since)
+		assert.NoError(t, err)
+		pids := make([]int, len(changes))
+		for i, change := range changes {
+			pids[i] = change.PatientID
+		}
+		return pids, more
+	}
+
+	// the last change of a full page is left to the next page, it may be followed by changes logged at the same time
+	pids, more := collect(lastRun)
+	assert.Equal(t, []int{1}, pids)
+	assert.True(t, more)
+
+	pids, more = collect(lastRun.Add(time.Minute))
+	assert.Equal(t, []int{2}, pids)
+	assert.True(t, more)
+
+	// a page of changes logged at the same time cannot be split, so all changes are collected at once
+	pids, more = collect(lastRun.Add(2 * time.Minute))
+	assert.Equal(t, []int{3, 4, 5}, pids)
+	assert.False(t, more)
+
+	pids, more = collect(lastRun.Add(3 * time.Minute))
+	assert.Equal(t, []int{5}, pids)
+	assert.False(t, more)
+}
+
+func TestResetPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db"), MaxIdleConns: 4}
+	db, err := OpenSQL(context.Background(), cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, 1, db.Stats().Idle)
+
+	// idle connections are closed, the next query connects again
+	resetPool(db, cfg)
+	assert.Equal(t, 0, db.Stats().Idle)
+	assert.NoError(t, db.Ping())
+	assert.Equal(t, 1, db.Stats().Idle)
+}
+
+func TestCollectChangedAppts_QueryTimeout(t *testing.T) {
+	// a live sqlite query is not canceled race free by the driver, so the query blocks by a stub driver
+	db := sql.OpenDB(blockingConnector{})
+	defer db.Close()
+
+	cfg := DBConfig{Driver: DriverSQLite, QueryTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := New(db, cfg, "").CollectChangedAppts(context.Background(), time.Now())
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, job.ErrUnavailable), "timeouts get retried")
+		assert.Contains(t, err.Error(), "query timed out after 50ms")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// blockingConnector opens connections whose queries block until canceled, like a query waiting for a lock
+type blockingConnector struct{}
+
+func (c blockingConnector) Connect(context.Context) (driver.Conn, error) {
+	return blockingConn{}, nil
+}
+
+func (c blockingConnector) Driver() driver.Driver {
+	return nil
+}
+
+type blockingConn struct{}
+
+func (conn blockingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (conn blockingConn) Close() error {
+	return nil
+}
+
+func (conn blockingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (conn blockingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCollectChangedAppts_SQLite_Unscannable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg := DBConfig{Driver: DriverSQLite, Database: filepath.Join(dir, "pds6.db")}
+	db, err := OpenSQL(ctx, cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE pds6_kallog (datlog DATETIME, action TEXT, datum DATE, zeit TEXT, pid INTEGER, txt TEXT, usc TEXT)")
+	assert.NoError(t, err)
+
+	// datlog holds the wall clock of Europe/Vienna
+	loc := pds6Location(t)
+	lastRun := time.Date(2026, 10, 5, 8, 0, 0, 0, loc)
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for i, pid := range []interface{}{1, nil, 3} {
+		_, err = db.Exec("INSERT INTO pds6_kallog VALUES (?, ?, ?, ?, ?, ?, ?)", wallClock(lastRun.Add(time.Duration(i+1)*time.Minute), loc), "eFill", day, "09:30", pid, "Lastname Firstname", "eT")
+		assert.NoError(t, err)
+	}
+
+	// the row without a patient id is skipped, the others are still notified
+	changes, err := New(db, cfg, "").CollectChangedAppts(ctx, lastRun)
+	if assert.NoError(t, err) && assert.Len(t, changes, 2) {
+		assert.Equal(t, 1, changes[0].PatientID)
+		assert.Equal(t, 3, changes[1].PatientID)
+	}
+
+	// no row scans, the query is broken
+	_, err = db.Exec("UPDATE pds6_kallog SET pid = NULL")
+	assert.NoError(t, err)
+	_, err = New(db, cfg, "").CollectChangedAppts(ctx, lastRun)
+	var collectErr *job.CollectError
+	if assert.True(t, errors.As(err, &collectErr)) {
+		assert.Equal(t, job.ErrScanFailed, collectErr.Kind)
+	}
+}
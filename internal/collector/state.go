@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+)
+
+type fileStateStore struct {
+	path string
+}
+
+// NewStateFile creates a StateStore persisting the state as json file at `path`
+func NewStateFile(path string) job.StateStore {
+	return &fileStateStore{path}
+}
+
+// LoadState reads the state file
+// a missing state file results in an empty state
+func (store *fileStateStore) LoadState() (*job.State, error) {
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return &job.State{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read state file")
+	}
+
+	state := &job.State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrap(err, "could not decode state file")
+	}
+	return state, nil
+}
+
+// SaveState writes the state file
+// the file gets replaced atomically, so a crash never leaves a truncated state behind
+func (store *fileStateStore) SaveState(state *job.State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "could not encode state")
+	}
+
+	return errors.Wrap(replaceFile(store.path, data), "could not write state file")
+}
+
+// replaceFile writes the file atomically, so a crash never leaves a truncated file behind
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "could not replace file")
+}
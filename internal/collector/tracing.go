@@ -0,0 +1,28 @@
+package collector
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of queries by the global tracer provider, spans are no-ops unless one got registered
+var tracer = otel.Tracer("github.com/emed-appts/emed-mailer/internal/collector")
+
+// startQuerySpan starts the span of a collection as child of the span in ctx, e.g. of the job run
+func startQuerySpan(ctx context.Context, name string, cfg DBConfig) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("db.system", cfg.Driver)))
+}
+
+// endQuerySpan records the number of collected appointments and the error, if any, and ends the span
+func endQuerySpan(span trace.Span, count int, err error) {
+	span.SetAttributes(attribute.Int("appointments.count", count))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
-	"github.com/rs/zerolog"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -10,6 +12,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+	"github.com/emed-appts/emed-mailer/internal/redact"
+
 	_ "github.com/kardianos/minwinsvc" // import minwinsvc for windows services
 	"github.com/pkg/errors"
 	"gopkg.in/ini.v1"
@@ -19,61 +24,276 @@ import (
 var (
 	// Path of config file
 	Path string
+	// Env names the profile overlaid on the config file, e.g. staging reads app.staging.ini after app.ini
+	Env string
 
 	// General config
 	General = &general{}
 	// Mail config
 	Mail = &mail{}
+	// MailBooked config overrides Mail for bookings
+	MailBooked = &MailRoute{}
+	// MailCancelled config overrides Mail for cancellations
+	MailCancelled = &MailRoute{}
+	// Webhook config
+	Webhook = &webhook{}
+	// Slack config
+	Slack = &slack{}
 	// DB config
 	DB = &db{}
 	// Log config
 	Log = &log{}
+	// Reminder config
+	Reminder = &reminder{}
+	// Tracing config
+	Tracing = &tracing{}
+
+	// Warnings collected while loading, to be logged once the logger is configured
+	Warnings []string
 
 	// AppWorkPath of binary
 	AppWorkPath string
 	isWindows   bool
 )
 
+// DefaultSubject of mails if none is configured
+const DefaultSubject = "eTermin Buchungen/Storni: {{ len .ChangedAppts }}"
+
+// DefaultReminderSubject of reminders if none is configured
+const DefaultReminderSubject = "Terminerinnerung: {{ .Start | formatTime }}"
+
+// DefaultTimeFormat of times in mails
+const DefaultTimeFormat = "02.01.2006 15:04"
+
+// namedTimeFormats may be configured by name instead of a layout
+var namedTimeFormats = map[string]string{
+	"ANSIC":    time.ANSIC,
+	"RFC822":   time.RFC822,
+	"RFC822Z":  time.RFC822Z,
+	"RFC1123":  time.RFC1123,
+	"RFC1123Z": time.RFC1123Z,
+	"RFC3339":  time.RFC3339,
+	"Kitchen":  time.Kitchen,
+}
+
+// timeLayout returns the layout of a named format, otherwise the format is a layout itself
+func timeLayout(format string) string {
+	if layout, ok := namedTimeFormats[format]; ok {
+		return layout
+	}
+	return format
+}
+
+// EnvPrefix of environment variables overriding config values
+// EMED_<SECTION>_<KEY> takes precedence over KEY in [section] of the config file
+const EnvPrefix = "EMED_"
+
 // general defines the general configuration.
 type general struct {
-	Root     string `ini:"ROOT"`
-	CronExpression string `ini:"SCHEDULE"`
-	Schedule cron.Schedule `ini:"-"`
-	Interval time.Duration `ini:"-"`
+	Root              string         `ini:"ROOT" toml:"ROOT" yaml:"ROOT"`
+	CronExpression    string         `ini:"SCHEDULE" toml:"SCHEDULE" yaml:"SCHEDULE"`
+	Schedule          cron.Schedule  `ini:"-" toml:"-" yaml:"-" json:"-"`
+	Timezone          string         `ini:"TIMEZONE" toml:"TIMEZONE" yaml:"TIMEZONE"`
+	Location          *time.Location `ini:"-" toml:"-" yaml:"-" json:"-"`
+	TimeFormat        string         `ini:"TIME_FORMAT" toml:"TIME_FORMAT" yaml:"TIME_FORMAT"`
+	TimeLayout        string         `ini:"-" toml:"-" yaml:"-"`
+	Interval          time.Duration  `ini:"-" toml:"-" yaml:"-"`
+	RunOnStart        bool           `ini:"RUN_ON_START" toml:"RUN_ON_START" yaml:"RUN_ON_START"`
+	StatePath         string         `ini:"STATE_PATH" toml:"STATE_PATH" yaml:"STATE_PATH"`
+	DedupeRetention   time.Duration  `ini:"DEDUPE_RETENTION" toml:"DEDUPE_RETENTION" yaml:"DEDUPE_RETENTION"`
+	LookbackWindow    time.Duration  `ini:"LOOKBACK_WINDOW" toml:"LOOKBACK_WINDOW" yaml:"LOOKBACK_WINDOW"`
+	QueuePath         string         `ini:"QUEUE_PATH" toml:"QUEUE_PATH" yaml:"QUEUE_PATH"`
+	QueueMaxAge       time.Duration  `ini:"QUEUE_MAX_AGE" toml:"QUEUE_MAX_AGE" yaml:"QUEUE_MAX_AGE"`
+	SkipIfRunning     bool           `ini:"SKIP_IF_RUNNING" toml:"SKIP_IF_RUNNING" yaml:"SKIP_IF_RUNNING"`
+	ShutdownTimeout   time.Duration  `ini:"SHUTDOWN_TIMEOUT" toml:"SHUTDOWN_TIMEOUT" yaml:"SHUTDOWN_TIMEOUT"`
+	HTTPAddr          string         `ini:"HTTP_ADDR" toml:"HTTP_ADDR" yaml:"HTTP_ADDR"`
+	PIDFile           string         `ini:"PID_FILE" toml:"PID_FILE" yaml:"PID_FILE"`
+	AdminEmail        []string       `ini:"ADMIN_EMAIL" toml:"ADMIN_EMAIL" yaml:"ADMIN_EMAIL" delim:","`
+	AlertInterval     time.Duration  `ini:"ALERT_INTERVAL" toml:"ALERT_INTERVAL" yaml:"ALERT_INTERVAL"`
+	AdminSubject      string         `ini:"ADMIN_SUBJECT" toml:"ADMIN_SUBJECT" yaml:"ADMIN_SUBJECT"`
+	AdminTemplate     string         `ini:"ADMIN_TEMPLATE" toml:"ADMIN_TEMPLATE" yaml:"ADMIN_TEMPLATE"`
+	Heartbeat         string         `ini:"HEARTBEAT" toml:"HEARTBEAT" yaml:"HEARTBEAT"`
+	HeartbeatSchedule cron.Schedule  `ini:"-" toml:"-" yaml:"-" json:"-"`
+	ReadyCheckSMTP    bool           `ini:"READY_CHECK_SMTP" toml:"READY_CHECK_SMTP" yaml:"READY_CHECK_SMTP"`
+	StatusMaxAge      time.Duration  `ini:"STATUS_MAX_AGE" toml:"STATUS_MAX_AGE" yaml:"STATUS_MAX_AGE"`
+	EnablePprof       bool           `ini:"ENABLE_PPROF" toml:"ENABLE_PPROF" yaml:"ENABLE_PPROF"`
+	DryRun            bool           `ini:"DRY_RUN" toml:"DRY_RUN" yaml:"DRY_RUN"`
+	DryRunCommit      bool           `ini:"DRY_RUN_COMMIT" toml:"DRY_RUN_COMMIT" yaml:"DRY_RUN_COMMIT"`
 }
 
 // mail defines the mailer configuration.
 type mail struct {
-	Server   string `ini:"SERVER"`
-	Port     int    `ini:"PORT"`
-	User     string `ini:"USER"`
-	Password string `ini:"PASSWORD"`
+	Server       string `ini:"SERVER" toml:"SERVER" yaml:"SERVER"`
+	Port         int    `ini:"PORT" toml:"PORT" yaml:"PORT"`
+	User         string `ini:"USER" toml:"USER" yaml:"USER"`
+	Password     string `ini:"PASSWORD" toml:"PASSWORD" yaml:"PASSWORD"`
+	PasswordFile string `ini:"PASSWORD_FILE" toml:"PASSWORD_FILE" yaml:"PASSWORD_FILE"`
+	AuthType     string `ini:"AUTH_TYPE" toml:"AUTH_TYPE" yaml:"AUTH_TYPE"`
+
+	// Fallbacks are mapped from the [mail.fallback.<name>] sections in order
+	Fallbacks fallbacks `ini:"-" toml:"fallback" yaml:"fallback"`
+
+	OAuthTokenURL     string `ini:"OAUTH_TOKEN_URL" toml:"OAUTH_TOKEN_URL" yaml:"OAUTH_TOKEN_URL"`
+	OAuthClientID     string `ini:"OAUTH_CLIENT_ID" toml:"OAUTH_CLIENT_ID" yaml:"OAUTH_CLIENT_ID"`
+	OAuthClientSecret string `ini:"OAUTH_CLIENT_SECRET" toml:"OAUTH_CLIENT_SECRET" yaml:"OAUTH_CLIENT_SECRET"`
+	OAuthScope        string `ini:"OAUTH_SCOPE" toml:"OAUTH_SCOPE" yaml:"OAUTH_SCOPE"`
+
+	Encryption         string `ini:"ENCRYPTION" toml:"ENCRYPTION" yaml:"ENCRYPTION"`
+	InsecureSkipVerify bool   `ini:"INSECURE_SKIP_VERIFY" toml:"INSECURE_SKIP_VERIFY" yaml:"INSECURE_SKIP_VERIFY"`
+	HeloHost           string `ini:"HELO_HOST" toml:"HELO_HOST" yaml:"HELO_HOST"`
+	Proxy              string `ini:"PROXY" toml:"PROXY" yaml:"PROXY"`
+
+	DialTimeout time.Duration `ini:"DIAL_TIMEOUT" toml:"DIAL_TIMEOUT" yaml:"DIAL_TIMEOUT"`
+	Timeout     time.Duration `ini:"TIMEOUT" toml:"TIMEOUT" yaml:"TIMEOUT"`
+
+	ConnectRetries int           `ini:"CONNECT_RETRIES" toml:"CONNECT_RETRIES" yaml:"CONNECT_RETRIES"`
+	SendRetries    int           `ini:"SEND_RETRIES" toml:"SEND_RETRIES" yaml:"SEND_RETRIES"`
+	RetryBackoff   time.Duration `ini:"RETRY_BACKOFF" toml:"RETRY_BACKOFF" yaml:"RETRY_BACKOFF"`
+	IdleTimeout    time.Duration `ini:"IDLE_TIMEOUT" toml:"IDLE_TIMEOUT" yaml:"IDLE_TIMEOUT"`
+	KeepAlive      time.Duration `ini:"KEEPALIVE" toml:"KEEPALIVE" yaml:"KEEPALIVE"`
+	Concurrency    int           `ini:"CONCURRENCY" toml:"CONCURRENCY" yaml:"CONCURRENCY"`
+	RateLimit      float64       `ini:"RATE_LIMIT" toml:"RATE_LIMIT" yaml:"RATE_LIMIT"`
+	Burst          int           `ini:"BURST" toml:"BURST" yaml:"BURST"`
+
+	BreakerThreshold int           `ini:"BREAKER_THRESHOLD" toml:"BREAKER_THRESHOLD" yaml:"BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `ini:"BREAKER_COOLDOWN" toml:"BREAKER_COOLDOWN" yaml:"BREAKER_COOLDOWN"`
+
+	From    string   `ini:"FROM" toml:"FROM" yaml:"FROM"`
+	To      []string `ini:"TO" toml:"TO" yaml:"TO" delim:","`
+	CC      []string `ini:"CC" toml:"CC" yaml:"CC" delim:","`
+	BCC     []string `ini:"BCC" toml:"BCC" yaml:"BCC" delim:","`
+	Subject string   `ini:"SUBJECT" toml:"SUBJECT" yaml:"SUBJECT"`
+	ReplyTo string   `ini:"REPLY_TO" toml:"REPLY_TO" yaml:"REPLY_TO"`
+	// FromName replaces the display name of From
+	FromName string `ini:"FROM_NAME" toml:"FROM_NAME" yaml:"FROM_NAME"`
+	// SubjectPrefixBooked and SubjectPrefixCancelled are prepended to the subjects of bookings and cancellations
+	SubjectPrefixBooked    string `ini:"SUBJECT_PREFIX_BOOKED" toml:"SUBJECT_PREFIX_BOOKED" yaml:"SUBJECT_PREFIX_BOOKED"`
+	SubjectPrefixCancelled string `ini:"SUBJECT_PREFIX_CANCELLED" toml:"SUBJECT_PREFIX_CANCELLED" yaml:"SUBJECT_PREFIX_CANCELLED"`
+	// MessageIDDomain is the right side of generated Message-IDs, defaults to the domain of From
+	MessageIDDomain string `ini:"MESSAGE_ID_DOMAIN" toml:"MESSAGE_ID_DOMAIN" yaml:"MESSAGE_ID_DOMAIN"`
+	// Charset and TransferEncoding of the text and html parts
+	Charset          string `ini:"CHARSET" toml:"CHARSET" yaml:"CHARSET"`
+	TransferEncoding string `ini:"TRANSFER_ENCODING" toml:"TRANSFER_ENCODING" yaml:"TRANSFER_ENCODING"`
+
+	// Headers are mapped from the keys of the [mail.headers] section
+	Headers map[string]string `ini:"-" toml:"headers" yaml:"headers"`
+	// Routing is mapped from the [routing] section, the recipients of every provider
+	Routing map[string][]string `ini:"-" toml:"-" yaml:"-"`
+
+	Digest       bool   `ini:"DIGEST" toml:"DIGEST" yaml:"DIGEST"`
+	TemplateText string `ini:"TEMPLATE_TEXT" toml:"TEMPLATE_TEXT" yaml:"TEMPLATE_TEXT"`
+	TemplateHTML string `ini:"TEMPLATE_HTML" toml:"TEMPLATE_HTML" yaml:"TEMPLATE_HTML"`
+
+	Calendar         bool          `ini:"CALENDAR" toml:"CALENDAR" yaml:"CALENDAR"`
+	CalendarDuration time.Duration `ini:"CALENDAR_DURATION" toml:"CALENDAR_DURATION" yaml:"CALENDAR_DURATION"`
+}
+
+// fallbacks are the smtp servers tried in order if the primary one fails.
+type fallbacks []fallback
+
+// fallback defines a smtp server tried if the primary one fails.
+type fallback struct {
+	Section      string `ini:"-" toml:"-" yaml:"-"`
+	Server       string `ini:"SERVER" toml:"SERVER" yaml:"SERVER"`
+	Port         int    `ini:"PORT" toml:"PORT" yaml:"PORT"`
+	User         string `ini:"USER" toml:"USER" yaml:"USER"`
+	Password     string `ini:"PASSWORD" toml:"PASSWORD" yaml:"PASSWORD"`
+	PasswordFile string `ini:"PASSWORD_FILE" toml:"PASSWORD_FILE" yaml:"PASSWORD_FILE"`
+}
+
+// MailRoute defines the mail configuration of one kind of change, unset values fall back to mail.
+type MailRoute struct {
+	To      []string `ini:"TO" toml:"TO" yaml:"TO" delim:","`
+	CC      []string `ini:"CC" toml:"CC" yaml:"CC" delim:","`
+	BCC     []string `ini:"BCC" toml:"BCC" yaml:"BCC" delim:","`
+	Subject string   `ini:"SUBJECT" toml:"SUBJECT" yaml:"SUBJECT"`
+
+	TemplateText string `ini:"TEMPLATE_TEXT" toml:"TEMPLATE_TEXT" yaml:"TEMPLATE_TEXT"`
+	TemplateHTML string `ini:"TEMPLATE_HTML" toml:"TEMPLATE_HTML" yaml:"TEMPLATE_HTML"`
+}
+
+// webhook defines the webhook notifier configuration.
+type webhook struct {
+	URL     string        `ini:"URL" toml:"URL" yaml:"URL"`
+	Timeout time.Duration `ini:"TIMEOUT" toml:"TIMEOUT" yaml:"TIMEOUT"`
 
-	From    string `ini:"FROM"`
-	To      string `ini:"TO"`
-	Subject string `ini:"SUBJECT"`
+	MaxRetries   int           `ini:"MAX_RETRIES" toml:"MAX_RETRIES" yaml:"MAX_RETRIES"`
+	RetryBackoff time.Duration `ini:"RETRY_BACKOFF" toml:"RETRY_BACKOFF" yaml:"RETRY_BACKOFF"`
+}
+
+// slack defines the slack notifier configuration.
+type slack struct {
+	WebhookURL string        `ini:"WEBHOOK_URL" toml:"WEBHOOK_URL" yaml:"WEBHOOK_URL"`
+	Timeout    time.Duration `ini:"TIMEOUT" toml:"TIMEOUT" yaml:"TIMEOUT"`
+
+	MaxRetries   int           `ini:"MAX_RETRIES" toml:"MAX_RETRIES" yaml:"MAX_RETRIES"`
+	RetryBackoff time.Duration `ini:"RETRY_BACKOFF" toml:"RETRY_BACKOFF" yaml:"RETRY_BACKOFF"`
+	Interval     time.Duration `ini:"INTERVAL" toml:"INTERVAL" yaml:"INTERVAL"`
 }
 
 // db defines the database configuration.
 type db struct {
-	Server   string `ini:"SERVER"`
-	Port     int    `ini:"PORT"`
-	User     string `ini:"USER"`
-	Password string `ini:"PASSWORD"`
-
-	Database string `ini:"DATABASE"`
+	Driver       string `ini:"DRIVER" toml:"DRIVER" yaml:"DRIVER"`
+	Server       string `ini:"SERVER" toml:"SERVER" yaml:"SERVER"`
+	Port         int    `ini:"PORT" toml:"PORT" yaml:"PORT"`
+	Instance     string `ini:"INSTANCE" toml:"INSTANCE" yaml:"INSTANCE"`
+	User         string `ini:"USER" toml:"USER" yaml:"USER"`
+	Password     string `ini:"PASSWORD" toml:"PASSWORD" yaml:"PASSWORD"`
+	PasswordFile string `ini:"PASSWORD_FILE" toml:"PASSWORD_FILE" yaml:"PASSWORD_FILE"`
+
+	Database   string `ini:"DATABASE" toml:"DATABASE" yaml:"DATABASE"`
+	Query      string `ini:"QUERY" toml:"QUERY" yaml:"QUERY"`
+	AuditTable string `ini:"AUDIT_TABLE" toml:"AUDIT_TABLE" yaml:"AUDIT_TABLE"`
+
+	Encrypt                bool `ini:"ENCRYPT" toml:"ENCRYPT" yaml:"ENCRYPT"`
+	TrustServerCertificate bool `ini:"TRUST_SERVER_CERTIFICATE" toml:"TRUST_SERVER_CERTIFICATE" yaml:"TRUST_SERVER_CERTIFICATE"`
+
+	MaxOpenConns    int           `ini:"MAX_OPEN_CONNS" toml:"MAX_OPEN_CONNS" yaml:"MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `ini:"MAX_IDLE_CONNS" toml:"MAX_IDLE_CONNS" yaml:"MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `ini:"CONN_MAX_LIFETIME" toml:"CONN_MAX_LIFETIME" yaml:"CONN_MAX_LIFETIME"`
+
+	ConnectRetries    int           `ini:"CONNECT_RETRIES" toml:"CONNECT_RETRIES" yaml:"CONNECT_RETRIES"`
+	ConnectRetryDelay time.Duration `ini:"CONNECT_RETRY_DELAY" toml:"CONNECT_RETRY_DELAY" yaml:"CONNECT_RETRY_DELAY"`
+	QueryTimeout      time.Duration `ini:"QUERY_TIMEOUT" toml:"QUERY_TIMEOUT" yaml:"QUERY_TIMEOUT"`
+
+	PageSize int `ini:"PAGE_SIZE" toml:"PAGE_SIZE" yaml:"PAGE_SIZE"`
 }
 
 // log defines the logging configuration.
 type log struct {
-	Level   string `ini:"LEVEL"`
-	Colored bool   `ini:"COLORED"`
-	Pretty  bool   `ini:"PRETTY"`
+	Level   string `ini:"LEVEL" toml:"LEVEL" yaml:"LEVEL"`
+	Output  string `ini:"OUTPUT" toml:"OUTPUT" yaml:"OUTPUT"`
+	File    string `ini:"FILE" toml:"FILE" yaml:"FILE"`
+	Colored bool   `ini:"COLORED" toml:"COLORED" yaml:"COLORED"`
+	Pretty  bool   `ini:"PRETTY" toml:"PRETTY" yaml:"PRETTY"`
+
+	MaxSizeMB  int `ini:"MAX_SIZE_MB" toml:"MAX_SIZE_MB" yaml:"MAX_SIZE_MB"`
+	MaxBackups int `ini:"MAX_BACKUPS" toml:"MAX_BACKUPS" yaml:"MAX_BACKUPS"`
+	MaxAgeDays int `ini:"MAX_AGE_DAYS" toml:"MAX_AGE_DAYS" yaml:"MAX_AGE_DAYS"`
+}
+
+// reminder defines the configuration of appointment reminders.
+type reminder struct {
+	Enabled  bool          `ini:"ENABLED" toml:"ENABLED" yaml:"ENABLED"`
+	LeadTime time.Duration `ini:"LEAD_TIME" toml:"LEAD_TIME" yaml:"LEAD_TIME"`
+	Query    string        `ini:"QUERY" toml:"QUERY" yaml:"QUERY"`
+
+	Subject      string `ini:"SUBJECT" toml:"SUBJECT" yaml:"SUBJECT"`
+	TemplateText string `ini:"TEMPLATE_TEXT" toml:"TEMPLATE_TEXT" yaml:"TEMPLATE_TEXT"`
+	TemplateHTML string `ini:"TEMPLATE_HTML" toml:"TEMPLATE_HTML" yaml:"TEMPLATE_HTML"`
+
+	StatePath string `ini:"STATE_PATH" toml:"STATE_PATH" yaml:"STATE_PATH"`
+}
+
+// tracing defines the export of OpenTelemetry traces.
+type tracing struct {
+	Endpoint string `ini:"ENDPOINT" toml:"ENDPOINT" yaml:"ENDPOINT"`
 }
 
 // Load loads the configuration from `Path`
 func Load() error {
 	isWindows = runtime.GOOS == "windows"
+	Warnings = nil
 
 	var appPath string
 	var err error
@@ -87,13 +307,9 @@ func Load() error {
 		Path = path.Join(AppWorkPath, Path)
 	}
 
-	config, err := ini.Load(Path)
-	if err != nil {
-		return errors.Wrap(err, "could not load ini config")
-	}
-
-	if err = config.Section("general").MapTo(General); err != nil {
-		return errors.Wrap(err, "could not map general section")
+	setDefaults()
+	if err := loadFile(Path, Env); err != nil {
+		return errors.WithStack(err)
 	}
 
 	if !filepath.IsAbs(General.Root) {
@@ -103,38 +319,396 @@ func Load() error {
 		return errors.Wrap(err, "could not create folders of root path")
 	}
 
-	General.Schedule, err = cron.Parse(General.CronExpression)
+	if General.StatePath != "" && !filepath.IsAbs(General.StatePath) {
+		General.StatePath = path.Join(General.Root, General.StatePath)
+	}
+	if General.QueuePath != "" && !filepath.IsAbs(General.QueuePath) {
+		General.QueuePath = path.Join(General.Root, General.QueuePath)
+	}
+	if General.PIDFile != "" && !filepath.IsAbs(General.PIDFile) {
+		General.PIDFile = path.Join(General.Root, General.PIDFile)
+	}
+
+	// an invalid cron expression or timezone gets reported by Validate
+	if General.Timezone != "" {
+		General.Location, _ = tzinfo.LoadLocation(General.Timezone)
+	}
+	if General.TimeFormat == "" {
+		General.TimeFormat = DefaultTimeFormat
+	}
+	General.TimeLayout = timeLayout(General.TimeFormat)
+	if General.Schedule, err = parseSchedule(General.CronExpression); err == nil {
+		// calculate interval
+		nextExecutionTime := General.Schedule.Next(time.Now())
+		General.Interval = General.Schedule.Next(nextExecutionTime).Sub(nextExecutionTime)
+	}
+	if General.StatusMaxAge == 0 {
+		// a single missed run is tolerated
+		General.StatusMaxAge = 2 * General.Interval
+	}
+	if General.Heartbeat != "" {
+		General.HeartbeatSchedule, _ = parseSchedule(General.Heartbeat)
+	}
+
+	if err := readPasswordFile("mail", &Mail.Password, Mail.PasswordFile); err != nil {
+		return errors.WithStack(err)
+	}
+	for i := range Mail.Fallbacks {
+		f := &Mail.Fallbacks[i]
+		if err := readPasswordFile(f.Section, &f.Password, f.PasswordFile); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if Mail.Subject == "" {
+		Mail.Subject = DefaultSubject
+	}
+
+	if Mail.Encryption == "" {
+		Mail.Encryption = "auto"
+	}
+	if Mail.AuthType == "" {
+		Mail.AuthType = "auto"
+	}
+	Mail.Charset = strings.ToUpper(Mail.Charset)
+	if Mail.Charset == "" {
+		Mail.Charset = "UTF-8"
+	}
+	Mail.TransferEncoding = strings.ToLower(Mail.TransferEncoding)
+	if Mail.TransferEncoding == "" {
+		Mail.TransferEncoding = "quoted-printable"
+	}
+
+	for _, tmpl := range []*string{
+		&Mail.TemplateText, &Mail.TemplateHTML,
+		&MailBooked.TemplateText, &MailBooked.TemplateHTML,
+		&MailCancelled.TemplateText, &MailCancelled.TemplateHTML,
+		&General.AdminTemplate,
+	} {
+		if *tmpl != "" && !filepath.IsAbs(*tmpl) {
+			*tmpl = path.Join(AppWorkPath, *tmpl)
+		}
+	}
+
+	// the sqlite database is a file like the state
+	if DB.Driver == "sqlite" && DB.Database != "" && !filepath.IsAbs(DB.Database) {
+		DB.Database = path.Join(General.Root, DB.Database)
+	}
+
+	if err := readPasswordFile("db", &DB.Password, DB.PasswordFile); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !filepath.IsAbs(Log.File) {
+		Log.File = path.Join(General.Root, Log.File)
+	}
+
+	if !filepath.IsAbs(Reminder.StatePath) {
+		Reminder.StatePath = path.Join(General.Root, Reminder.StatePath)
+	}
+	for _, tmpl := range []*string{&Reminder.TemplateText, &Reminder.TemplateHTML} {
+		if *tmpl != "" && !filepath.IsAbs(*tmpl) {
+			*tmpl = path.Join(AppWorkPath, *tmpl)
+		}
+	}
+
+	return Validate()
+}
+
+// setDefaults resets the configuration to the defaults, keys missing in the config file keep them
+func setDefaults() {
+	*General = general{
+		DedupeRetention: 24 * time.Hour,
+		QueueMaxAge:     24 * time.Hour,
+		SkipIfRunning:   true,
+		ShutdownTimeout: 30 * time.Second,
+		AlertInterval:   time.Hour,
+		TimeFormat:      DefaultTimeFormat,
+	}
+	*Mail = mail{
+		DialTimeout:      10 * time.Second,
+		Timeout:          time.Minute,
+		ConnectRetries:   5,
+		SendRetries:      3,
+		RetryBackoff:     5 * time.Second,
+		IdleTimeout:      30 * time.Second,
+		BreakerThreshold: 3,
+		BreakerCooldown:  5 * time.Minute,
+		Concurrency:      1,
+		Burst:            1,
+		Digest:           true,
+		CalendarDuration: 15 * time.Minute,
+		Headers:          make(map[string]string),
+		Routing:          make(map[string][]string),
+	}
+	*MailBooked = MailRoute{}
+	*MailCancelled = MailRoute{}
+	*Webhook = webhook{
+		Timeout:      10 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 5 * time.Second,
+	}
+	*Slack = slack{
+		Timeout:      10 * time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 5 * time.Second,
+		Interval:     time.Second,
+	}
+	*DB = db{
+		Driver:            "mssql",
+		ConnectRetries:    5,
+		ConnectRetryDelay: 2 * time.Second,
+		QueryTimeout:      30 * time.Second,
+	}
+	*Log = log{
+		Output: "file",
+		File:   "emed-mailer.log",
+	}
+	*Reminder = reminder{
+		LeadTime:  24 * time.Hour,
+		Subject:   DefaultReminderSubject,
+		StatePath: "reminders.json",
+	}
+	*Tracing = tracing{}
+}
+
+// mapINI maps the sections of the ini file onto the configuration
+// sections missing in the file leave the configuration as it is
+func mapINI(config *ini.File) error {
+	for _, section := range []struct {
+		name   string
+		target interface{}
+	}{
+		{"general", General},
+		{"mail", Mail},
+		{"mail.booked", MailBooked},
+		{"mail.cancelled", MailCancelled},
+		{"webhook", Webhook},
+		{"slack", Slack},
+		{"db", DB},
+		{"log", Log},
+		{"reminder", Reminder},
+		{"tracing", Tracing},
+	} {
+		s, err := config.GetSection(section.name)
+		if err != nil {
+			continue
+		}
+		if err := s.MapTo(section.target); err != nil {
+			return errors.Wrapf(err, "could not map %s section", section.name)
+		}
+	}
+
+	if section, err := config.GetSection("mail"); err == nil {
+		// MAX_RETRIES applied to connecting and sending alike
+		if key, err := section.GetKey("MAX_RETRIES"); err == nil {
+			Warnings = append(Warnings, "mail MAX_RETRIES is deprecated, use CONNECT_RETRIES and SEND_RETRIES")
+			for name, retries := range map[string]*int{"CONNECT_RETRIES": &Mail.ConnectRetries, "SEND_RETRIES": &Mail.SendRetries} {
+				if !section.HasKey(name) {
+					*retries = key.MustInt(*retries)
+				}
+			}
+		}
+	}
+
+	for _, section := range config.ChildSections("mail.fallback") {
+		f := fallback{Section: section.Name()}
+		if err := section.MapTo(&f); err != nil {
+			return errors.Wrapf(err, "could not map %s section", section.Name())
+		}
+		Mail.Fallbacks = append(Mail.Fallbacks, f)
+	}
+
+	if section, err := config.GetSection("mail.headers"); err == nil {
+		for name, value := range section.KeysHash() {
+			Mail.Headers[name] = value
+		}
+	}
+	if section, err := config.GetSection("routing"); err == nil {
+		for _, key := range section.Keys() {
+			Mail.Routing[key.Name()] = key.Strings(",")
+		}
+	}
+
+	if section, err := config.GetSection("db"); err == nil {
+		// MapTo skips durations which are not positive, but 0 disables the query timeout
+		if key, err := section.GetKey("QUERY_TIMEOUT"); err == nil {
+			DB.QueryTimeout = key.MustDuration(DB.QueryTimeout)
+		}
+	}
+	return nil
+}
+
+// Reload loads the configuration again
+// an invalid configuration is reported and leaves the previous one in place
+func Reload() error {
+	general, mail, mailBooked, mailCancelled := *General, *Mail, *MailBooked, *MailCancelled
+	webhook, slack, db, log, reminder, tracing, warnings := *Webhook, *Slack, *DB, *Log, *Reminder, *Tracing, Warnings
+
+	if err := Load(); err != nil {
+		*General, *Mail, *MailBooked, *MailCancelled = general, mail, mailBooked, mailCancelled
+		*Webhook, *Slack, *DB, *Log, *Reminder, *Tracing, Warnings = webhook, slack, db, log, reminder, tracing, warnings
+		return err
+	}
+	return nil
+}
+
+// parseSchedule parses the cron expression, evaluated in the configured timezone
+// schedules are evaluated in the system local zone unless configured otherwise
+// a TZ= prefix of the expression takes precedence
+func parseSchedule(expr string) (cron.Schedule, error) {
+	schedule, err := cron.Parse(expr)
 	if err != nil {
-		return errors.Wrap(err, "could not parse cron expression")
+		return nil, err
+	}
+
+	if spec, ok := schedule.(*cron.SpecSchedule); ok && General.Timezone != "" && !strings.HasPrefix(expr, "TZ=") {
+		if loc, err := tzinfo.LoadLocation(General.Timezone); err == nil {
+			spec.Location = loc
+		}
 	}
-	// calculate interval
-	nextExecutionTime := General.Schedule.Next(time.Now())
-	General.Interval = General.Schedule.Next(nextExecutionTime).Sub(nextExecutionTime)
+	return schedule, nil
+}
 
-	// check if interval is longer than 15 minutes
-	if General.Interval.Minutes() < 15 {
-		return errors.New("schedule interval shorter than 15 minutes")
+// Secrets returns the configured secrets, which must never be logged
+func Secrets() []string {
+	// webhook urls usually contain an access token
+	secrets := []string{Mail.Password, Mail.OAuthClientSecret, DB.Password, Webhook.URL, Slack.WebhookURL}
+	for _, f := range Mail.Fallbacks {
+		secrets = append(secrets, f.Password)
 	}
+	if u, err := url.Parse(Mail.Proxy); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		secrets = append(secrets, password)
+	}
+	return secrets
+}
 
-	if err = config.Section("mail").MapTo(Mail); err != nil {
-		return errors.Wrap(err, "could not map mail section")
+// Redacted returns a copy of the loaded configuration with masked secrets, e.g. for logging
+func Redacted() interface{} {
+	m := *Mail
+	m.Password = redact.Value(m.Password)
+	m.OAuthClientSecret = redact.Value(m.OAuthClientSecret)
+	m.Fallbacks = make([]fallback, len(Mail.Fallbacks))
+	for i, f := range Mail.Fallbacks {
+		f.Password = redact.Value(f.Password)
+		m.Fallbacks[i] = f
 	}
+	if u, err := url.Parse(m.Proxy); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redact.Value(password))
+			m.Proxy = u.String()
+		}
+	}
+	w := *Webhook
+	w.URL = redact.Value(w.URL)
+	sl := *Slack
+	sl.WebhookURL = redact.Value(sl.WebhookURL)
+	d := *DB
+	d.Password = redact.Value(d.Password)
+
+	return struct {
+		General       general
+		Mail          mail
+		MailBooked    MailRoute
+		MailCancelled MailRoute
+		Webhook       webhook
+		Slack         slack
+		DB            db
+		Log           log
+		Reminder      reminder
+		Tracing       tracing
+	}{*General, m, *MailBooked, *MailCancelled, w, sl, d, *Log, *Reminder, *Tracing}
+}
+
+// readPasswordFile replaces the password by the trimmed content of `file`
+// e.g. a docker or kubernetes secret
+func readPasswordFile(section string, password *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if !filepath.IsAbs(file) {
+		file = path.Join(AppWorkPath, file)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s password file", section)
+	}
+
+	if *password != "" {
+		Warnings = append(Warnings, fmt.Sprintf("%s PASSWORD and PASSWORD_FILE are both set, using PASSWORD_FILE", section))
+	}
+	*password = strings.TrimSpace(string(content))
+
+	return nil
+}
 
-	if err = config.Section("db").MapTo(DB); err != nil {
-		return errors.Wrap(err, "could not map db section")
+// profilePath returns the path of the profile overlay of the config file, e.g. conf/app.staging.ini of conf/app.ini
+func profilePath(path, env string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + env + ext
+}
+
+// profileFile returns the path of the profile overlay of the config file, empty if there is none
+// a missing overlay is ignored, so profiles only need a file if they differ
+func profileFile(path, env string) (string, error) {
+	if strings.ContainsAny(env, `/\`) {
+		return "", errors.Errorf("invalid env %q", env)
 	}
 
-	if err = config.Section("log").MapTo(Log); err != nil {
-		return errors.Wrap(err, "could not map log section")
+	overlayPath := profilePath(path, env)
+	if _, err := os.Stat(overlayPath); os.IsNotExist(err) {
+		return "", nil
 	}
+	return overlayPath, nil
+}
 
-	if _, err := zerolog.ParseLevel(Log.Level); err != nil {
-		return errors.Wrap(err, "could not parse log level")
+// overlayProfile overrides config values by the keys of the ini profile overlay
+func overlayProfile(config *ini.File, path, env string) error {
+	overlayPath, err := profileFile(path, env)
+	if err != nil || overlayPath == "" {
+		return err
+	}
+	overlay, err := ini.Load(overlayPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not load env %s", env)
 	}
 
+	for _, section := range overlay.Sections() {
+		// NewKey instead of Key, which would return the key of a parent section like [mail] for [mail.booked]
+		target := config.Section(section.Name())
+		for _, key := range section.Keys() {
+			if _, err := target.NewKey(key.Name(), key.Value()); err != nil {
+				return errors.Wrapf(err, "could not set %s of env %s", key.Name(), env)
+			}
+		}
+	}
 	return nil
 }
 
+// overlayEnv overrides config values by environment variables
+// EMED_<SECTION>_<KEY> maps to KEY of [section], e.g. EMED_MAIL_PASSWORD to PASSWORD of [mail]
+// empty variables are ignored
+func overlayEnv(config *ini.File, environ []string) {
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(kv[len(EnvPrefix):], "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		name := strings.SplitN(parts[0], "_", 2)
+		if len(name) != 2 {
+			continue
+		}
+
+		config.Section(strings.ToLower(name[0])).Key(name[1]).SetValue(parts[1])
+	}
+}
+
 func getAppPath() (string, error) {
 	var appPath string
 
@@ -0,0 +1,331 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// document is the layout of toml and yaml config files
+// tables are the sections of ini files, nested tables their child sections like headers of mail for [mail.headers]
+type document struct {
+	General  *general            `toml:"general" yaml:"general"`
+	Mail     *mailDocument       `toml:"mail" yaml:"mail"`
+	Routing  map[string][]string `toml:"routing" yaml:"routing"`
+	Webhook  *webhook            `toml:"webhook" yaml:"webhook"`
+	Slack    *slack              `toml:"slack" yaml:"slack"`
+	DB       *db                 `toml:"db" yaml:"db"`
+	Log      *log                `toml:"log" yaml:"log"`
+	Reminder *reminder           `toml:"reminder" yaml:"reminder"`
+	Tracing  *tracing            `toml:"tracing" yaml:"tracing"`
+}
+
+// mailDocument is the mail table, which holds the tables of bookings and cancellations
+type mailDocument struct {
+	mail      `yaml:",inline"`
+	Booked    *MailRoute `toml:"booked" yaml:"booked"`
+	Cancelled *MailRoute `toml:"cancelled" yaml:"cancelled"`
+}
+
+// decoders of the config formats by extension, others are read as ini
+var decoders = map[string]func([]byte, *document) error{
+	".toml": decodeTOML,
+	".yaml": decodeYAML,
+	".yml":  decodeYAML,
+}
+
+// loadFile loads the config file and the profile overlay of env in the format given by the extension
+// environment variables take precedence over both
+func loadFile(path, env string) error {
+	decode, ok := decoders[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		config, err := ini.Load(path)
+		if err != nil {
+			return errors.Wrap(err, "could not load ini config")
+		}
+		if env != "" {
+			if err := overlayProfile(config, path, env); err != nil {
+				return err
+			}
+		}
+		overlayEnv(config, os.Environ())
+		return mapINI(config)
+	}
+
+	if err := decodeFile(path, decode); err != nil {
+		return err
+	}
+	if env != "" {
+		overlayPath, err := profileFile(path, env)
+		if err != nil {
+			return err
+		}
+		if overlayPath != "" {
+			if err := decodeFile(overlayPath, decode); err != nil {
+				return errors.Wrapf(err, "could not load env %s", env)
+			}
+		}
+	}
+
+	overlay := ini.Empty()
+	overlayEnv(overlay, os.Environ())
+	if err := mapINI(overlay); err != nil {
+		return err
+	}
+
+	// like child sections of ini files, fallbacks share the keys of mail they do not set
+	for i := range Mail.Fallbacks {
+		f := &Mail.Fallbacks[i]
+		if f.Port == 0 {
+			f.Port = Mail.Port
+		}
+		if f.User == "" {
+			f.User = Mail.User
+		}
+		if f.Password == "" {
+			f.Password = Mail.Password
+		}
+		if f.PasswordFile == "" {
+			f.PasswordFile = Mail.PasswordFile
+		}
+	}
+	return nil
+}
+
+// decodeFile decodes the file onto the configuration, keys missing in the file leave it as it is
+func decodeFile(path string, decode func([]byte, *document) error) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", path)
+	}
+
+	doc := &document{
+		General:  General,
+		Mail:     &mailDocument{mail: *Mail, Booked: MailBooked, Cancelled: MailCancelled},
+		Routing:  Mail.Routing,
+		Webhook:  Webhook,
+		Slack:    Slack,
+		DB:       DB,
+		Log:      Log,
+		Reminder: Reminder,
+		Tracing:  Tracing,
+	}
+	if err := decode(src, doc); err != nil {
+		return errors.Wrapf(err, "could not load %s", path)
+	}
+
+	// the mail table is decoded onto a copy, as it is embedded in the document
+	if doc.Mail != nil {
+		*Mail = doc.Mail.mail
+	}
+	return nil
+}
+
+// decodeYAML decodes the yaml document by the yaml tags of the config structs
+func decodeYAML(src []byte, doc *document) error {
+	return errors.WithStack(yaml.Unmarshal(src, doc))
+}
+
+// UnmarshalYAML decodes the mapping of fallback servers by name, in the order of the document
+func (f *fallbacks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var servers map[string]fallback
+	if err := unmarshal(&servers); err != nil {
+		return err
+	}
+
+	*f = nil
+	for _, item := range order {
+		name := fmt.Sprint(item.Key)
+		server := servers[name]
+		server.Section = "mail.fallback." + name
+		*f = append(*f, server)
+	}
+	return nil
+}
+
+// decodeTOML decodes the toml document by the toml tags of the config structs
+// the document is decoded generically first, as the toml package can not decode durations like 10s
+func decodeTOML(src []byte, doc *document) error {
+	var tree map[string]interface{}
+	md, err := toml.Decode(string(src), &tree)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the metadata lists the keys in the order of the document, which matters for fallbacks
+	d := tomlDecoder{order: make(map[string]int)}
+	for i, key := range md.Keys() {
+		d.order[key.String()] = i
+	}
+	return d.decode(nil, tree, reflect.ValueOf(doc).Elem())
+}
+
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	fallbacksType = reflect.TypeOf(fallbacks(nil))
+)
+
+// tomlDecoder assigns the values of a generically decoded toml document
+type tomlDecoder struct {
+	order map[string]int
+}
+
+func (d tomlDecoder) decode(key []string, value interface{}, out reflect.Value) error {
+	switch out.Type() {
+	case durationType:
+		s, ok := value.(string)
+		if !ok {
+			return d.unsupported(key, value, "a duration like 10s")
+		}
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Wrap(err, strings.Join(key, "."))
+		}
+		out.SetInt(int64(duration))
+		return nil
+	case fallbacksType:
+		return d.decodeFallbacks(key, value, out)
+	}
+
+	switch out.Kind() {
+	case reflect.Ptr:
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		return d.decode(key, value, out.Elem())
+	case reflect.Struct:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return d.unsupported(key, value, "a table")
+		}
+		for i := 0; i < out.NumField(); i++ {
+			field := out.Type().Field(i)
+			if field.Anonymous {
+				if err := d.decode(key, table, out.Field(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			name := field.Tag.Get("toml")
+			v, ok := table[name]
+			if name == "" || name == "-" || !ok {
+				continue
+			}
+			if err := d.decode(append(key[:len(key):len(key)], name), v, out.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return d.unsupported(key, value, "a table")
+		}
+		if out.IsNil() {
+			out.Set(reflect.MakeMap(out.Type()))
+		}
+		for name, v := range table {
+			elem := reflect.New(out.Type().Elem()).Elem()
+			if err := d.decode(append(key[:len(key):len(key)], name), v, elem); err != nil {
+				return err
+			}
+			out.SetMapIndex(reflect.ValueOf(name), elem)
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return d.unsupported(key, value, "a list")
+		}
+		items := reflect.MakeSlice(out.Type(), len(list), len(list))
+		for i, v := range list {
+			if err := d.decode(key, v, items.Index(i)); err != nil {
+				return err
+			}
+		}
+		out.Set(items)
+	case reflect.String:
+		// values of string keys like headers may be scalars of any type, as in ini files
+		switch v := value.(type) {
+		case string:
+			out.SetString(v)
+		case bool, int64, float64:
+			out.SetString(fmt.Sprint(v))
+		default:
+			return d.unsupported(key, value, "a string")
+		}
+	case reflect.Bool:
+		v, ok := value.(bool)
+		if !ok {
+			return d.unsupported(key, value, "a boolean")
+		}
+		out.SetBool(v)
+	case reflect.Int:
+		v, ok := value.(int64)
+		if !ok || out.OverflowInt(v) {
+			return d.unsupported(key, value, "an integer")
+		}
+		out.SetInt(v)
+	case reflect.Float64:
+		switch v := value.(type) {
+		case float64:
+			out.SetFloat(v)
+		case int64:
+			out.SetFloat(float64(v))
+		default:
+			return d.unsupported(key, value, "a number")
+		}
+		if math.IsInf(out.Float(), 0) || math.IsNaN(out.Float()) {
+			return d.unsupported(key, value, "a finite number")
+		}
+	default:
+		return d.unsupported(key, value, out.Type().String())
+	}
+	return nil
+}
+
+// decodeFallbacks decodes the table of fallback servers by name, in the order of the document
+func (d tomlDecoder) decodeFallbacks(key []string, value interface{}, out reflect.Value) error {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return d.unsupported(key, value, "a table")
+	}
+
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	position := func(name string) int {
+		return d.order[toml.Key(append(key[:len(key):len(key)], name)).String()]
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return position(names[i]) < position(names[j])
+	})
+
+	servers := make(fallbacks, len(names))
+	for i, name := range names {
+		servers[i].Section = "mail.fallback." + name
+		if err := d.decode(append(key[:len(key):len(key)], name), table[name], reflect.ValueOf(&servers[i]).Elem()); err != nil {
+			return err
+		}
+	}
+	out.Set(reflect.ValueOf(servers))
+	return nil
+}
+
+func (d tomlDecoder) unsupported(key []string, value interface{}, expected string) error {
+	return errors.Errorf("%s: unsupported value %v, expected %s", strings.Join(key, "."), value, expected)
+}
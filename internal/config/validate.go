@@ -0,0 +1,401 @@
+package config
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/collector/tzinfo"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// ValidationError lists every problem found in the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(err.Problems, "\n  - ")
+}
+
+// Validate checks the loaded configuration
+// it reports all problems at once, so they can be fixed in one go
+func Validate() error {
+	v := &validator{}
+
+	// general
+	if v.required("general.SCHEDULE", General.CronExpression) {
+		if _, err := cron.Parse(General.CronExpression); err != nil {
+			v.addf("general.SCHEDULE: could not parse cron expression %q: %v, %s", General.CronExpression, err, scheduleHint)
+		} else if General.LookbackWindow > 0 {
+			// the lookback window catches the changes logged late, so frequent runs do not miss them
+			if General.Interval < time.Minute {
+				v.addf("general.SCHEDULE: schedule interval %s shorter than 1 minute", General.Interval)
+			}
+		} else if General.Interval.Minutes() < 15 {
+			v.addf("general.SCHEDULE: schedule interval %s shorter than 15 minutes, unless LOOKBACK_WINDOW is set", General.Interval)
+		}
+	}
+
+	if General.Timezone != "" {
+		if _, err := tzinfo.LoadLocation(General.Timezone); err != nil {
+			v.addf("general.TIMEZONE: unknown timezone %q: %v", General.Timezone, err)
+		}
+	}
+
+	// a layout without any element formats every time the same
+	if t := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC); t.Format(General.TimeLayout) == General.TimeLayout {
+		v.addf("general.TIME_FORMAT: %q is neither a layout like 02.01.2006 15:04 nor a named format like RFC1123", General.TimeFormat)
+	}
+
+	v.addresses("general.ADMIN_EMAIL", General.AdminEmail)
+	if General.Heartbeat != "" {
+		if _, err := cron.Parse(General.Heartbeat); err != nil {
+			v.addf("general.HEARTBEAT: could not parse cron expression %q: %v, %s", General.Heartbeat, err, scheduleHint)
+		}
+		if len(General.AdminEmail) == 0 {
+			v.addf("general.ADMIN_EMAIL: required if HEARTBEAT is set")
+		}
+	}
+	if General.EnablePprof && General.HTTPAddr == "" {
+		v.addf("general.HTTP_ADDR: required if ENABLE_PPROF is set")
+	}
+	if General.LookbackWindow < 0 {
+		v.addf("general.LOOKBACK_WINDOW: must not be negative")
+	} else if General.LookbackWindow > General.DedupeRetention {
+		// changes collected again after they got forgotten would be notified twice
+		v.addf("general.LOOKBACK_WINDOW: %s exceeds DEDUPE_RETENTION %s", General.LookbackWindow, General.DedupeRetention)
+	}
+	if General.QueueMaxAge < 0 {
+		v.addf("general.QUEUE_MAX_AGE: must not be negative")
+	}
+	if General.AlertInterval < 0 {
+		v.addf("general.ALERT_INTERVAL: must not be negative")
+	}
+	v.file("general.ADMIN_TEMPLATE", General.AdminTemplate)
+	if General.StatusMaxAge < 0 {
+		v.addf("general.STATUS_MAX_AGE: must not be negative")
+	}
+
+	// mail
+	v.required("mail.SERVER", Mail.Server)
+	v.port("mail.PORT", Mail.Port)
+	for _, f := range Mail.Fallbacks {
+		v.required(f.Section+".SERVER", f.Server)
+		v.port(f.Section+".PORT", f.Port)
+	}
+	switch Mail.AuthType {
+	case "", "auto", "plain", "login", "cram-md5":
+	case "xoauth2":
+		v.required("mail.USER", Mail.User)
+		v.required("mail.OAUTH_TOKEN_URL", Mail.OAuthTokenURL)
+		v.required("mail.OAUTH_CLIENT_ID", Mail.OAuthClientID)
+		v.required("mail.OAUTH_CLIENT_SECRET", Mail.OAuthClientSecret)
+	default:
+		v.addf("mail.AUTH_TYPE: unknown auth type %q", Mail.AuthType)
+	}
+	if strings.ContainsAny(Mail.HeloHost, " \t\r\n") {
+		v.addf("mail.HELO_HOST: invalid hostname %q", Mail.HeloHost)
+	}
+	if Mail.Proxy != "" {
+		switch u, err := url.Parse(Mail.Proxy); {
+		case err != nil:
+			v.addf("mail.PROXY: invalid url: %v", err)
+		case u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http":
+			v.addf("mail.PROXY: unsupported scheme %q, expected socks5, socks5h or http", u.Scheme)
+		case u.Host == "":
+			v.addf("mail.PROXY: missing host")
+		}
+	}
+	if Mail.DialTimeout <= 0 || Mail.Timeout <= 0 {
+		v.addf("mail: DIAL_TIMEOUT and TIMEOUT must be positive")
+	}
+	switch Mail.Encryption {
+	case "auto", "none", "starttls", "tls":
+	default:
+		v.addf("mail.ENCRYPTION: unknown encryption %q", Mail.Encryption)
+	}
+	switch Mail.Charset {
+	case "UTF-8", "ISO-8859-1", "ISO-8859-15":
+	case "US-ASCII":
+		if Mail.TransferEncoding == "8bit" {
+			v.addf("mail.TRANSFER_ENCODING: 8bit is pointless for US-ASCII, use quoted-printable or base64")
+		}
+	default:
+		v.addf("mail.CHARSET: unsupported charset %q", Mail.Charset)
+	}
+	switch Mail.TransferEncoding {
+	case "quoted-printable", "base64", "8bit":
+	default:
+		v.addf("mail.TRANSFER_ENCODING: unknown transfer encoding %q", Mail.TransferEncoding)
+	}
+	if v.required("mail.FROM", Mail.From) {
+		if _, err := netmail.ParseAddress(Mail.From); err != nil {
+			v.addf("mail.FROM: invalid address %q: %v", Mail.From, err)
+		}
+	}
+	if Mail.ReplyTo != "" {
+		if _, err := netmail.ParseAddress(Mail.ReplyTo); err != nil {
+			v.addf("mail.REPLY_TO: invalid address %q: %v", Mail.ReplyTo, err)
+		}
+	}
+	if len(Mail.To) == 0 {
+		v.addf("mail.TO: required")
+	}
+	v.addresses("mail.TO", Mail.To)
+	v.addresses("mail.CC", Mail.CC)
+	v.addresses("mail.BCC", Mail.BCC)
+	for name, value := range Mail.Headers {
+		v.header("mail.headers."+name, name, value)
+	}
+	v.file("mail.TEMPLATE_TEXT", Mail.TemplateText)
+	v.file("mail.TEMPLATE_HTML", Mail.TemplateHTML)
+	if Mail.Concurrency < 1 || Mail.Concurrency > 10 {
+		v.addf("mail.CONCURRENCY: %d out of range 1-10", Mail.Concurrency)
+	}
+	if Mail.ConnectRetries < 0 {
+		v.addf("mail.CONNECT_RETRIES: must not be negative")
+	}
+	if Mail.SendRetries < 0 {
+		v.addf("mail.SEND_RETRIES: must not be negative")
+	}
+	if Mail.BreakerThreshold < 0 {
+		v.addf("mail.BREAKER_THRESHOLD: must not be negative")
+	}
+	if Mail.KeepAlive > 0 && Mail.KeepAlive >= Mail.IdleTimeout {
+		v.addf("mail.KEEPALIVE: %s must be shorter than IDLE_TIMEOUT %s", Mail.KeepAlive, Mail.IdleTimeout)
+	}
+	if Mail.RateLimit < 0 {
+		v.addf("mail.RATE_LIMIT: must not be negative")
+	}
+	if Mail.Burst < 1 {
+		v.addf("mail.BURST: must be at least 1")
+	}
+	if Mail.Calendar && Mail.CalendarDuration <= 0 {
+		v.addf("mail.CALENDAR_DURATION: must be positive")
+	}
+	for provider, to := range Mail.Routing {
+		if len(to) == 0 {
+			v.addf("routing.%s: requires at least one recipient", provider)
+		}
+		v.addresses("routing."+provider, to)
+	}
+	v.route("mail.booked", MailBooked)
+	v.route("mail.cancelled", MailCancelled)
+
+	// webhook
+	if Webhook.URL != "" {
+		if u, err := url.Parse(Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// the url is a secret, so it is not reported
+			v.addf("webhook.URL: invalid http(s) url")
+		}
+	}
+	if Webhook.MaxRetries < 0 {
+		v.addf("webhook.MAX_RETRIES: must not be negative")
+	}
+
+	// slack
+	if Slack.WebhookURL != "" {
+		if u, err := url.Parse(Slack.WebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			// the url is a secret, so it is not reported
+			v.addf("slack.WEBHOOK_URL: invalid https url")
+		}
+	}
+	if Slack.MaxRetries < 0 {
+		v.addf("slack.MAX_RETRIES: must not be negative")
+	}
+
+	// tracing
+	if Tracing.Endpoint != "" {
+		if u, err := url.Parse(Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf("tracing.ENDPOINT: invalid http(s) url %q", Tracing.Endpoint)
+		}
+	}
+
+	// db
+	switch DB.Driver {
+	case "mssql":
+		v.required("db.SERVER", DB.Server)
+		switch {
+		case DB.Instance != "" && DB.Port != 0:
+			v.addf("db.PORT: must not be set together with db.INSTANCE, the port of named instances is resolved by the SQL Server Browser")
+		case DB.Instance == "":
+			v.port("db.PORT", DB.Port)
+		}
+	case "postgres", "mysql":
+		v.required("db.SERVER", DB.Server)
+		v.port("db.PORT", DB.Port)
+	case "sqlite":
+		// the database is a local file
+	default:
+		v.addf("db.DRIVER: unknown driver %q", DB.Driver)
+	}
+	v.required("db.DATABASE", DB.Database)
+	if DB.Query != "" {
+		// the last run is passed as first positional parameter
+		param := map[string]string{"mssql": "@p1", "postgres": "$1", "mysql": "?", "sqlite": "?"}[DB.Driver]
+		if param != "" && !strings.Contains(DB.Query, param) {
+			v.addf("db.QUERY: query does not reference the last run parameter %s", param)
+		}
+	}
+	if DB.AuditTable != "" && !auditTablePattern.MatchString(DB.AuditTable) {
+		v.addf("db.AUDIT_TABLE: invalid table name %q", DB.AuditTable)
+	}
+	if DB.MaxOpenConns < 0 || DB.MaxIdleConns < 0 || DB.ConnMaxLifetime < 0 {
+		v.addf("db: connection pool limits must not be negative")
+	}
+	if DB.ConnectRetries < 0 || DB.ConnectRetryDelay < 0 {
+		v.addf("db: CONNECT_RETRIES and CONNECT_RETRY_DELAY must not be negative")
+	}
+	if DB.QueryTimeout < 0 {
+		v.addf("db.QUERY_TIMEOUT: must not be negative")
+	}
+	if DB.PageSize < 0 {
+		v.addf("db.PAGE_SIZE: must not be negative")
+	}
+	if DB.PageSize > 0 && DB.Query != "" && !pageOrderPattern.MatchString(strings.TrimRight(DB.Query, "; \t\r\n")) {
+		// the row limit is appended to the query, and the next page starts after the last datlog of the previous one
+		v.addf("db.QUERY: query must end with ORDER BY datlog ASC to be collected in pages")
+	}
+
+	// reminder
+	if Reminder.Enabled {
+		// there is no default query, as the appointments table differs between installations
+		if v.required("reminder.QUERY", Reminder.Query) {
+			// the window is passed as first and second positional parameter
+			switch DB.Driver {
+			case "mysql", "sqlite":
+				// the parameters are not numbered, both have to be bound by placeholders in order
+				if strings.Count(Reminder.Query, "?") < 2 {
+					v.addf("reminder.QUERY: query does not reference both window parameters by ?")
+				}
+			default:
+				params := map[string][]string{"mssql": {"@p1", "@p2"}, "postgres": {"$1", "$2"}}[DB.Driver]
+				for _, param := range params {
+					if !strings.Contains(Reminder.Query, param) {
+						v.addf("reminder.QUERY: query does not reference the window parameter %s", param)
+					}
+				}
+			}
+		}
+		if Reminder.LeadTime <= 0 {
+			v.addf("reminder.LEAD_TIME: must be positive")
+		}
+		v.file("reminder.TEMPLATE_TEXT", Reminder.TemplateText)
+		v.file("reminder.TEMPLATE_HTML", Reminder.TemplateHTML)
+	}
+
+	// log
+	if _, err := zerolog.ParseLevel(Log.Level); err != nil {
+		v.addf("log.LEVEL: %v", err)
+	}
+	switch Log.Output {
+	case "file", "stdout", "stderr":
+	default:
+		v.addf("log.OUTPUT: unknown output %q", Log.Output)
+	}
+	if Log.MaxSizeMB < 0 || Log.MaxBackups < 0 || Log.MaxAgeDays < 0 {
+		v.addf("log: MAX_SIZE_MB, MAX_BACKUPS and MAX_AGE_DAYS must not be negative")
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{v.problems}
+	}
+	return nil
+}
+
+// auditTablePattern matches table names, optionally qualified by the schema
+// the name is part of the statements, so nothing else is allowed
+var auditTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// pageOrderPattern matches queries ending with an ascending order by the time of change, optionally qualified by the table
+var pageOrderPattern = regexp.MustCompile(`(?i)\bORDER\s+BY\s+([A-Za-z_][A-Za-z0-9_]*\.)?datlog(\s+ASC)?$`)
+
+// scheduleHint explains the expected format of a schedule
+const scheduleHint = "expected 5 fields (minute hour day-of-month month day-of-week) or 6 fields starting with seconds, " +
+	"e.g. 0 6 * * * or 0 0 6 * * *, or a descriptor like @hourly or @every 1h30m"
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// required reports an empty value, returns true if the value is set
+func (v *validator) required(key, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.addf("%s: required", key)
+		return false
+	}
+	return true
+}
+
+// addresses reports every address which does not parse
+func (v *validator) addresses(key string, addresses []string) {
+	for _, address := range addresses {
+		if _, err := netmail.ParseAddress(address); err != nil {
+			v.addf("%s: invalid address %q: %v", key, address, err)
+		}
+	}
+}
+
+// file reports a configured file path which does not exist
+func (v *validator) file(key, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.addf("%s: could not find file: %v", key, err)
+	}
+}
+
+// route reports problems of a mail route section
+func (v *validator) route(section string, route *MailRoute) {
+	if len(route.To) == 0 && (len(route.CC) > 0 || len(route.BCC) > 0) {
+		v.addf("%s.TO: required if CC or BCC is set", section)
+	}
+	v.addresses(section+".TO", route.To)
+	v.addresses(section+".CC", route.CC)
+	v.addresses(section+".BCC", route.BCC)
+	v.file(section+".TEMPLATE_TEXT", route.TemplateText)
+	v.file(section+".TEMPLATE_HTML", route.TemplateHTML)
+}
+
+// reservedHeaders are set by the mailer and must not be overridden by custom headers
+var reservedHeaders = []string{
+	"from", "to", "cc", "bcc", "reply-to", "subject", "date", "message-id", "mime-version",
+	"content-type", "content-transfer-encoding",
+}
+
+// header reports an invalid custom header
+func (v *validator) header(key, name, value string) {
+	for _, r := range name {
+		if r <= ' ' || r > '~' || r == ':' {
+			v.addf("%s: invalid header name %q", key, name)
+			return
+		}
+	}
+	for _, reserved := range reservedHeaders {
+		if strings.EqualFold(name, reserved) {
+			v.addf("%s: header %s is set by the mailer", key, name)
+			return
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		v.addf("%s: header value must not contain line breaks", key)
+	}
+}
+
+func (v *validator) port(key string, port int) {
+	if port < 1 || port > 65535 {
+		v.addf("%s: port %d out of range 1-65535", key, port)
+	}
+}
@@ -0,0 +1,126 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultAlertSubject is the subject of alerts without SubjectTemplate
+const defaultAlertSubject = "emed-mailer run failed"
+
+// Alerter interface notifies an administrator about failed runs
+type Alerter interface {
+	// Alert reports the failure of the run started at `run`, ctx carries the run ID
+	Alert(ctx context.Context, run time.Time, err error) error
+}
+
+// AlertConfig struct encapsulate all settings for failure alerts
+type AlertConfig struct {
+	// To are the addresses of the administrators
+	To []string
+	// Interval is the minimum time between alerts, failures in between are counted and reported with the next alert
+	Interval time.Duration
+
+	// SubjectTemplate and TextTemplate render alerts from AlertData, e.g. to match the parsing rules of a helpdesk
+	// both are optional, defaulting to a concise failure message
+	SubjectTemplate *texttemplate.Template
+	TextTemplate    *texttemplate.Template
+}
+
+// AlertData struct is passed to the alert templates
+type AlertData struct {
+	// Run is the start of the failed run
+	Run   time.Time
+	RunID string
+	// Error is the message of the failure
+	Error string
+	// Suppressed counts the failed runs since PreviousAlert, which did not get alerted due to the interval
+	Suppressed    int
+	PreviousAlert time.Time
+}
+
+type mailAlerter struct {
+	cfg    AlertConfig
+	mailer Mailer
+
+	mu sync.Mutex
+	// last is the time of the last alert
+	last time.Time
+	// suppressed counts the failures since the last alert
+	suppressed int
+}
+
+// NewMailAlerter creates an Alerter sending a concise failure message by the mailer
+func NewMailAlerter(cfg AlertConfig, mailer Mailer) Alerter {
+	return &mailAlerter{
+		cfg:    cfg,
+		mailer: mailer,
+	}
+}
+
+func (a *mailAlerter) Alert(ctx context.Context, run time.Time, err error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.last.IsZero() && run.Sub(a.last) < a.cfg.Interval {
+		a.suppressed++
+		return nil
+	}
+
+	data := &AlertData{
+		Run:           run,
+		RunID:         RunID(ctx),
+		Error:         err.Error(),
+		Suppressed:    a.suppressed,
+		PreviousAlert: a.last,
+	}
+	subject, text, err := a.render(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.mailer.SendMessage(&Message{
+		Subject: subject,
+		Text:    text,
+		To:      a.cfg.To,
+		RunID:   data.RunID,
+	}); err != nil {
+		return err
+	}
+
+	a.last = run
+	a.suppressed = 0
+	return nil
+}
+
+// render renders the subject and the text of the alert by the templates, if configured
+func (a *mailAlerter) render(data *AlertData) (string, string, error) {
+	subject := defaultAlertSubject
+	if a.cfg.SubjectTemplate != nil {
+		buf := new(strings.Builder)
+		if err := a.cfg.SubjectTemplate.Execute(buf, data); err != nil {
+			return "", "", errors.Wrap(err, "could not render alert subject")
+		}
+		subject = buf.String()
+	}
+
+	text := new(strings.Builder)
+	if a.cfg.TextTemplate != nil {
+		if err := a.cfg.TextTemplate.Execute(text, data); err != nil {
+			return "", "", errors.Wrap(err, "could not render alert")
+		}
+		return subject, text.String(), nil
+	}
+
+	fmt.Fprintf(text, "The emed-mailer run at %s failed:\n\n%s\n", data.Run.Format(time.RFC1123Z), data.Error)
+	if data.Suppressed > 0 {
+		fmt.Fprintf(text, "\n%d further runs failed since the previous alert at %s.\n", data.Suppressed, data.PreviousAlert.Format(time.RFC1123Z))
+	}
+	return subject, text.String(), nil
+}
@@ -0,0 +1,84 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChangedApptsJob_Run_Alert(t *testing.T) {
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, errors.New("could not connect to database"))
+
+	var sent []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { sent = append(sent, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	job := New(Config{
+		Alerter: NewMailAlerter(AlertConfig{To: []string{"admin@example.com"}, Interval: time.Hour}, m),
+	}, c, nil, &State{})
+
+	// failures within the interval are throttled
+	job.Run(context.Background())
+	job.Run(context.Background())
+
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, []string{"admin@example.com"}, sent[0].To)
+		assert.Contains(t, sent[0].Text, "could not connect to database")
+	}
+}
+
+func TestMailAlerter_Suppressed(t *testing.T) {
+	var sent []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { sent = append(sent, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	a := NewMailAlerter(AlertConfig{Interval: time.Hour}, m)
+	run := time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, a.Alert(context.Background(), run.Add(time.Duration(i)*time.Minute), errors.New("failed")))
+	}
+	assert.NoError(t, a.Alert(context.Background(), run.Add(time.Hour), errors.New("failed")))
+
+	if assert.Len(t, sent, 2) {
+		assert.Contains(t, sent[1].Text, "2 further runs failed since the previous alert")
+	}
+}
+
+func TestMailAlerter_Templates(t *testing.T) {
+	var sent []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { sent = append(sent, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	subjectTmpl, err := template.Inline("alert subject", "[emed-mailer] run {{ .RunID }} failed")
+	assert.NoError(t, err)
+	textTmpl, err := template.Inline("alert", "{{ .Run.Format \"2006-01-02\" }}: {{ .Error }}")
+	assert.NoError(t, err)
+
+	a := NewMailAlerter(AlertConfig{SubjectTemplate: subjectTmpl, TextTemplate: textTmpl}, m)
+	run := time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC)
+	assert.NoError(t, a.Alert(WithRunID(context.Background(), "r1"), run, errors.New("database unreachable")))
+
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "[emed-mailer] run r1 failed", sent[0].Subject)
+		assert.Equal(t, "2020-01-01: database unreachable", sent[0].Text)
+		assert.Equal(t, "r1", sent[0].RunID)
+	}
+}
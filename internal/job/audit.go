@@ -0,0 +1,23 @@
+package job
+
+import (
+	"context"
+	"time"
+)
+
+// AuditLog interface records sent notifications, e.g. for compliance
+type AuditLog interface {
+	Record(ctx context.Context, entries []*AuditEntry) error
+}
+
+// AuditEntry struct records the notification of one change
+type AuditEntry struct {
+	// ApptID is the ID of the change
+	ApptID    string
+	IsBooking bool
+	// Recipients are the addresses of To, CC and BCC
+	Recipients []string
+	Time       time.Time
+	// Err is the reason the notification failed, nil if it got sent
+	Err error
+}
@@ -0,0 +1,69 @@
+package job
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// auditLog records the entries in memory, failing if err is set
+type auditLog struct {
+	err error
+
+	mu      sync.Mutex
+	entries []*AuditEntry
+}
+
+func (a *auditLog) Record(ctx context.Context, entries []*AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, entries...)
+	return a.err
+}
+
+func TestMailNotifier_Audit(t *testing.T) {
+	booking := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 1, IsBooking: true}
+	cancellation := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 2}
+
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool { return len(msg.To) == 0 })).
+		Return(&Receipt{}, nil)
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool { return len(msg.To) > 0 })).
+		Return(nil, errors.New("rejected"))
+
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	audit := &auditLog{err: errors.New("audit table unavailable")}
+	notifier := NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Cancelled:    &Route{To: []string{"cancellations@example.com"}},
+		Audit:        audit,
+		Recipients:   []string{"frontdesk@example.com"},
+	}, m)
+
+	// a failing audit log does not fail the notification
+	err = notifier.Notify(context.Background(), time.Now(), []*ApptChange{booking, cancellation})
+	if assert.IsType(t, &PartialError{}, err) {
+		assert.Equal(t, []*ApptChange{booking}, err.(*PartialError).Notified)
+	}
+
+	if assert.Len(t, audit.entries, 2) {
+		byID := map[string]*AuditEntry{audit.entries[0].ApptID: audit.entries[0], audit.entries[1].ApptID: audit.entries[1]}
+
+		assert.Equal(t, []string{"frontdesk@example.com"}, byID[booking.ID()].Recipients)
+		assert.NoError(t, byID[booking.ID()].Err)
+		assert.Equal(t, []string{"cancellations@example.com"}, byID[cancellation.ID()].Recipients)
+		assert.Error(t, byID[cancellation.ID()].Err)
+	}
+}
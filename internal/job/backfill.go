@@ -0,0 +1,65 @@
+package job
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backfill notifies the changes after `from` up to and including `to`, e.g. after an outage
+// notified changes are remembered like those of a run, so they are neither sent twice nor sent again by runs
+// every page is remembered before the next one gets collected, so an interrupted backfill resumes where it stopped
+func (job *changedApptsJob) Backfill(ctx context.Context, from, to time.Time) error {
+	if !to.After(from) {
+		return errors.Errorf("backfill range %s - %s is empty", from, to)
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	ctx = WithRunID(ctx, newRunID())
+	run := time.Now()
+	cursor := from
+	for {
+		collected, more, err := job.collectPage(ctx, cursor)
+		if err != nil {
+			return errors.Wrap(err, "collect updated appointments failed")
+		}
+		if more {
+			cursor = collected[len(collected)-1].Time
+		}
+
+		var changedAppts []*ApptChange
+		for _, change := range collected {
+			if !change.Time.After(to) {
+				changedAppts = append(changedAppts, change)
+			}
+		}
+		// the changes are ordered, so later pages are beyond the range
+		more = more && !cursor.After(to)
+		changedAppts = job.dedupe(changedAppts)
+
+		Logger(ctx).Info().
+			Time("from", from).
+			Time("to", to).
+			Int("collected", len(collected)).
+			Int("changes", len(changedAppts)).
+			Msg("backfilling changes")
+
+		if len(changedAppts) > 0 {
+			notified, keys, err := job.notify(ctx, from, changedAppts)
+			job.statsMu.Lock()
+			job.stats.Notified += len(notified)
+			job.statsMu.Unlock()
+
+			job.commit(ctx, run, keys, false)
+			if err != nil {
+				return errors.Wrapf(err, "backfill notified %d of %d changes", len(notified), len(changedAppts))
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
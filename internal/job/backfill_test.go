@@ -0,0 +1,113 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChangedApptsJob_Backfill(t *testing.T) {
+	from := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+	notified := &ApptChange{Time: from.Add(time.Minute), PatientID: 1, IsBooking: true}
+	missed := &ApptChange{Time: from.Add(time.Hour), PatientID: 2, IsBooking: true}
+	later := &ApptChange{Time: to.Add(time.Minute), PatientID: 3}
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, from).
+		Return([]*ApptChange{notified, missed, later}, nil)
+
+	// only the missed change within the range gets sent
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool {
+			return msg.Text == "2"
+		})).
+		Return(&Receipt{}, nil).
+		Once()
+
+	textTmpl, err := template.Inline("text", "{{ range .ChangedAppts }}{{ .PatientID }}{{ end }}")
+	assert.NoError(t, err)
+
+	lastRun := time.Now().Add(-time.Hour)
+	job := New(Config{
+		DedupeRetention: time.Hour,
+	}, c, []Notifier{NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Digest:       true,
+	}, m)}, &State{
+		LastRun:  lastRun,
+		Notified: map[string]time.Time{notified.ID(): time.Now()},
+	})
+
+	assert.NoError(t, job.Backfill(context.Background(), from, to))
+	m.AssertExpectations(t)
+
+	// backfilled changes are remembered, the last run stays
+	impl := job.(*changedApptsJob)
+	assert.Contains(t, impl.notified, missed.ID())
+	assert.Equal(t, lastRun, impl.lastRun)
+
+	assert.Error(t, job.Backfill(context.Background(), to, from))
+}
+
+// pageCollector returns the pages in order, recording after which time each got collected
+type pageCollector struct {
+	MockCollector
+	pages [][]*ApptChange
+	err   error
+	since []time.Time
+}
+
+func (c *pageCollector) CollectChangedApptsPage(ctx context.Context, since time.Time) ([]*ApptChange, bool, error) {
+	c.since = append(c.since, since)
+	if len(c.pages) == 0 {
+		return nil, false, c.err
+	}
+	page := c.pages[0]
+	c.pages = c.pages[1:]
+	return page, len(c.pages) > 0 || c.err != nil, nil
+}
+
+func TestChangedApptsJob_Backfill_Pages(t *testing.T) {
+	from := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+	first := &ApptChange{Time: from.Add(time.Minute), PatientID: 1, IsBooking: true}
+	second := &ApptChange{Time: from.Add(time.Hour), PatientID: 2, IsBooking: true}
+
+	// the backfill gets interrupted collecting the second page
+	c := &pageCollector{
+		pages: [][]*ApptChange{{first}, {second}},
+		err:   errors.New("connection refused"),
+	}
+
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
+		Twice()
+
+	textTmpl, err := template.Inline("text", "{{ range .ChangedAppts }}{{ .PatientID }}{{ end }}")
+	assert.NoError(t, err)
+
+	job := New(Config{DedupeRetention: time.Hour}, c, []Notifier{NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Digest:       true,
+	}, m)}, &State{})
+
+	assert.Error(t, job.Backfill(context.Background(), from, to))
+	assert.Equal(t, []time.Time{from, first.Time, second.Time}, c.since)
+
+	// the pages sent before the interruption are remembered
+	impl := job.(*changedApptsJob)
+	assert.Contains(t, impl.notified, first.ID())
+	assert.Contains(t, impl.notified, second.ID())
+	m.AssertExpectations(t)
+}
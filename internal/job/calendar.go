@@ -0,0 +1,152 @@
+package job
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CalendarRequest method invites to booked appointments
+	CalendarRequest = "REQUEST"
+	// CalendarCancel method removes cancelled appointments
+	CalendarCancel = "CANCEL"
+
+	icsTimeFormat = "20060102T150405Z"
+)
+
+// CalendarConfig struct encapsulate all settings of attached calendar invites
+type CalendarConfig struct {
+	// Duration of appointments, the database knows the start only
+	Duration time.Duration
+	// Organizer is the mail address the invites are sent from, optional
+	Organizer string
+}
+
+// calendarUID identifies the appointment, booking and cancellation share the same UID
+// so calendar clients remove the event on cancellation, and move it if the appointment got moved
+// without the id of the appointment the UID falls back to the patient and the start
+func calendarUID(change *ApptChange) string {
+	if change.ApptID != "" {
+		return change.ApptID + "@emed-mailer"
+	}
+	return fmt.Sprintf("%d-%s@emed-mailer", change.PatientID, change.Appointment.UTC().Format(icsTimeFormat))
+}
+
+// calendarSummary names the provider and the patient of the appointment
+func calendarSummary(change *ApptChange) string {
+	if change.Provider != "" {
+		return "eTermin " + change.Provider + ": " + change.PatientName
+	}
+	return "eTermin: " + change.PatientName
+}
+
+// calendar renders the changes as iCalendar object (RFC 5545) with the given method
+func calendar(cfg *CalendarConfig, method string, changes []*ApptChange, now time.Time) []byte {
+	buf := new(bytes.Buffer)
+	line := func(format string, args ...interface{}) {
+		buf.WriteString(foldLine(fmt.Sprintf(format, args...)))
+		buf.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//emed-appts//emed-mailer//DE")
+	line("METHOD:%s", method)
+	for _, change := range latestPerUID(changes) {
+		line("BEGIN:VEVENT")
+		line("UID:%s", calendarUID(change))
+		line("DTSTAMP:%s", now.UTC().Format(icsTimeFormat))
+		line("DTSTART:%s", change.Appointment.UTC().Format(icsTimeFormat))
+		line("DTEND:%s", change.Appointment.Add(cfg.Duration).UTC().Format(icsTimeFormat))
+		line("SUMMARY:%s", escapeText(calendarSummary(change)))
+		if change.Location != "" {
+			line("LOCATION:%s", escapeText(change.Location))
+		}
+		if cfg.Organizer != "" {
+			line("ORGANIZER:mailto:%s", cfg.Organizer)
+		}
+		// later changes of the same UID supersede the earlier ones, e.g. a cancellation or a move of the invite
+		line("SEQUENCE:%d", change.Time.Unix())
+		if method == CalendarCancel {
+			line("STATUS:CANCELLED")
+		} else {
+			line("STATUS:CONFIRMED")
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+
+	return buf.Bytes()
+}
+
+// latestPerUID keeps the latest change of every UID, in the order the UIDs first occur
+// a calendar object must not hold several events of the same UID (RFC 5546), e.g. of an appointment moved twice
+func latestPerUID(changes []*ApptChange) []*ApptChange {
+	index := make(map[string]int, len(changes))
+	var latest []*ApptChange
+	for _, change := range changes {
+		uid := calendarUID(change)
+		i, ok := index[uid]
+		if !ok {
+			index[uid] = len(latest)
+			latest = append(latest, change)
+			continue
+		}
+		if !change.Time.Before(latest[i].Time) {
+			latest[i] = change
+		}
+	}
+	return latest
+}
+
+// calendarAttachments returns an invite for the bookings and a cancellation for the cancelled appointments
+func calendarAttachments(cfg *CalendarConfig, changes []*ApptChange, now time.Time) []*Attachment {
+	var booked, cancelled []*ApptChange
+	for _, change := range changes {
+		if change.IsBooking {
+			booked = append(booked, change)
+		} else {
+			cancelled = append(cancelled, change)
+		}
+	}
+
+	var attachments []*Attachment
+	for _, c := range []struct {
+		method  string
+		changes []*ApptChange
+	}{{CalendarRequest, booked}, {CalendarCancel, cancelled}} {
+		if len(c.changes) == 0 {
+			continue
+		}
+		attachments = append(attachments, &Attachment{
+			Name:        "appointment.ics",
+			ContentType: "text/calendar; charset=utf-8; method=" + c.method,
+			Data:        calendar(cfg, c.method, c.changes, now),
+		})
+	}
+	return attachments
+}
+
+// escapeText escapes a TEXT property value
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// foldLine splits content lines longer than 75 octets, continuation lines start with a space
+// it never splits within a multi-byte character
+func foldLine(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package job
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalendarAttachments(t *testing.T) {
+	appt := time.Date(2020, 3, 2, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &CalendarConfig{Duration: 15 * time.Minute, Organizer: "praxis@example.com"}
+
+	attachments := calendarAttachments(cfg, []*ApptChange{
+		{Time: now, Appointment: appt, PatientID: 1, PatientName: "Lastname, Firstname", IsBooking: true},
+		{Time: now.Add(time.Minute), Appointment: appt, PatientID: 1, PatientName: "Lastname, Firstname", IsBooking: false},
+	}, now)
+
+	if assert.Len(t, attachments, 2) {
+		request, cancel := string(attachments[0].Data), string(attachments[1].Data)
+
+		assert.Equal(t, "appointment.ics", attachments[0].Name)
+		assert.Equal(t, "text/calendar; charset=utf-8; method=REQUEST", attachments[0].ContentType)
+		assert.Contains(t, request, "METHOD:REQUEST\r\n")
+		assert.Contains(t, request, "DTSTART:20200302T093000Z\r\n")
+		assert.Contains(t, request, "DTEND:20200302T094500Z\r\n")
+		assert.Contains(t, request, "SUMMARY:eTermin: Lastname\\, Firstname\r\n")
+		assert.Contains(t, request, "ORGANIZER:mailto:praxis@example.com\r\n")
+
+		// the cancellation removes the event of the booking
+		assert.Contains(t, cancel, "METHOD:CANCEL\r\n")
+		assert.Contains(t, cancel, "STATUS:CANCELLED\r\n")
+		assert.Contains(t, request, "UID:1-20200302T093000Z@emed-mailer\r\n")
+		assert.Contains(t, cancel, "UID:1-20200302T093000Z@emed-mailer\r\n")
+		// the cancellation is the later revision
+		assert.Contains(t, request, "SEQUENCE:1583064000\r\n")
+		assert.Contains(t, cancel, "SEQUENCE:1583064060\r\n")
+	}
+}
+
+func TestCalendarAttachments_ApptID(t *testing.T) {
+	appt := time.Date(2020, 3, 2, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &CalendarConfig{Duration: 15 * time.Minute}
+
+	// two appointments of the patient in the same slot, the second gets moved
+	attachments := calendarAttachments(cfg, []*ApptChange{
+		{Time: now, Appointment: appt, PatientID: 1, PatientName: "Lastname Firstname", IsBooking: true, Provider: "Dr. Huber", ApptID: "4711"},
+		{Time: now, Appointment: appt, PatientID: 1, PatientName: "Lastname Firstname", IsBooking: true, Provider: "Dr. Gruber", ApptID: "4712"},
+		{Time: now.Add(time.Minute), Appointment: appt.Add(time.Hour), PatientID: 1, PatientName: "Lastname Firstname", IsBooking: true,
+			Provider: "Dr. Gruber", ApptID: "4712", PreviousAppointment: appt},
+	}, now)
+
+	if assert.Len(t, attachments, 1) {
+		request := string(attachments[0].Data)
+		assert.Contains(t, request, "SUMMARY:eTermin Dr. Huber: Lastname Firstname\r\n")
+		assert.Contains(t, request, "SUMMARY:eTermin Dr. Gruber: Lastname Firstname\r\n")
+		assert.Equal(t, 1, strings.Count(request, "UID:4711@emed-mailer\r\n"))
+		// the moved appointment keeps its UID, only its latest change is part of the invite
+		assert.Equal(t, 1, strings.Count(request, "UID:4712@emed-mailer\r\n"))
+		assert.Equal(t, 2, strings.Count(request, "BEGIN:VEVENT\r\n"))
+		assert.Contains(t, request, "DTSTART:20200302T103000Z\r\n")
+		assert.Contains(t, request, "SEQUENCE:1583064060\r\n")
+	}
+}
+
+func TestFoldLine(t *testing.T) {
+	folded := foldLine("SUMMARY:" + strings.Repeat("ä", 50))
+	for _, line := range strings.Split(folded, "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+	}
+	assert.Equal(t, "SUMMARY:"+strings.Repeat("ä", 50), strings.Replace(folded, "\r\n ", "", -1))
+}
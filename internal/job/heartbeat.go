@@ -0,0 +1,63 @@
+package job
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Heartbeat sends a periodic liveness message, independent of the change notifications
+type Heartbeat struct {
+	job    Job
+	to     []string
+	mailer Mailer
+
+	// mu serializes heartbeats
+	mu sync.Mutex
+	// notified is the number of notified changes at the previous heartbeat
+	notified int
+}
+
+// NewHeartbeat creates a Heartbeat reporting the stats of the job to the given addresses
+func NewHeartbeat(job Job, to []string, mailer Mailer) *Heartbeat {
+	return &Heartbeat{
+		job:    job,
+		to:     to,
+		mailer: mailer,
+	}
+}
+
+// Run sends one heartbeat, suitable for scheduling
+func (hb *Heartbeat) Run() {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	stats := hb.job.Stats()
+
+	lastPoll := "never since startup"
+	if !stats.LastPoll.IsZero() {
+		lastPoll = stats.LastPoll.Format(time.RFC1123Z)
+	}
+
+	text := new(strings.Builder)
+	fmt.Fprintf(text, "emed-mailer is still running.\n\n")
+	fmt.Fprintf(text, "Changes notified since the last heartbeat: %d\n", stats.Notified-hb.notified)
+	fmt.Fprintf(text, "Last successful database poll: %s\n", lastPoll)
+
+	if _, err := hb.mailer.SendMessage(&Message{
+		Subject: fmt.Sprintf("emed-mailer heartbeat: %d changes", stats.Notified-hb.notified),
+		Text:    text.String(),
+		To:      hb.to,
+	}); err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not send heartbeat")
+
+		return
+	}
+
+	hb.notified = stats.Notified
+}
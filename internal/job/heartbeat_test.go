@@ -0,0 +1,56 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHeartbeat(t *testing.T) {
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return([]*ApptChange{
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 1, IsBooking: true},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 2, IsBooking: false},
+		}, nil).
+		Once()
+
+	var sent []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { sent = append(sent, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	subjectTmpl, err := template.Inline("subject", "changes")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		Digest:          true,
+	}, m)}, &State{})
+	hb := NewHeartbeat(job, []string{"admin@example.com"}, m)
+
+	hb.Run()
+	assert.NoError(t, job.Execute(context.Background()).Err)
+	hb.Run()
+	hb.Run()
+
+	// the second message is the digest of the run
+	if assert.Len(t, sent, 4) {
+		assert.Contains(t, sent[0].Text, "Last successful database poll: never since startup")
+		assert.Equal(t, []string{"admin@example.com"}, sent[2].To)
+		assert.Contains(t, sent[2].Text, "Changes notified since the last heartbeat: 2")
+		assert.Contains(t, sent[2].Text, job.Stats().LastPoll.Format(time.RFC1123Z))
+		assert.Contains(t, sent[3].Text, "Changes notified since the last heartbeat: 0")
+	}
+}
@@ -1,93 +1,736 @@
 package job
 
 import (
-	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/emed-appts/emed-mailer/internal/template"
+	"github.com/emed-appts/emed-mailer/internal/metrics"
 
-	"github.com/rs/zerolog/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// Mailer interface
-type Mailer interface {
-	Run(<-chan struct{}) error
-	SendMessage(string, string) error
+// Config struct encapsulate all settings for a Job
+type Config struct {
+	// StateStore persists the state between runs, optional
+	StateStore StateStore
+	// DedupeRetention is how long notified changes are remembered to suppress duplicates
+	DedupeRetention time.Duration
+	// LookbackWindow collects at least the changes within the window before a run, even if they are older than the last run
+	// changes logged late or by a clock behind are caught this way, zero collects since the last run only
+	LookbackWindow time.Duration
+	// SkipIfRunning skips a run if the previous one is still in progress
+	// otherwise the run waits for the previous one to finish
+	SkipIfRunning bool
+	// DryRun marks runs whose notifications only get logged by the notifiers
+	// dry runs neither advance lastRun nor remember notified changes, unless DryRunCommit is set
+	DryRun       bool
+	DryRunCommit bool
+	// Alerter notifies about failed runs, optional
+	Alerter Alerter
+	// Queue persists changes whose notification failed, optional
+	// queued changes are retried first thing in later runs, otherwise failed runs collect the same window again
+	Queue Queue
+	// QueueMaxAge is how long queued changes are retried, zero retries forever
+	QueueMaxAge time.Duration
+	// CollectRetries of collections failing with ErrUnavailable, waiting CollectRetryDelay before the first retry and doubling it afterwards
+	CollectRetries    int
+	CollectRetryDelay time.Duration
 }
 
-// ApptChange struct
+// ApptChange struct is a booked or cancelled appointment, as collected and passed to the templates
+// fields are only ever added, so templates and persisted state keep working
 type ApptChange struct {
-	Time        time.Time
+	// Time is when the appointment got booked or cancelled
+	Time time.Time
+	// Appointment is the start of the appointment
 	Appointment time.Time
 	PatientID   int
 	PatientName string
 	IsBooking   bool
+
+	// Provider, Location and PreviousAppointment are empty unless collected by a custom query
+	Provider string
+	Location string
+	// PreviousAppointment is the start before the appointment got moved
+	PreviousAppointment time.Time
+	// ApptID identifies the appointment in the database, it stays the same when the appointment gets moved
+	ApptID string
+}
+
+// ChangeType returns booked or cancelled, like the mail routes and the audit trail
+func (change *ApptChange) ChangeType() string {
+	if change.IsBooking {
+		return "booked"
+	}
+	return "cancelled"
+}
+
+// ID identifies the change, the same change collected twice results in the same ID
+func (change *ApptChange) ID() string {
+	return fmt.Sprintf("%d/%s/%s/%t",
+		change.PatientID,
+		change.Time.UTC().Format(time.RFC3339Nano),
+		change.Appointment.UTC().Format(time.RFC3339Nano),
+		change.IsBooking,
+	)
+}
+
+// FindChange collects the change identified by `id` again, see ApptChange.ID
+func FindChange(ctx context.Context, collector Collector, id string) (*ApptChange, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 4 {
+		return nil, errors.Errorf("invalid appointment id %q, expected <patient id>/<time of change>/<appointment>/<is booking>", id)
+	}
+	changed, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid time of change in appointment id %q", id)
+	}
+
+	// changes are collected after the given time, so start just before the change
+	changes, err := collector.CollectChangedAppts(ctx, changed.Add(-time.Second))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not collect changed appointments")
+	}
+	for _, change := range changes {
+		if change.ID() == id {
+			return change, nil
+		}
+	}
+	return nil, errors.Errorf("could not find appointment %s", id)
 }
 
 // Collector interface
 type Collector interface {
 	// collects latest changed appointments ordered by time of change
-	CollectChangedAppts(time.Time) ([]*ApptChange, error)
+	// cancelling the context aborts the collection
+	CollectChangedAppts(context.Context, time.Time) ([]*ApptChange, error)
+}
+
+// PageCollector is implemented by collectors reading the changes in pages, bounding the memory of large collections
+// runs and backfills notify every page before collecting the next one
+type PageCollector interface {
+	// CollectChangedApptsPage collects a page of the changes after the given time ordered by time of change
+	// more reports further changes, the next page collects them after the time of the last change of this page
+	CollectChangedApptsPage(context.Context, time.Time) (changes []*ApptChange, more bool, err error)
+}
+
+// kinds of collector failures, test for them by errors.Is
+var (
+	// ErrUnavailable reports the database could not be reached, a later attempt may succeed
+	ErrUnavailable = errors.New("database unavailable")
+	// ErrQueryFailed reports the database rejected the query, e.g. a broken custom query
+	ErrQueryFailed = errors.New("query failed")
+	// ErrScanFailed reports rows not matching the columns expected by the collector
+	ErrScanFailed = errors.New("scan failed")
+)
+
+// CollectError is returned by a Collector which failed to collect the changes
+type CollectError struct {
+	// Kind is ErrUnavailable, ErrQueryFailed or ErrScanFailed
+	Kind error
+	// Err is the failure reported by the database
+	Err error
+}
+
+func (err *CollectError) Error() string {
+	return err.Kind.Error() + ": " + err.Err.Error()
+}
+
+// Unwrap returns the failure reported by the database, e.g. for errors.As on driver errors
+func (err *CollectError) Unwrap() error {
+	return err.Err
+}
+
+// Is reports whether target is the kind of the failure
+func (err *CollectError) Is(target error) bool {
+	return target == err.Kind
+}
+
+// Notifier interface delivers changed appointments, e.g. by mail or webhook
+type Notifier interface {
+	// Name identifies the deliveries of the notifier in the state, e.g. mail
+	// it must not change between releases, or changes only some notifiers delivered get sent again
+	Name() string
+	// Notify delivers the changes collected since lastRun, retrying as configured for the notifier
+	// changes delivered before a failure are reported by a *PartialError
+	Notify(ctx context.Context, lastRun time.Time, changes []*ApptChange) error
+}
+
+// PartialError is returned by a Notifier which failed after delivering some of the changes
+type PartialError struct {
+	// Notified lists the delivered changes
+	Notified []*ApptChange
+	// Err is the failure
+	Err error
+}
+
+func (err *PartialError) Error() string {
+	return err.Err.Error()
+}
+
+// State struct holds everything a job needs to resume after a restart
+type State struct {
+	// LastRun is the execution time of the last successful run
+	LastRun time.Time
+	// Notified maps IDs of already notified changes to the time of notification
+	// changes only some notifiers delivered are mapped by <name>/<ID> per notifier, see notifierNames
+	Notified map[string]time.Time
+}
+
+// StateStore interface
+type StateStore interface {
+	// LoadState returns the persisted state, an empty state if nothing got persisted yet
+	LoadState() (*State, error)
+	SaveState(*State) error
 }
 
 // Job interface
 type Job interface {
-	Run()
+	// Run executes the job once and logs failures, suitable for scheduling
+	Run(context.Context)
+	// Execute executes the job once and returns its outcome
+	Execute(context.Context) RunResult
+	// Pending collects the changes the next run would notify, without notifying them
+	// queued changes the run retries first come first, changes collected since the last run have no Queued time
+	Pending(context.Context) ([]*QueuedChange, error)
+	// Backfill notifies the changes within the range, skipping already notified ones
+	// it does not advance the last run
+	Backfill(ctx context.Context, from, to time.Time) error
+	// Stats returns the statistics since the job got created
+	Stats() Stats
+	// SetNotifiers replaces the notifiers, e.g. after a config reload
+	// it waits for a run in progress
+	SetNotifiers([]Notifier)
+}
+
+// Stats struct holds statistics of the runs of a job
+type Stats struct {
+	// Notified counts the changes delivered by all notifiers
+	Notified int
+	// LastPoll is the time of the last successful collection, zero if none succeeded yet
+	LastPoll time.Time
+	// LastRun is the start of the last finished run and LastResult its outcome, zero if none finished yet
+	// skipped runs are not recorded
+	LastRun    time.Time
+	LastResult RunResult
+	// LastSuccess is the start of the last successful run, zero if none succeeded yet
+	LastSuccess time.Time
+}
+
+// RunResult struct summarizes a run
+type RunResult struct {
+	// Collected counts the collected changes and the queued ones retried, already notified ones included
+	Collected int
+	// Sent counts the changes delivered by all notifiers
+	Sent int
+	// Failed counts the changes a notifier failed to deliver
+	Failed int
+	// Duration is how long the run took
+	Duration time.Duration
+	// Err is why the run failed, nil if it succeeded or got skipped
+	Err error
 }
 
 type changedApptsJob struct {
+	// mu serializes runs
+	mu sync.Mutex
+	// running is set while a run is in progress
+	running uint32
+
+	cfg       Config
 	collector Collector
-	mailer    Mailer
+	notifiers []Notifier
 	lastRun   time.Time
+	notified  map[string]time.Time
+
+	// statsMu guards stats, which are read while a run is in progress
+	statsMu sync.Mutex
+	stats   Stats
 }
 
-// New creates a Job instance
-func New(collector Collector, mailer Mailer, lastRun time.Time) Job {
+// New creates a Job instance resuming from the given state
+// every change gets delivered by all notifiers
+func New(cfg Config, collector Collector, notifiers []Notifier, state *State) Job {
+	notified := state.Notified
+	if notified == nil {
+		notified = make(map[string]time.Time)
+	}
+
 	return &changedApptsJob{
+		cfg:       cfg,
 		collector: collector,
-		mailer:    mailer,
-		lastRun:   lastRun,
+		notifiers: notifiers,
+		lastRun:   state.LastRun,
+		notified:  notified,
 	}
 }
 
-// Run executes the job once
-func (job *changedApptsJob) Run() {
+// Run executes the job once and logs the result
+// failures are alerted, unless caused by shutdown
+func (job *changedApptsJob) Run(ctx context.Context) {
+	ctx = WithRunID(ctx, newRunID())
+	run := time.Now()
+	result := job.Execute(ctx)
+	err := result.Err
+	if err == nil {
+		Logger(ctx).Debug().
+			Int("collected", result.Collected).
+			Int("sent", result.Sent).
+			Dur("duration", result.Duration).
+			Msg("job run finished")
+
+		return
+	}
+
+	Logger(ctx).Error().
+		Err(err).
+		Int("collected", result.Collected).
+		Int("sent", result.Sent).
+		Int("failed", result.Failed).
+		Dur("duration", result.Duration).
+		Msg("job run failed")
+
+	if job.cfg.Alerter == nil || ctx.Err() != nil {
+		return
+	}
+	if err := job.cfg.Alerter.Alert(ctx, run, err); err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Msg("could not send failure alert")
+	}
+}
+
+// Execute executes the job once and returns how many changes got notified and why it failed
+// a run skipped because the previous one is still in progress is no failure
+func (job *changedApptsJob) Execute(ctx context.Context) RunResult {
+	if RunID(ctx) == "" {
+		ctx = WithRunID(ctx, newRunID())
+	}
+	start := time.Now()
+
+	ctx, span := startSpan(ctx, "job.run", attribute.String("run.id", RunID(ctx)))
+	if job.cfg.SkipIfRunning {
+		if !atomic.CompareAndSwapUint32(&job.running, 0, 1) {
+			Logger(ctx).Warn().
+				Msg("previous run still in progress, skipping run")
+
+			span.SetAttributes(attribute.Bool("run.skipped", true))
+			endSpan(span, nil)
+			return RunResult{Duration: time.Since(start)}
+		}
+		defer atomic.StoreUint32(&job.running, 0)
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	timer := prometheus.NewTimer(metrics.JobDuration)
+	defer timer.ObserveDuration()
+
+	var result RunResult
+	result.Err = job.run(ctx, &result)
+	result.Duration = time.Since(start)
+
+	job.statsMu.Lock()
+	job.stats.LastRun = start
+	job.stats.LastResult = result
+	if result.Err == nil {
+		job.stats.LastSuccess = start
+	}
+	job.statsMu.Unlock()
+
+	span.SetAttributes(
+		attribute.Int("appointments.collected", result.Collected),
+		attribute.Int("appointments.sent", result.Sent),
+		attribute.Int("appointments.failed", result.Failed),
+	)
+	endSpan(span, result.Err)
+	return result
+}
+
+func (job *changedApptsJob) run(ctx context.Context, result *RunResult) error {
 	// store execution time
 	run := time.Now()
 
-	changedAppts, err := job.collector.CollectChangedAppts(job.lastRun)
+	// retry the changes of previous runs before processing new ones
+	var drainErr error
+	if job.cfg.Queue != nil {
+		drainErr = job.drain(ctx, run, result)
+	}
+
+	if err := job.process(ctx, run, result); err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// process notifies the changes since the last run page by page and adds them to the result
+func (job *changedApptsJob) process(ctx context.Context, run time.Time, result *RunResult) error {
+	since := job.since(run)
+	cursor := since
+	var collected, fresh int
+	for {
+		changedAppts, more, err := job.collectPage(ctx, cursor)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Wrap(ctx.Err(), "collect updated appointments cancelled by shutdown")
+			}
+			return errors.Wrap(err, "collect updated appointments failed")
+		}
+
+		metrics.AppointmentsProcessed.Add(float64(len(changedAppts)))
+		job.statsMu.Lock()
+		job.stats.LastPoll = run
+		job.statsMu.Unlock()
+
+		collected += len(changedAppts)
+		result.Collected += len(changedAppts)
+		if more {
+			cursor = changedAppts[len(changedAppts)-1].Time
+		}
+
+		// skip changes which already got notified, e.g. by an overlapping run
+		changedAppts = job.dedupe(changedAppts)
+		fresh += len(changedAppts)
+		// only the last page advances lastRun, so an interrupted run collects the remaining pages again
+		if err := job.notifyPage(ctx, run, since, changedAppts, !more, result); err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+
+	if fresh == 0 {
+		// logged at info level, so quiet periods prove the runs happen
+		Logger(ctx).Info().
+			Time("since", since).
+			Time("until", run).
+			Int("collected", collected).
+			Msg("0 changes to notify")
+	}
+	return nil
+}
+
+// notifyPage notifies a page of the changes collected since `since` and commits them, the last page advances lastRun
+func (job *changedApptsJob) notifyPage(ctx context.Context, run, since time.Time, changedAppts []*ApptChange, last bool, result *RunResult) error {
+	if len(changedAppts) == 0 {
+		job.commit(ctx, run, nil, last)
+		return nil
+	}
+
+	notified, keys, err := job.notify(ctx, since, changedAppts)
+	result.Sent += len(notified)
+	result.Failed += len(changedAppts) - len(notified)
+	job.statsMu.Lock()
+	job.stats.Notified += len(notified)
+	job.statsMu.Unlock()
+
+	Logger(ctx).Info().
+		Int("changes", len(changedAppts)).
+		Int("notified", len(notified)).
+		Int("failed", len(changedAppts)-len(notified)).
+		Msg("notified changed appointments")
+
 	if err != nil {
-		log.Error().
+		// remember what got delivered, and either queue the rest or collect the same window again next run
+		queued := job.enqueue(ctx, run, changedAppts, notified)
+		job.commit(ctx, run, keys, last && queued)
+		return errors.Wrapf(err, "notified %d of %d changes", len(notified), len(changedAppts))
+	}
+
+	// persist state only after the changes got delivered
+	job.commit(ctx, run, keys, last)
+	return nil
+}
+
+// since returns where a run at `run` starts collecting, the last run or the start of the lookback window if earlier
+// changes collected twice are skipped by dedupe
+func (job *changedApptsJob) since(run time.Time) time.Time {
+	if start := run.Add(-job.cfg.LookbackWindow); job.cfg.LookbackWindow > 0 && start.Before(job.lastRun) {
+		return start
+	}
+	return job.lastRun
+}
+
+// collect collects all changes since `since`, retrying while the database is unavailable
+func (job *changedApptsJob) collect(ctx context.Context, since time.Time) ([]*ApptChange, error) {
+	var changedAppts []*ApptChange
+	err := job.retryCollect(ctx, func() error {
+		var err error
+		changedAppts, err = job.collector.CollectChangedAppts(ctx, since)
+		return err
+	})
+	return changedAppts, err
+}
+
+// collectPage collects a page of the changes since `since` like collect, all of them if the collector has no pages
+func (job *changedApptsJob) collectPage(ctx context.Context, since time.Time) ([]*ApptChange, bool, error) {
+	pager, ok := job.collector.(PageCollector)
+	if !ok {
+		changedAppts, err := job.collect(ctx, since)
+		return changedAppts, false, err
+	}
+
+	var changedAppts []*ApptChange
+	var more bool
+	err := job.retryCollect(ctx, func() error {
+		var err error
+		changedAppts, more, err = pager.CollectChangedApptsPage(ctx, since)
+		return err
+	})
+	return changedAppts, more, err
+}
+
+// retryCollect runs the collection, retrying while the database is unavailable
+// other failures, e.g. a broken query, would fail again and are returned right away
+func (job *changedApptsJob) retryCollect(ctx context.Context, collect func() error) error {
+	delay := job.cfg.CollectRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := collect()
+		if err == nil || !errors.Is(err, ErrUnavailable) || attempt > job.cfg.CollectRetries {
+			return err
+		}
+
+		Logger(ctx).Warn().
 			Err(err).
-			Msg("collect updated appointments failed")
+			Int("attempt", attempt).
+			Dur("delay", delay).
+			Msg("could not collect changed appointments, retrying")
 
-		return
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Pending returns the queued changes and collects the changes since the last run, skipping already notified ones like a run does
+func (job *changedApptsJob) Pending(ctx context.Context) ([]*QueuedChange, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	now := time.Now()
+	var pending []*QueuedChange
+	if job.cfg.Queue != nil {
+		queue, err := job.cfg.Queue.LoadQueue()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load queue")
+		}
+
+		// like drain, changes queued longer than QueueMaxAge are given up
+		var changes []*ApptChange
+		queued := make(map[*ApptChange]time.Time, len(queue))
+		for _, q := range queue {
+			if job.cfg.QueueMaxAge > 0 && now.Sub(q.Queued) > job.cfg.QueueMaxAge {
+				continue
+			}
+			changes = append(changes, q.Change)
+			queued[q.Change] = q.Queued
+		}
+		for _, change := range job.dedupe(changes) {
+			pending = append(pending, &QueuedChange{Change: change, Queued: queued[change]})
+		}
 	}
-	templateData := struct {
-		LastRun      time.Time
-		ChangedAppts []*ApptChange
-	}{
-		LastRun:      job.lastRun,
-		ChangedAppts: changedAppts,
+
+	changedAppts, err := job.collect(ctx, job.since(now))
+	if err != nil {
+		return nil, errors.Wrap(err, "collect updated appointments failed")
+	}
+	seen := make(map[string]bool, len(pending))
+	for _, q := range pending {
+		seen[q.Change.ID()] = true
 	}
+	for _, change := range job.dedupe(changedAppts) {
+		if !seen[change.ID()] {
+			pending = append(pending, &QueuedChange{Change: change})
+		}
+	}
+	return pending, nil
+}
 
-	buf := new(bytes.Buffer)
-	if err := template.Execute(buf, "changedappts.tmpl", templateData); err != nil {
-		log.Error().
+// SetNotifiers replaces the notifiers of later runs
+func (job *changedApptsJob) SetNotifiers(notifiers []Notifier) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.notifiers = notifiers
+}
+
+// Stats returns the statistics since the job got created
+func (job *changedApptsJob) Stats() Stats {
+	job.statsMu.Lock()
+	defer job.statsMu.Unlock()
+
+	return job.stats
+}
+
+// notify delivers the changes collected since `since` by every notifier, a failing notifier does not stop the others
+// a notifier only gets the changes it did not deliver yet, so after a failure only the failed notifier retries them
+// it returns the changes delivered by all notifiers and the keys to remember, see commit
+func (job *changedApptsJob) notify(ctx context.Context, since time.Time, changedAppts []*ApptChange) ([]*ApptChange, []string, error) {
+	names := notifierNames(job.notifiers)
+	delivered := make(map[string]bool)
+	var failed int
+	var firstErr error
+	for i, notifier := range job.notifiers {
+		var pending []*ApptChange
+		for _, change := range changedAppts {
+			if !job.delivered(names[i], change) {
+				pending = append(pending, change)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		notifyCtx, span := startSpan(ctx, "job.notify",
+			attribute.String("notifier", names[i]),
+			attribute.Int("appointments.count", len(pending)),
+			attribute.String("change.type", changeType(pending)),
+		)
+		err := notifier.Notify(notifyCtx, since, pending)
+		endSpan(span, err)
+		if err == nil {
+			for _, change := range pending {
+				delivered[deliveryKey(names[i], change)] = true
+			}
+			continue
+		}
+
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+		Logger(ctx).Error().
 			Err(err).
-			Msg("could not execute template")
+			Msgf("notifier %s failed", names[i])
+
+		if partial, ok := err.(*PartialError); ok {
+			for _, change := range partial.Notified {
+				delivered[deliveryKey(names[i], change)] = true
+			}
+		}
+	}
+
+	notified := make([]*ApptChange, 0, len(changedAppts))
+	var keys []string
+	for _, change := range changedAppts {
+		all := true
+		for _, name := range names {
+			all = all && (delivered[deliveryKey(name, change)] || job.delivered(name, change))
+		}
+		if all {
+			notified = append(notified, change)
+			keys = append(keys, change.ID())
+			continue
+		}
+		// remember the notifiers which delivered the change, the others retry it
+		for _, name := range names {
+			if key := deliveryKey(name, change); delivered[key] {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return notified, keys, errors.Wrapf(firstErr, "%d of %d notifiers failed", failed, len(job.notifiers))
+	}
+	return notified, keys, nil
+}
+
+// delivered reports whether the named notifier already delivered the change
+func (job *changedApptsJob) delivered(name string, change *ApptChange) bool {
+	_, ok := job.notified[deliveryKey(name, change)]
+	return ok
+}
+
+// deliveryKey of a change delivered by the named notifier, while others failed
+func deliveryKey(name string, change *ApptChange) string {
+	return name + "/" + change.ID()
+}
+
+// notifierNames returns the names of the notifiers
+// names should be unique, further notifiers of the same name are numbered by their order, e.g. mail#2
+func notifierNames(notifiers []Notifier) []string {
+	names := make([]string, len(notifiers))
+	count := make(map[string]int, len(notifiers))
+	for i, notifier := range notifiers {
+		name := notifier.Name()
+		count[name]++
+		if count[name] > 1 {
+			name = fmt.Sprintf("%s#%d", name, count[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// commit remembers the keys of the notified changes returned by notify and advances lastRun if requested
+// dry runs are non-committal unless configured otherwise
+func (job *changedApptsJob) commit(ctx context.Context, run time.Time, keys []string, advance bool) {
+	if job.cfg.DryRun && !job.cfg.DryRunCommit {
+		Logger(ctx).Info().
+			Msg("dry run, state not advanced")
 
 		return
 	}
 
-	if err := job.mailer.SendMessage("text/html", buf.String()); err != nil {
-		log.Error().
-			Err(err).
-			Msg("could not send message")
+	if advance {
+		// set lastRun time
+		job.lastRun = run
+	}
+	for _, key := range keys {
+		job.notified[key] = run
+	}
+
+	job.saveState(ctx)
+}
+
+// dedupe removes changes which already got notified
+// and forgets notified changes older than the retention
+func (job *changedApptsJob) dedupe(changedAppts []*ApptChange) []*ApptChange {
+	threshold := time.Now().Add(-job.cfg.DedupeRetention)
+	for id, notifiedAt := range job.notified {
+		if notifiedAt.Before(threshold) {
+			delete(job.notified, id)
+		}
+	}
 
+	fresh := make([]*ApptChange, 0, len(changedAppts))
+	seen := make(map[string]bool, len(changedAppts))
+	for _, change := range changedAppts {
+		id := change.ID()
+		if _, ok := job.notified[id]; ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		fresh = append(fresh, change)
+	}
+	return fresh
+}
+
+// saveState persists the current state if a StateStore is configured
+func (job *changedApptsJob) saveState(ctx context.Context) {
+	if job.cfg.StateStore == nil {
 		return
 	}
 
-	// set lastRun time
-	job.lastRun = run
+	state := &State{
+		LastRun:  job.lastRun,
+		Notified: job.notified,
+	}
+	if err := job.cfg.StateStore.SaveState(state); err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Msg("could not save state")
+	}
 }
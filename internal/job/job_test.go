@@ -1,11 +1,17 @@
 package job
 
 import (
+	"bytes"
+	"context"
 	"testing"
 	"time"
 
+	"github.com/emed-appts/emed-mailer/internal/template"
 	"github.com/emed-appts/emed-mailer/test"
 
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -19,7 +25,7 @@ func TestChangedApptsJob_Run(t *testing.T) {
 
 	c := &MockCollector{}
 	c.
-		On("CollectChangedAppts", lastRun).
+		On("CollectChangedAppts", mock.Anything, lastRun).
 		Return([]*ApptChange{
 			{
 				Time:        time.Now(),
@@ -40,12 +46,26 @@ func TestChangedApptsJob_Run(t *testing.T) {
 
 	m := &MockMailer{}
 	m.
-		On("SendMessage", "text/html", mock.AnythingOfType("string")).
-		Return(nil).
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
 		Once()
 
-	job := &changedApptsJob{c, m, lastRun}
-	job.Run()
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+	htmlTmpl, err := template.HTML("changedappts.tmpl", "")
+	assert.NoError(t, err)
+
+	job := &changedApptsJob{
+		collector: c,
+		notifiers: []Notifier{NewMailNotifier(MailConfig{
+			TextTemplate: textTmpl,
+			HTMLTemplate: htmlTmpl,
+			Digest:       true,
+		}, m)},
+		lastRun:  lastRun,
+		notified: map[string]time.Time{},
+	}
+	job.Run(context.Background())
 
 	// test that lastRun has been updated
 	assert.True(t, job.lastRun.After(lastRun))
@@ -53,3 +73,658 @@ func TestChangedApptsJob_Run(t *testing.T) {
 	c.AssertExpectations(t)
 	m.AssertExpectations(t)
 }
+
+func TestMailNotifier_Render_Details(t *testing.T) {
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+	htmlTmpl, err := template.HTML("changedappts.tmpl", "")
+	assert.NoError(t, err)
+
+	appt := time.Date(2026, 10, 5, 9, 30, 0, 0, time.UTC)
+	moved := &ApptChange{
+		Time:                appt.Add(-48 * time.Hour),
+		Appointment:         appt,
+		PatientID:           1,
+		PatientName:         "Firstname Lastname",
+		IsBooking:           true,
+		Provider:            "Dr. Huber",
+		Location:            "Ordination 2",
+		PreviousAppointment: appt.Add(-24 * time.Hour),
+	}
+	plain := &ApptChange{Time: appt, Appointment: appt, PatientID: 2, PatientName: "Other"}
+
+	notifier := &mailNotifier{cfg: MailConfig{TextTemplate: textTmpl, HTMLTemplate: htmlTmpl}}
+	msg, err := notifier.render(&TemplateData{ChangedAppts: []*ApptChange{moved, plain}}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Contains(t, msg.Text, "Termin: 05.10.2026 09:30  (bisher 04.10.2026 09:30)  Behandler: Dr. Huber  Ort: Ordination 2\n")
+	// unknown details are left out
+	assert.Contains(t, msg.Text, "Other  Termin: 05.10.2026 09:30\n")
+	assert.Contains(t, msg.HTML, "<td>Dr. Huber</td>")
+	assert.Contains(t, msg.HTML, "<small>bisher 04.10.2026 09:30</small>")
+}
+
+func TestChangedApptsJob_Run_Dedupe(t *testing.T) {
+	change := &ApptChange{
+		Time:        time.Now(),
+		Appointment: time.Now(),
+		PatientID:   1,
+		PatientName: "Firstname Lastname",
+		IsBooking:   true,
+	}
+
+	// an overlapping run collects the same change again
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return([]*ApptChange{change}, nil).
+		Twice()
+
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
+		Once()
+
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	job := New(Config{
+		DedupeRetention: time.Hour,
+	}, c, []Notifier{NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+	}, m)}, &State{LastRun: time.Now().Add(-time.Hour)})
+	job.Run(context.Background())
+	job.Run(context.Background())
+
+	c.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Pending(t *testing.T) {
+	lastRun := time.Now().Add(-time.Hour)
+	notified := &ApptChange{Time: time.Now(), PatientID: 1, IsBooking: true}
+	pending := &ApptChange{Time: time.Now(), PatientID: 2}
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return([]*ApptChange{notified, pending}, nil)
+
+	// nothing gets notified, so no notifier is needed
+	job := New(Config{
+		DedupeRetention: time.Hour,
+	}, c, nil, &State{
+		LastRun:  lastRun,
+		Notified: map[string]time.Time{notified.ID(): time.Now()},
+	})
+
+	changes, err := job.Pending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []*QueuedChange{{Change: pending}}, changes)
+}
+
+func TestChangedApptsJob_Run_Separate(t *testing.T) {
+	lastRun := time.Now().Add(time.Hour * -24)
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return([]*ApptChange{
+			{
+				Time:        time.Now(),
+				Appointment: time.Now(),
+				PatientID:   1,
+				PatientName: "Firstname Lastname",
+				IsBooking:   true,
+			},
+			{
+				Time:        time.Now(),
+				Appointment: time.Now(),
+				PatientID:   2,
+				PatientName: "Firstname Lastname",
+				IsBooking:   false,
+			},
+		}, nil).
+		Once()
+
+	// every change is sent separately
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
+		Twice()
+
+	subjectTmpl, err := template.Inline("subject", "{{ .PatientName }}")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+	}, m)}, &State{LastRun: lastRun})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+
+	c.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Run_LookbackWindow(t *testing.T) {
+	// the last run is more recent than the window, so the window is collected again
+	lastRun := time.Now().Add(-5 * time.Minute)
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.MatchedBy(func(since time.Time) bool {
+			return since.Before(lastRun.Add(-4 * time.Minute))
+		})).
+		Return(nil, nil).
+		Once()
+
+	job := New(Config{LookbackWindow: 10 * time.Minute}, c, nil, &State{LastRun: lastRun})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+	c.AssertExpectations(t)
+
+	// after an outage collection starts at the last run
+	lastRun = time.Now().Add(-time.Hour)
+	c = &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return(nil, nil).
+		Once()
+
+	job = New(Config{LookbackWindow: 10 * time.Minute}, c, nil, &State{LastRun: lastRun})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+	c.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Run_Empty(t *testing.T) {
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, nil).
+		Once()
+
+	// an empty run sends nothing
+	m := &MockMailer{}
+
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(buf)
+
+	lastRun := time.Now().Add(-time.Hour)
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Digest:       true,
+	}, m)}, &State{LastRun: lastRun})
+	result := job.Execute(context.Background())
+	assert.NoError(t, result.Err)
+	assert.Equal(t, 0, result.Collected)
+
+	c.AssertExpectations(t)
+	m.AssertNotCalled(t, "SendMessage", mock.Anything)
+
+	// the run advances the last run and logs the checked window
+	assert.True(t, job.(*changedApptsJob).lastRun.After(lastRun))
+	assert.Contains(t, buf.String(), `"level":"info"`)
+	assert.Contains(t, buf.String(), `"message":"0 changes to notify"`)
+	assert.Contains(t, buf.String(), `"since":"`+lastRun.Format(zerolog.TimeFieldFormat)+`"`)
+}
+
+func TestChangedApptsJob_Run_Pages(t *testing.T) {
+	lastRun := time.Now().Add(-time.Hour)
+	first := &ApptChange{Time: lastRun.Add(time.Minute), PatientID: 1, IsBooking: true}
+	second := &ApptChange{Time: lastRun.Add(2 * time.Minute), PatientID: 2, IsBooking: true}
+	third := &ApptChange{Time: lastRun.Add(3 * time.Minute), PatientID: 3}
+
+	c := &pageCollector{pages: [][]*ApptChange{{first, second}, {third}}}
+
+	// every page gets sent before the next one gets collected
+	var sent []string
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) {
+			sent = append(sent, args.Get(0).(*Message).Text)
+			assert.Len(t, c.since, len(sent))
+		}).
+		Return(&Receipt{}, nil).
+		Twice()
+
+	textTmpl, err := template.Inline("text", "{{ range .ChangedAppts }}{{ .PatientID }}{{ end }}")
+	assert.NoError(t, err)
+
+	job := New(Config{DedupeRetention: time.Hour}, c, []Notifier{NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Digest:       true,
+	}, m)}, &State{LastRun: lastRun})
+
+	result := job.Execute(context.Background())
+	assert.NoError(t, result.Err)
+	assert.Equal(t, 3, result.Collected)
+	assert.Equal(t, 3, result.Sent)
+	assert.Equal(t, []string{"12", "3"}, sent)
+	assert.Equal(t, []time.Time{lastRun, second.Time}, c.since)
+	assert.True(t, job.(*changedApptsJob).lastRun.After(lastRun))
+	m.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Stats_LastRun(t *testing.T) {
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, nil).
+		Once()
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, errors.New("connection refused")).
+		Once()
+
+	job := New(Config{}, c, nil, &State{LastRun: time.Now().Add(-time.Hour)})
+	assert.True(t, job.Stats().LastRun.IsZero())
+
+	assert.NoError(t, job.Execute(context.Background()).Err)
+	stats := job.Stats()
+	assert.False(t, stats.LastRun.IsZero())
+	assert.Equal(t, stats.LastRun, stats.LastSuccess)
+	assert.NoError(t, stats.LastResult.Err)
+
+	// a failed run keeps the time of the last successful one
+	assert.Error(t, job.Execute(context.Background()).Err)
+	failed := job.Stats()
+	assert.True(t, failed.LastRun.After(stats.LastRun))
+	assert.Equal(t, stats.LastSuccess, failed.LastSuccess)
+	assert.Error(t, failed.LastResult.Err)
+	c.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Run_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the run passes a context derived from ctx, carrying the run ID
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.MatchedBy(func(c context.Context) bool { return c.Err() == context.Canceled }), mock.AnythingOfType("time.Time")).
+		Return(nil, errors.New("could not query database: context canceled")).
+		Once()
+
+	m := &MockMailer{}
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{Digest: true}, m)}, &State{LastRun: time.Now().Add(-time.Hour)})
+	err := job.Execute(ctx).Err
+
+	// shutdown is reported as such rather than as database failure
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.Contains(t, err.Error(), "cancelled by shutdown")
+
+	c.AssertExpectations(t)
+	m.AssertNotCalled(t, "SendMessage", mock.Anything)
+}
+
+func TestChangedApptsJob_Run_CollectRetry(t *testing.T) {
+	unavailable := errors.Wrap(&CollectError{Kind: ErrUnavailable, Err: errors.New("connection refused")}, "could not query database")
+	broken := errors.Wrap(&CollectError{Kind: ErrQueryFailed, Err: errors.New("invalid column name")}, "could not query database")
+
+	// the database becoming unavailable is retried within the run
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, unavailable).
+		Once()
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, nil).
+		Once()
+
+	job := New(Config{CollectRetries: 2, CollectRetryDelay: time.Millisecond}, c, nil, &State{LastRun: time.Now().Add(-time.Hour)})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+	c.AssertExpectations(t)
+
+	// a broken query fails right away
+	c = &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(nil, broken).
+		Once()
+
+	job = New(Config{CollectRetries: 2, CollectRetryDelay: time.Millisecond}, c, nil, &State{LastRun: time.Now().Add(-time.Hour)})
+	err := job.Execute(context.Background()).Err
+	assert.True(t, errors.Is(err, ErrQueryFailed))
+	assert.False(t, errors.Is(err, ErrUnavailable))
+	c.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Run_Routes(t *testing.T) {
+	lastRun := time.Now().Add(time.Hour * -24)
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return([]*ApptChange{
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 1, PatientName: "Booked", IsBooking: true},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 2, PatientName: "Cancelled", IsBooking: false},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 3, PatientName: "Booked", IsBooking: true},
+		}, nil).
+		Once()
+
+	cancelledSubject, err := template.Inline("cancelled subject", "Storni: {{ len .ChangedAppts }}")
+	assert.NoError(t, err)
+	subjectTmpl, err := template.Inline("subject", "Buchungen: {{ len .ChangedAppts }}")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	// bookings fall back to the defaults, cancellations are routed separately
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool {
+			return msg.Subject == "Buchungen: 2" && msg.To == nil
+		})).
+		Return(&Receipt{}, nil).
+		Once()
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool {
+			return msg.Subject == "Storni: 1" && assert.ObjectsAreEqual([]string{"storno@example.com"}, msg.To)
+		})).
+		Return(&Receipt{}, nil).
+		Once()
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		Digest:          true,
+		Cancelled: &Route{
+			SubjectTemplate: cancelledSubject,
+			To:              []string{"storno@example.com"},
+		},
+	}, m)}, &State{LastRun: lastRun})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+
+	c.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestMailNotifier_SubjectPrefix(t *testing.T) {
+	booked := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 1, IsBooking: true}
+	cancelled := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 2}
+	other := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 3, IsBooking: true}
+
+	subjectTmpl, err := template.Inline("subject", "eTermin: {{ len .ChangedAppts }}")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	var subjects []string
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { subjects = append(subjects, args.Get(0).(*Message).Subject) }).
+		Return(&Receipt{}, nil)
+
+	// the digest gets split by change type
+	n := NewMailNotifier(MailConfig{
+		SubjectTemplate:     subjectTmpl,
+		TextTemplate:        textTmpl,
+		Digest:              true,
+		SubjectPrefixBooked: "[Buchung]",
+	}, m)
+	assert.NoError(t, n.Notify(context.Background(), time.Now(), []*ApptChange{booked, cancelled, other}))
+	assert.Equal(t, []string{"[Buchung] eTermin: 2", "eTermin: 1"}, subjects)
+
+	// without prefixes the digest is sent as a whole
+	subjects = nil
+	n = NewMailNotifier(MailConfig{SubjectTemplate: subjectTmpl, TextTemplate: textTmpl, Digest: true}, m)
+	assert.NoError(t, n.Notify(context.Background(), time.Now(), []*ApptChange{booked, cancelled, other}))
+	assert.Equal(t, []string{"eTermin: 3"}, subjects)
+}
+
+func TestChangedApptsJob_Run_ProviderRouting(t *testing.T) {
+	lastRun := time.Now().Add(time.Hour * -24)
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return([]*ApptChange{
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 1, Provider: "Dr. Huber", IsBooking: true},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 2, Provider: "Dr. Gruber", IsBooking: true},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 3, Provider: "Dr. Huber", IsBooking: false},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 4, IsBooking: true},
+		}, nil).
+		Once()
+
+	subjectTmpl, err := template.Inline("subject", "{{ len .ChangedAppts }}")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	// changes of listed providers go to their recipients, others to the defaults
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool {
+			return msg.Subject == "2" && assert.ObjectsAreEqual([]string{"huber@example.com"}, msg.To)
+		})).
+		Return(&Receipt{}, nil).
+		Once()
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool {
+			return msg.Subject == "2" && msg.To == nil
+		})).
+		Return(&Receipt{}, nil).
+		Once()
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		Digest:          true,
+		ProviderTo:      map[string][]string{"Dr. Huber": {"huber@example.com"}},
+	}, m)}, &State{LastRun: lastRun})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+
+	c.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestMailNotifier_ProviderRoutingKeepsCCAndBCC(t *testing.T) {
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	var msgs []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { msgs = append(msgs, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	n := NewMailNotifier(MailConfig{
+		TextTemplate: textTmpl,
+		Digest:       true,
+		Cancelled:    &Route{To: []string{"cancellations@example.com"}, CC: []string{"office@example.com"}},
+		ProviderTo:   map[string][]string{"Dr. Huber": {"huber@example.com"}},
+		CC:           []string{"frontdesk@example.com"},
+		BCC:          []string{"compliance@example.com"},
+	}, m)
+	assert.NoError(t, n.Notify(context.Background(), time.Now(), []*ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1, Provider: "Dr. Huber", IsBooking: true},
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 2, Provider: "Dr. Huber"},
+	}))
+
+	if assert.Len(t, msgs, 2) {
+		// the defaults of the mailer
+		assert.Equal(t, []string{"huber@example.com"}, msgs[0].To)
+		assert.Equal(t, []string{"frontdesk@example.com"}, msgs[0].CC)
+		assert.Equal(t, []string{"compliance@example.com"}, msgs[0].BCC)
+		// the recipients of the route
+		assert.Equal(t, []string{"huber@example.com"}, msgs[1].To)
+		assert.Equal(t, []string{"office@example.com"}, msgs[1].CC)
+		assert.Empty(t, msgs[1].BCC)
+	}
+}
+
+func TestChangedApptsJob_Run_NotifierFailure(t *testing.T) {
+	lastRun := time.Now().Add(time.Hour * -24)
+	changes := []*ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1, PatientName: "Firstname Lastname", IsBooking: true},
+	}
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return(changes, nil).
+		Once()
+
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	// a failing notifier does not stop the others
+	failing := &MockMailer{}
+	failing.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(nil, errors.New("connection refused")).
+		Once()
+	healthy := &MockMailer{}
+	healthy.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
+		Once()
+
+	job := New(Config{}, c, []Notifier{
+		NewMailNotifier(MailConfig{TextTemplate: textTmpl, Digest: true}, failing),
+		NewMailNotifier(MailConfig{TextTemplate: textTmpl, Digest: true}, healthy),
+	}, &State{LastRun: lastRun})
+	err = job.Execute(context.Background()).Err
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1 of 2 notifiers failed")
+	}
+	// the same window gets collected again
+	assert.Equal(t, lastRun, job.(*changedApptsJob).lastRun)
+
+	c.AssertExpectations(t)
+	failing.AssertExpectations(t)
+	healthy.AssertExpectations(t)
+}
+
+func TestChangedApptsJob_Run_PartialFailure(t *testing.T) {
+	lastRun := time.Now().Add(time.Hour * -24)
+	good := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 1, IsBooking: true}
+	bad := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 2, IsBooking: true}
+	later := &ApptChange{Time: time.Now(), Appointment: time.Now(), PatientID: 3, IsBooking: false}
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, lastRun).
+		Return([]*ApptChange{good, bad, later}, nil).
+		Twice()
+
+	textTmpl, err := template.Inline("text", "{{ .PatientID }}")
+	assert.NoError(t, err)
+
+	// the failing change does not stop the later one
+	isBad := func(msg *Message) bool { return msg.Text == "2" }
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(isBad)).
+		Return(nil, errors.New("mailbox unavailable")).
+		Twice()
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool { return !isBad(msg) })).
+		Return(&Receipt{}, nil).
+		Twice()
+
+	job := New(Config{DedupeRetention: time.Hour}, c, []Notifier{
+		NewMailNotifier(MailConfig{TextTemplate: textTmpl}, m),
+	}, &State{LastRun: lastRun})
+
+	result := job.Execute(context.Background())
+	assert.Equal(t, 3, result.Collected)
+	assert.Equal(t, 2, result.Sent)
+	assert.Equal(t, 1, result.Failed)
+	err = result.Err
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "notified 2 of 3 changes")
+		assert.Contains(t, err.Error(), "1 of 3 messages failed")
+	}
+	impl := job.(*changedApptsJob)
+	assert.Equal(t, lastRun, impl.lastRun)
+	assert.Contains(t, impl.notified, good.ID())
+	assert.Contains(t, impl.notified, later.ID())
+	assert.NotContains(t, impl.notified, bad.ID())
+	assert.Equal(t, 2, job.Stats().Notified)
+
+	// the next run only retries the failed change
+	result = job.Execute(context.Background())
+	assert.Error(t, result.Err)
+	assert.Equal(t, 3, result.Collected)
+	assert.Equal(t, 0, result.Sent)
+	assert.Equal(t, 1, result.Failed)
+
+	c.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestMailNotifier_Concurrency(t *testing.T) {
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+	subjectTmpl, err := template.Inline("subject", "{{ .PatientID }}")
+	assert.NoError(t, err)
+
+	// a failed message does not stop the others
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.MatchedBy(func(msg *Message) bool { return msg.Subject == "2" })).
+		Return(nil, errors.New("mailbox unavailable")).
+		Once()
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil).
+		Twice()
+
+	n := NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		Concurrency:     3,
+	}, m)
+	err = n.Notify(context.Background(), time.Now(), []*ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1},
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 2},
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 3},
+	})
+
+	if assert.IsType(t, &PartialError{}, err) {
+		assert.Len(t, err.(*PartialError).Notified, 2)
+		assert.Contains(t, err.Error(), "1 of 3 messages failed")
+	}
+	m.AssertExpectations(t)
+}
+
+func TestFindChange(t *testing.T) {
+	changed := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	change := &ApptChange{
+		Time:        changed,
+		Appointment: time.Date(2026, 10, 5, 9, 30, 0, 0, time.UTC),
+		PatientID:   7,
+		IsBooking:   true,
+	}
+	other := &ApptChange{Time: changed.Add(time.Minute), PatientID: 8}
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, changed.Add(-time.Second)).
+		Return([]*ApptChange{change, other}, nil)
+
+	found, err := FindChange(context.Background(), c, change.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, change, found)
+
+	_, err = FindChange(context.Background(), c, "7/"+changed.Format(time.RFC3339Nano)+"/2026-10-05T09:30:00Z/false")
+	assert.EqualError(t, err, "could not find appointment 7/2026-10-01T08:00:00Z/2026-10-05T09:30:00Z/false")
+
+	_, err = FindChange(context.Background(), c, "7")
+	assert.Error(t, err)
+}
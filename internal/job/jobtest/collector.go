@@ -0,0 +1,50 @@
+package jobtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+)
+
+// Collector is an in-memory job.Collector
+// it returns the added changes newer than the last run, like the database collector does
+type Collector struct {
+	mu      sync.Mutex
+	changes []*job.ApptChange
+
+	// Err is returned by CollectChangedAppts if set
+	Err error
+}
+
+var _ job.Collector = &Collector{}
+
+// Add adds changes, they must be added ordered by time of change
+func (c *Collector) Add(changes ...*job.ApptChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changes = append(c.changes, changes...)
+}
+
+// CollectChangedAppts returns the changes newer than lastRun
+func (c *Collector) CollectChangedAppts(ctx context.Context, lastRun time.Time) ([]*job.ApptChange, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var changes []*job.ApptChange
+	for _, change := range c.changes {
+		if change.Time.After(lastRun) {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
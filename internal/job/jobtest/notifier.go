@@ -0,0 +1,71 @@
+// Package jobtest provides fakes for testing code built on the job package.
+package jobtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+)
+
+// Notifier is a fake job.Notifier recording every call
+type Notifier struct {
+	mu sync.Mutex
+	// calls lists the changes of every call
+	calls [][]*job.ApptChange
+
+	// ID is returned by Name, jobtest if empty
+	ID string
+	// Err is returned by Notify if set
+	Err error
+	// Deliver is the number of changes delivered before Err, reported by a *job.PartialError
+	Deliver int
+}
+
+var _ job.Notifier = &Notifier{}
+
+// Name returns the ID of the notifier
+func (n *Notifier) Name() string {
+	if n.ID == "" {
+		return "jobtest"
+	}
+	return n.ID
+}
+
+// Notify records the changes and fails as configured
+func (n *Notifier) Notify(ctx context.Context, lastRun time.Time, changes []*job.ApptChange) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.calls = append(n.calls, changes)
+	if n.Err == nil {
+		return nil
+	}
+
+	deliver := n.Deliver
+	if deliver > len(changes) {
+		deliver = len(changes)
+	}
+	return &job.PartialError{Notified: changes[:deliver], Err: n.Err}
+}
+
+// Calls returns the changes of every call
+func (n *Notifier) Calls() [][]*job.ApptChange {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.calls
+}
+
+// Notified returns all changes passed to the notifier
+func (n *Notifier) Notified() []*job.ApptChange {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var changes []*job.ApptChange
+	for _, call := range n.calls {
+		changes = append(changes, call...)
+	}
+	return changes
+}
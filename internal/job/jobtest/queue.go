@@ -0,0 +1,40 @@
+package jobtest
+
+import (
+	"sync"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+)
+
+// Queue is an in-memory job.Queue
+type Queue struct {
+	mu      sync.Mutex
+	changes []*job.QueuedChange
+}
+
+var _ job.Queue = &Queue{}
+
+// LoadQueue returns the saved changes
+func (q *Queue) LoadQueue() ([]*job.QueuedChange, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]*job.QueuedChange(nil), q.changes...), nil
+}
+
+// SaveQueue replaces the saved changes
+func (q *Queue) SaveQueue(changes []*job.QueuedChange) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.changes = changes
+	return nil
+}
+
+// Len returns the number of queued changes
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.changes)
+}
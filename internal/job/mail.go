@@ -0,0 +1,356 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Mailer interface
+type Mailer interface {
+	Run(<-chan struct{}) error
+	// SendMessage blocks until the message got sent and returns its receipt
+	SendMessage(*Message) (*Receipt, error)
+}
+
+// Receipt struct identifies a sent message, e.g. for tracking it downstream
+type Receipt struct {
+	// MessageID is the Message-ID header of the message, including angle brackets
+	MessageID string
+	// Response is the reply of the mail server accepting the message, empty for dry runs
+	Response string
+}
+
+// Message struct holds the rendered bodies of a notification
+type Message struct {
+	// Subject is the rendered subject
+	Subject string
+	// Text is the plain text body
+	Text string
+	// HTML is the optional html alternative of the body
+	HTML string
+
+	// To, CC and BCC override the configured recipients of the mailer if To is set
+	To  []string
+	CC  []string
+	BCC []string
+
+	// Attachments are attached to the message, optional
+	Attachments []*Attachment
+
+	// RunID identifies the run the message belongs to, logged by the mailer
+	RunID string
+}
+
+// Attachment struct holds a file attached to a message
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// MailConfig struct encapsulate all settings for the mail notifier
+type MailConfig struct {
+	SubjectTemplate *texttemplate.Template
+	TextTemplate    *texttemplate.Template
+	HTMLTemplate    *htmltemplate.Template
+
+	// Digest sends all changes of a run within a single message
+	// otherwise every change is sent separately
+	Digest bool
+	// Booked and Cancelled route bookings and cancellations separately, optional
+	// in digest mode every route gets its own message
+	Booked    *Route
+	Cancelled *Route
+	// SubjectPrefixBooked and SubjectPrefixCancelled are prepended to the subjects of bookings and cancellations, optional
+	// if either is set, digest mode sends bookings and cancellations in separate messages
+	SubjectPrefixBooked    string
+	SubjectPrefixCancelled string
+	// ProviderTo maps a provider to the To recipients of its changes, replacing the ones of the route, optional
+	// CC and BCC of the route or the mailer still apply, changes of unlisted providers go to the recipients of their route or the mailer
+	// in digest mode every provider gets its own message
+	ProviderTo map[string][]string
+	// Calendar attaches calendar invites and cancellations of the changes, optional
+	Calendar *CalendarConfig
+	// Concurrency is the number of messages submitted to the mailer in parallel, defaults to 1
+	Concurrency int
+	// Audit records every sent or failed message, optional
+	Audit AuditLog
+	// Recipients are the default recipients of the mailer, recorded for messages without route recipients
+	Recipients []string
+	// CC and BCC are the default CC and BCC of the mailer, kept by messages routed by provider
+	CC  []string
+	BCC []string
+}
+
+// Route overrides templates and recipients for one kind of change
+// unset templates fall back to the ones of MailConfig, unset recipients to the ones of the mailer
+type Route struct {
+	SubjectTemplate *texttemplate.Template
+	TextTemplate    *texttemplate.Template
+	HTMLTemplate    *htmltemplate.Template
+
+	To  []string
+	CC  []string
+	BCC []string
+}
+
+// TemplateData struct is passed to the subject and body templates
+type TemplateData struct {
+	// LastRun is the time since when changes got collected
+	LastRun time.Time
+	// ChangedAppts lists the notified changes
+	ChangedAppts []*ApptChange
+	// ApptChange is the notified change if changes are sent separately, nil in digest mode
+	*ApptChange
+}
+
+type mailNotifier struct {
+	cfg    MailConfig
+	mailer Mailer
+}
+
+// NewMailNotifier creates a Notifier rendering the changes into messages sent by the mailer
+func NewMailNotifier(cfg MailConfig, mailer Mailer) Notifier {
+	return &mailNotifier{
+		cfg:    cfg,
+		mailer: mailer,
+	}
+}
+
+// Name returns mail
+func (notifier *mailNotifier) Name() string {
+	return "mail"
+}
+
+// Notify renders and sends the messages of the changes, up to Concurrency in parallel
+// a failed message does not stop the others, the changes of the sent messages are reported by a *PartialError
+func (notifier *mailNotifier) Notify(ctx context.Context, lastRun time.Time, changes []*ApptChange) error {
+	batches := notifier.batches(changes)
+	errs := make([]error, len(batches))
+
+	concurrency := notifier.cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, b := range batches {
+		data := &TemplateData{
+			LastRun:      lastRun,
+			ChangedAppts: b.changes,
+		}
+		if !notifier.cfg.Digest {
+			data.ApptChange = b.changes[0]
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, data *TemplateData, b *batch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errs[i] = notifier.send(ctx, data, b)
+		}(i, data, b)
+	}
+	wg.Wait()
+
+	notified := make([]*ApptChange, 0, len(changes))
+	var failed int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			notified = append(notified, batches[i].changes...)
+			continue
+		}
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if failed > 0 {
+		return &PartialError{
+			Notified: notified,
+			Err:      errors.Wrapf(firstErr, "%d of %d messages failed", failed, len(batches)),
+		}
+	}
+	return nil
+}
+
+// batch holds the changes sent within one message
+type batch struct {
+	// route is nil for the defaults
+	route *Route
+	// provider is set if the changes are routed to the recipients of their provider
+	provider string
+	changes  []*ApptChange
+}
+
+// subjectPrefix returns the prefix of the subject, empty if the changes are of mixed types
+func (notifier *mailNotifier) subjectPrefix(changes []*ApptChange) string {
+	if changeType(changes) == "mixed" {
+		return ""
+	}
+	if changes[0].IsBooking {
+		return notifier.cfg.SubjectPrefixBooked
+	}
+	return notifier.cfg.SubjectPrefixCancelled
+}
+
+// batches splits the changes into messages
+// digest mode sends all changes of the same route and provider within a single message
+func (notifier *mailNotifier) batches(changedAppts []*ApptChange) []*batch {
+	type key struct {
+		route    *Route
+		provider string
+		booking  bool
+	}
+	prefixed := notifier.cfg.SubjectPrefixBooked != "" || notifier.cfg.SubjectPrefixCancelled != ""
+
+	var batches []*batch
+	byKey := make(map[key]*batch)
+	for _, change := range changedAppts {
+		k := key{route: notifier.cfg.Cancelled}
+		if change.IsBooking {
+			k.route = notifier.cfg.Booked
+		}
+		if _, ok := notifier.cfg.ProviderTo[change.Provider]; ok {
+			k.provider = change.Provider
+		}
+		if prefixed {
+			// split digests by change type, so every message gets the prefix of its changes
+			k.booking = change.IsBooking
+		}
+
+		if !notifier.cfg.Digest {
+			batches = append(batches, &batch{k.route, k.provider, []*ApptChange{change}})
+			continue
+		}
+
+		b, ok := byKey[k]
+		if !ok {
+			b = &batch{route: k.route, provider: k.provider}
+			byKey[k] = b
+			batches = append(batches, b)
+		}
+		b.changes = append(b.changes, change)
+	}
+	return batches
+}
+
+// send renders and sends the message of a batch
+func (notifier *mailNotifier) send(ctx context.Context, data *TemplateData, b *batch) error {
+	msg, err := notifier.render(data, b.route)
+	if err != nil {
+		return errors.Wrap(err, "could not render message")
+	}
+	if prefix := notifier.subjectPrefix(b.changes); prefix != "" {
+		msg.Subject = prefix + " " + msg.Subject
+	}
+	if b.provider != "" {
+		// the mailer replaces its recipients as a whole, so its CC and BCC are kept explicitly, e.g. a compliance BCC
+		if len(msg.To) == 0 {
+			msg.CC, msg.BCC = notifier.cfg.CC, notifier.cfg.BCC
+		}
+		msg.To = notifier.cfg.ProviderTo[b.provider]
+	}
+	if notifier.cfg.Calendar != nil {
+		msg.Attachments = calendarAttachments(notifier.cfg.Calendar, data.ChangedAppts, time.Now())
+	}
+	msg.RunID = RunID(ctx)
+
+	_, span := startSpan(ctx, "mail.send",
+		attribute.Int("appointments.count", len(data.ChangedAppts)),
+		attribute.String("change.type", changeType(data.ChangedAppts)),
+	)
+	_, err = notifier.mailer.SendMessage(msg)
+	err = errors.Wrap(err, "could not send message")
+	endSpan(span, err)
+	notifier.audit(ctx, msg, data.ChangedAppts, err)
+	return err
+}
+
+// audit records the outcome of the message, a failing audit log does not fail the notification
+func (notifier *mailNotifier) audit(ctx context.Context, msg *Message, changes []*ApptChange, sendErr error) {
+	if notifier.cfg.Audit == nil {
+		return
+	}
+
+	recipients := notifier.cfg.Recipients
+	if len(msg.To) > 0 {
+		recipients = make([]string, 0, len(msg.To)+len(msg.CC)+len(msg.BCC))
+		recipients = append(recipients, msg.To...)
+		recipients = append(recipients, msg.CC...)
+		recipients = append(recipients, msg.BCC...)
+	}
+
+	now := time.Now()
+	entries := make([]*AuditEntry, len(changes))
+	for i, change := range changes {
+		entries[i] = &AuditEntry{
+			ApptID:     change.ID(),
+			IsBooking:  change.IsBooking,
+			Recipients: recipients,
+			Time:       now,
+			Err:        sendErr,
+		}
+	}
+
+	if err := notifier.cfg.Audit.Record(ctx, entries); err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Int("changes", len(changes)).
+			Msg("could not record audit trail")
+	}
+}
+
+// render executes the templates of the route, falling back to the configured ones
+func (notifier *mailNotifier) render(data interface{}, route *Route) (*Message, error) {
+	msg := &Message{}
+
+	cfg := notifier.cfg
+	subjectTmpl, textTmpl, htmlTmpl := cfg.SubjectTemplate, cfg.TextTemplate, cfg.HTMLTemplate
+	if route != nil {
+		if route.SubjectTemplate != nil {
+			subjectTmpl = route.SubjectTemplate
+		}
+		if route.TextTemplate != nil {
+			textTmpl = route.TextTemplate
+		}
+		if route.HTMLTemplate != nil {
+			htmlTmpl = route.HTMLTemplate
+		}
+		msg.To, msg.CC, msg.BCC = route.To, route.CC, route.BCC
+	}
+
+	buf := new(bytes.Buffer)
+	if subjectTmpl != nil {
+		if err := subjectTmpl.Execute(buf, data); err != nil {
+			return nil, errors.Wrap(err, "could not execute subject template")
+		}
+		msg.Subject = buf.String()
+		buf.Reset()
+	}
+
+	if err := textTmpl.Execute(buf, data); err != nil {
+		return nil, errors.Wrap(err, "could not execute text template")
+	}
+	msg.Text = buf.String()
+
+	if htmlTmpl != nil {
+		buf.Reset()
+		if err := htmlTmpl.Execute(buf, data); err != nil {
+			return nil, errors.Wrap(err, "could not execute html template")
+		}
+		msg.HTML = buf.String()
+	}
+
+	return msg, nil
+}
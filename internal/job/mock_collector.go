@@ -2,6 +2,7 @@
 
 package job
 
+import context "context"
 import mock "github.com/stretchr/testify/mock"
 import time "time"
 
@@ -10,13 +11,13 @@ type MockCollector struct {
 	mock.Mock
 }
 
-// CollectChangedAppts provides a mock function with given fields: _a0
-func (_m *MockCollector) CollectChangedAppts(_a0 time.Time) ([]*ApptChange, error) {
-	ret := _m.Called(_a0)
+// CollectChangedAppts provides a mock function with given fields: _a0, _a1
+func (_m *MockCollector) CollectChangedAppts(_a0 context.Context, _a1 time.Time) ([]*ApptChange, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 []*ApptChange
-	if rf, ok := ret.Get(0).(func(time.Time) []*ApptChange); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) []*ApptChange); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]*ApptChange)
@@ -24,8 +25,8 @@ func (_m *MockCollector) CollectChangedAppts(_a0 time.Time) ([]*ApptChange, erro
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(time.Time) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
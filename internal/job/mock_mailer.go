@@ -23,16 +23,25 @@ func (_m *MockMailer) Run(_a0 <-chan struct{}) error {
 	return r0
 }
 
-// SendMessage provides a mock function with given fields: _a0, _a1
-func (_m *MockMailer) SendMessage(_a0 string, _a1 string) error {
-	ret := _m.Called(_a0, _a1)
+// SendMessage provides a mock function with given fields: _a0
+func (_m *MockMailer) SendMessage(_a0 *Message) (*Receipt, error) {
+	ret := _m.Called(_a0)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(_a0, _a1)
+	var r0 *Receipt
+	if rf, ok := ret.Get(0).(func(*Message) *Receipt); ok {
+		r0 = rf(_a0)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Receipt)
+		}
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*Message) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
@@ -0,0 +1,219 @@
+package job_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/job/jobtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChangedApptsJob_Notifiers(t *testing.T) {
+	changes := []*job.ApptChange{
+		{Time: time.Unix(1, 0), Appointment: time.Unix(100, 0), PatientID: 1, IsBooking: true},
+		{Time: time.Unix(2, 0), Appointment: time.Unix(200, 0), PatientID: 2, IsBooking: false},
+	}
+
+	tests := []struct {
+		name      string
+		notifiers []*jobtest.Notifier
+		wantErr   bool
+		// resent lists the number of changes every notifier gets again by the next run
+		resent []int
+	}{
+		{
+			name:      "all notifiers succeed",
+			notifiers: []*jobtest.Notifier{{}, {}},
+			resent:    []int{0, 0},
+		},
+		{
+			name:      "failing notifier does not stop the others",
+			notifiers: []*jobtest.Notifier{{Err: errors.New("unreachable")}, {}},
+			wantErr:   true,
+			// only the failed notifier gets the changes again
+			resent: []int{2, 0},
+		},
+		{
+			name:      "partially failing notifier only retries the undelivered changes",
+			notifiers: []*jobtest.Notifier{{}, {Err: errors.New("unreachable"), Deliver: 1}},
+			wantErr:   true,
+			resent:    []int{0, 1},
+		},
+		{
+			name:      "partially delivered changes are remembered",
+			notifiers: []*jobtest.Notifier{{Err: errors.New("unreachable"), Deliver: 1}},
+			wantErr:   true,
+			resent:    []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &job.MockCollector{}
+			c.
+				On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+				Return(changes, nil)
+
+			notifiers := make([]job.Notifier, len(tt.notifiers))
+			for i, n := range tt.notifiers {
+				notifiers[i] = n
+			}
+
+			j := job.New(job.Config{DedupeRetention: time.Hour}, c, notifiers, &job.State{LastRun: time.Unix(0, 0)})
+			err := j.Execute(context.Background()).Err
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+
+			for _, n := range tt.notifiers {
+				assert.Len(t, n.Calls(), 1)
+				n.Err = nil
+			}
+
+			assert.NoError(t, j.Execute(context.Background()).Err)
+			for i, n := range tt.notifiers {
+				assert.Len(t, n.Notified(), len(changes)+tt.resent[i], "notifier %d", i)
+			}
+		})
+	}
+}
+
+func TestChangedApptsJob_Notifiers_Reordered(t *testing.T) {
+	changes := []*job.ApptChange{
+		{Time: time.Unix(1, 0), Appointment: time.Unix(100, 0), PatientID: 1, IsBooking: true},
+		{Time: time.Unix(2, 0), Appointment: time.Unix(200, 0), PatientID: 2, IsBooking: false},
+	}
+	c := &job.MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return(changes, nil)
+
+	mail := &jobtest.Notifier{ID: "mail"}
+	webhook := &jobtest.Notifier{ID: "webhook", Err: errors.New("unreachable"), Deliver: 1}
+	j := job.New(job.Config{DedupeRetention: time.Hour}, c, []job.Notifier{mail, webhook}, &job.State{LastRun: time.Unix(0, 0)})
+	assert.Error(t, j.Execute(context.Background()).Err)
+
+	// deliveries are remembered by the name of the notifier, not by its position, e.g. after a reload enabled slack
+	webhook.Err = nil
+	slack := &jobtest.Notifier{ID: "slack"}
+	j.SetNotifiers([]job.Notifier{slack, webhook, mail})
+	assert.NoError(t, j.Execute(context.Background()).Err)
+
+	assert.Len(t, mail.Notified(), 2)
+	assert.Len(t, webhook.Notified(), 3)
+	if assert.Len(t, webhook.Calls(), 2) {
+		assert.Equal(t, 2, webhook.Calls()[1][0].PatientID)
+	}
+	// the new notifier only gets the change not delivered by all notifiers yet
+	assert.Len(t, slack.Notified(), 1)
+}
+
+func TestChangedApptsJob_Retry(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	c := &jobtest.Collector{}
+	c.Add(
+		&job.ApptChange{Time: start.Add(time.Minute), Appointment: start, PatientID: 1, IsBooking: true},
+		&job.ApptChange{Time: start.Add(2 * time.Minute), Appointment: start, PatientID: 2, IsBooking: true},
+	)
+	n := &jobtest.Notifier{Err: errors.New("unreachable")}
+
+	j := job.New(job.Config{DedupeRetention: time.Hour}, c, []job.Notifier{n}, &job.State{LastRun: start})
+
+	// a failed run collects the same window again
+	assert.Error(t, j.Execute(context.Background()).Err)
+	n.Err = nil
+	assert.NoError(t, j.Execute(context.Background()).Err)
+	if assert.Len(t, n.Calls(), 2) {
+		assert.Len(t, n.Calls()[1], 2)
+	}
+
+	// a successful run only collects newer changes
+	c.Add(&job.ApptChange{Time: time.Now().Add(time.Minute), Appointment: start, PatientID: 3, IsBooking: false})
+	assert.NoError(t, j.Execute(context.Background()).Err)
+	if assert.Len(t, n.Calls(), 3) {
+		assert.Len(t, n.Calls()[2], 1)
+		assert.Equal(t, 3, n.Calls()[2][0].PatientID)
+	}
+
+	// collection failures notify nothing
+	c.Err = errors.New("database unreachable")
+	assert.Error(t, j.Execute(context.Background()).Err)
+	assert.Len(t, n.Calls(), 3)
+}
+
+func TestChangedApptsJob_Queue(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	c := &jobtest.Collector{}
+	c.Add(
+		&job.ApptChange{Time: start.Add(time.Minute), Appointment: start, PatientID: 1, IsBooking: true},
+		&job.ApptChange{Time: start.Add(2 * time.Minute), Appointment: start, PatientID: 2, IsBooking: true},
+	)
+	n := &jobtest.Notifier{Err: errors.New("unreachable"), Deliver: 1}
+	q := &jobtest.Queue{}
+
+	j := job.New(job.Config{DedupeRetention: time.Hour, Queue: q, QueueMaxAge: time.Hour}, c, []job.Notifier{n}, &job.State{LastRun: start})
+
+	// undelivered changes get queued instead of collecting the same window again
+	assert.Error(t, j.Execute(context.Background()).Err)
+	assert.Equal(t, 1, q.Len())
+
+	// queued changes are retried before new ones
+	n.Err = nil
+	c.Add(&job.ApptChange{Time: time.Now().Add(time.Minute), Appointment: start, PatientID: 3, IsBooking: false})
+	assert.NoError(t, j.Execute(context.Background()).Err)
+	if assert.Len(t, n.Calls(), 3) {
+		assert.Equal(t, 2, n.Calls()[1][0].PatientID)
+		assert.Len(t, n.Calls()[2], 1)
+		assert.Equal(t, 3, n.Calls()[2][0].PatientID)
+	}
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestChangedApptsJob_Queue_Pending(t *testing.T) {
+	lastRun := time.Now().Add(-time.Hour)
+	queuedAt := time.Now().Add(-2 * time.Hour)
+	queued := &job.ApptChange{Time: lastRun.Add(-time.Hour), PatientID: 1, IsBooking: true}
+	collected := &job.ApptChange{Time: time.Now(), PatientID: 2}
+
+	q := &jobtest.Queue{}
+	q.SaveQueue([]*job.QueuedChange{
+		{Change: queued, Queued: queuedAt},
+		{Change: &job.ApptChange{PatientID: 3}, Queued: time.Now().Add(-48 * time.Hour)},
+	})
+	c := &jobtest.Collector{}
+	c.Add(collected)
+
+	j := job.New(job.Config{Queue: q, QueueMaxAge: 24 * time.Hour}, c, nil, &job.State{LastRun: lastRun})
+
+	// the next run retries the queued change first, expired ones are given up
+	changes, err := j.Pending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []*job.QueuedChange{
+		{Change: queued, Queued: queuedAt},
+		{Change: collected},
+	}, changes)
+	// nothing gets notified or given up
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestChangedApptsJob_Queue_MaxAge(t *testing.T) {
+	q := &jobtest.Queue{}
+	q.SaveQueue([]*job.QueuedChange{
+		{Change: &job.ApptChange{PatientID: 1}, Queued: time.Now().Add(-2 * time.Hour)},
+		{Change: &job.ApptChange{PatientID: 2}, Queued: time.Now().Add(-time.Minute)},
+	})
+	n := &jobtest.Notifier{}
+
+	j := job.New(job.Config{Queue: q, QueueMaxAge: time.Hour}, &jobtest.Collector{}, []job.Notifier{n}, &job.State{})
+
+	// changes older than the max age are given up
+	assert.NoError(t, j.Execute(context.Background()).Err)
+	if assert.Len(t, n.Calls(), 1) {
+		assert.Len(t, n.Calls()[0], 1)
+		assert.Equal(t, 2, n.Calls()[0][0].PatientID)
+	}
+	assert.Equal(t, 0, q.Len())
+}
@@ -0,0 +1,128 @@
+package job
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Queue interface persists changes whose notification failed, so later runs retry them
+type Queue interface {
+	// LoadQueue returns the persisted changes, none if nothing got persisted yet
+	LoadQueue() ([]*QueuedChange, error)
+	SaveQueue([]*QueuedChange) error
+}
+
+// QueuedChange struct is a change waiting for another notification attempt
+type QueuedChange struct {
+	Change *ApptChange
+	// Queued is the time of the first failed attempt
+	Queued time.Time
+}
+
+// drain notifies the changes queued by previous runs and adds them to the result
+// changes queued longer than QueueMaxAge are given up as permanently failed
+func (job *changedApptsJob) drain(ctx context.Context, run time.Time, result *RunResult) error {
+	queue, err := job.cfg.Queue.LoadQueue()
+	if err != nil {
+		return errors.Wrap(err, "could not load queue")
+	}
+	if len(queue) == 0 {
+		return nil
+	}
+
+	var changes []*ApptChange
+	queued := make(map[*ApptChange]time.Time, len(queue))
+	for _, q := range queue {
+		if job.cfg.QueueMaxAge > 0 && run.Sub(q.Queued) > job.cfg.QueueMaxAge {
+			Logger(ctx).Error().
+				Int("patientID", q.Change.PatientID).
+				Time("appointment", q.Change.Appointment).
+				Bool("booking", q.Change.IsBooking).
+				Time("queued", q.Queued).
+				Msg("giving up queued change, notification permanently failed")
+
+			continue
+		}
+		changes = append(changes, q.Change)
+		queued[q.Change] = q.Queued
+	}
+	// changes may have been notified in the meantime, e.g. by an overlapping run
+	changes = job.dedupe(changes)
+
+	var notified []*ApptChange
+	var keys []string
+	if len(changes) > 0 {
+		Logger(ctx).Info().
+			Int("queued", len(changes)).
+			Msg("retrying queued changes")
+
+		notified, keys, err = job.notify(ctx, job.lastRun, changes)
+		err = errors.Wrap(err, "retry queued changes failed")
+	}
+	result.Collected += len(changes)
+	result.Sent += len(notified)
+	result.Failed += len(changes) - len(notified)
+
+	delivered := make(map[*ApptChange]bool, len(notified))
+	for _, change := range notified {
+		delivered[change] = true
+	}
+	var remaining []*QueuedChange
+	for _, change := range changes {
+		if !delivered[change] {
+			remaining = append(remaining, &QueuedChange{Change: change, Queued: queued[change]})
+		}
+	}
+
+	job.commit(ctx, run, keys, false)
+	if saveErr := job.saveQueue(remaining); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// enqueue appends the undelivered changes to the queue
+// it returns false if the changes could not be queued, so the window has to be collected again
+func (job *changedApptsJob) enqueue(ctx context.Context, run time.Time, changes, notified []*ApptChange) bool {
+	if job.cfg.Queue == nil {
+		return false
+	}
+
+	queue, err := job.cfg.Queue.LoadQueue()
+	if err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Msg("could not load queue")
+
+		return false
+	}
+
+	delivered := make(map[*ApptChange]bool, len(notified))
+	for _, change := range notified {
+		delivered[change] = true
+	}
+	for _, change := range changes {
+		if !delivered[change] {
+			queue = append(queue, &QueuedChange{Change: change, Queued: run})
+		}
+	}
+
+	if err := job.saveQueue(queue); err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Msg("could not queue failed changes")
+
+		return false
+	}
+	return true
+}
+
+// saveQueue persists the queue, dry runs are non-committal unless configured otherwise
+func (job *changedApptsJob) saveQueue(queue []*QueuedChange) error {
+	if job.cfg.DryRun && !job.cfg.DryRunCommit {
+		return nil
+	}
+	return errors.Wrap(job.cfg.Queue.SaveQueue(queue), "could not save queue")
+}
@@ -0,0 +1,219 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Appointment struct is an upcoming appointment, as collected for reminders and passed to the reminder templates
+// fields are only ever added, so templates keep working
+type Appointment struct {
+	// Start is the start of the appointment
+	Start       time.Time
+	PatientID   int
+	PatientName string
+	// Email is the address of the patient, appointments without one are not reminded
+	Email string
+
+	// Provider and Location are empty unless collected by the query
+	Provider string
+	Location string
+}
+
+// ID identifies the appointment, a moved appointment gets a new ID and is reminded again
+func (appt *Appointment) ID() string {
+	return fmt.Sprintf("%d/%s", appt.PatientID, appt.Start.UTC().Format(time.RFC3339Nano))
+}
+
+// ReminderCollector interface
+type ReminderCollector interface {
+	// collects the appointments starting after `from` until `to` ordered by start
+	// cancelling the context aborts the collection
+	CollectUpcomingAppts(ctx context.Context, from, to time.Time) ([]*Appointment, error)
+}
+
+// ReminderConfig struct encapsulate all settings for reminders
+type ReminderConfig struct {
+	// LeadTime is how long before their start appointments get reminded
+	LeadTime time.Duration
+
+	SubjectTemplate *texttemplate.Template
+	TextTemplate    *texttemplate.Template
+	HTMLTemplate    *htmltemplate.Template
+
+	// StateStore persists the reminded appointments between runs, optional
+	StateStore StateStore
+	// DryRun marks runs whose reminders only get logged by the mailer, they are not remembered
+	DryRun bool
+}
+
+// ReminderData struct is passed to the reminder templates
+type ReminderData struct {
+	*Appointment
+}
+
+// Reminders sends a reminder to the patient of every appointment starting within the lead time, once per appointment
+type Reminders struct {
+	cfg       ReminderConfig
+	collector ReminderCollector
+	mailer    Mailer
+	renderer  *mailNotifier
+
+	// mu serializes runs
+	mu sync.Mutex
+	// reminded maps IDs of reminded appointments to the time of the reminder
+	reminded map[string]time.Time
+}
+
+// NewReminders creates Reminders resuming from the given state
+// the Notified field of the state holds the reminded appointments
+func NewReminders(cfg ReminderConfig, collector ReminderCollector, mailer Mailer, state *State) *Reminders {
+	reminded := state.Notified
+	if reminded == nil {
+		reminded = make(map[string]time.Time)
+	}
+
+	return &Reminders{
+		cfg:       cfg,
+		collector: collector,
+		mailer:    mailer,
+		renderer: &mailNotifier{cfg: MailConfig{
+			SubjectTemplate: cfg.SubjectTemplate,
+			TextTemplate:    cfg.TextTemplate,
+			HTMLTemplate:    cfg.HTMLTemplate,
+		}},
+		reminded: reminded,
+	}
+}
+
+// Run sends the due reminders once and logs the result, suitable for scheduling
+func (r *Reminders) Run(ctx context.Context) {
+	ctx = WithRunID(ctx, newRunID())
+	sent, err := r.Execute(ctx)
+	if err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Int("sent", sent).
+			Msg("reminder run failed")
+
+		return
+	}
+
+	Logger(ctx).Debug().
+		Int("sent", sent).
+		Msg("reminder run finished")
+}
+
+// Execute reminds the appointments starting within the lead time, which did not get reminded yet
+// it returns the number of sent reminders, a failed reminder does not stop the others and is tried again next run
+func (r *Reminders) Execute(ctx context.Context) (int, error) {
+	if RunID(ctx) == "" {
+		ctx = WithRunID(ctx, newRunID())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, span := startSpan(ctx, "reminders.run", attribute.String("run.id", RunID(ctx)))
+	sent, err := r.execute(ctx)
+	span.SetAttributes(attribute.Int("appointments.sent", sent))
+	endSpan(span, err)
+	return sent, err
+}
+
+// execute collects and sends the reminders of a run, the caller holds mu
+func (r *Reminders) execute(ctx context.Context) (int, error) {
+	run := time.Now()
+	appts, err := r.collector.CollectUpcomingAppts(ctx, run, run.Add(r.cfg.LeadTime))
+	if err != nil {
+		return 0, errors.Wrap(err, "collect upcoming appointments failed")
+	}
+
+	// an appointment is within the window for at most the lead time, so it can be forgotten afterwards
+	threshold := run.Add(-r.cfg.LeadTime)
+	for id, remindedAt := range r.reminded {
+		if remindedAt.Before(threshold) {
+			delete(r.reminded, id)
+		}
+	}
+
+	var sent, failed int
+	var firstErr error
+	for _, appt := range appts {
+		if _, ok := r.reminded[appt.ID()]; ok {
+			continue
+		}
+		if appt.Email == "" {
+			Logger(ctx).Debug().
+				Int("patientID", appt.PatientID).
+				Time("start", appt.Start).
+				Msg("skipping reminder of patient without email address")
+
+			continue
+		}
+
+		if err := r.send(ctx, appt); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			Logger(ctx).Error().
+				Err(err).
+				Int("patientID", appt.PatientID).
+				Time("start", appt.Start).
+				Msg("could not send reminder")
+
+			continue
+		}
+		sent++
+		if !r.cfg.DryRun {
+			r.reminded[appt.ID()] = run
+		}
+	}
+
+	r.saveState(ctx, run)
+
+	if failed > 0 {
+		return sent, errors.Wrapf(firstErr, "%d of %d reminders failed", failed, sent+failed)
+	}
+	return sent, nil
+}
+
+// send renders and sends the reminder of a single appointment to the patient
+func (r *Reminders) send(ctx context.Context, appt *Appointment) error {
+	msg, err := r.renderer.render(&ReminderData{appt}, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not render reminder")
+	}
+	msg.To = []string{appt.Email}
+	msg.RunID = RunID(ctx)
+
+	_, span := startSpan(ctx, "mail.send",
+		attribute.Int("appointments.count", 1),
+		attribute.String("change.type", "reminder"),
+	)
+	_, err = r.mailer.SendMessage(msg)
+	err = errors.Wrap(err, "could not send reminder")
+	endSpan(span, err)
+	return err
+}
+
+// saveState persists the reminded appointments if a StateStore is configured
+func (r *Reminders) saveState(ctx context.Context, run time.Time) {
+	if r.cfg.StateStore == nil || r.cfg.DryRun {
+		return
+	}
+
+	if err := r.cfg.StateStore.SaveState(&State{LastRun: run, Notified: r.reminded}); err != nil {
+		Logger(ctx).Error().
+			Err(err).
+			Msg("could not save reminder state")
+	}
+}
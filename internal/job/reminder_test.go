@@ -0,0 +1,124 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// upcomingCollector returns the same appointments on every collection
+type upcomingCollector []*Appointment
+
+func (c upcomingCollector) CollectUpcomingAppts(ctx context.Context, from, to time.Time) ([]*Appointment, error) {
+	return c, nil
+}
+
+// stateRecorder keeps the last saved state
+type stateRecorder struct {
+	saved *State
+}
+
+func (s *stateRecorder) LoadState() (*State, error) {
+	return &State{}, nil
+}
+
+func (s *stateRecorder) SaveState(state *State) error {
+	s.saved = state
+	return nil
+}
+
+func newTestReminderConfig(t *testing.T) ReminderConfig {
+	subjectTmpl, err := template.Inline("subject", "Erinnerung {{ .PatientName }}")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("reminder.txt.tmpl", "")
+	assert.NoError(t, err)
+	htmlTmpl, err := template.HTML("reminder.tmpl", "")
+	assert.NoError(t, err)
+
+	return ReminderConfig{
+		LeadTime:        24 * time.Hour,
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		HTMLTemplate:    htmlTmpl,
+	}
+}
+
+func TestReminders_Execute(t *testing.T) {
+	start := time.Now().Add(3 * time.Hour).Truncate(time.Minute)
+	c := upcomingCollector{
+		{Start: start, PatientID: 1, PatientName: "Maria Musterfrau", Email: "maria@example.com", Provider: "Dr. Huber"},
+		{Start: start, PatientID: 2, PatientName: "Max Mustermann"},
+		// already reminded in a previous run
+		{Start: start, PatientID: 3, PatientName: "Erika Muster", Email: "erika@example.com"},
+	}
+
+	var sent []*Message
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Run(func(args mock.Arguments) { sent = append(sent, args.Get(0).(*Message)) }).
+		Return(&Receipt{}, nil)
+
+	store := &stateRecorder{}
+	cfg := newTestReminderConfig(t)
+	cfg.StateStore = store
+	r := NewReminders(cfg, c, m, &State{Notified: map[string]time.Time{
+		c[2].ID(): time.Now().Add(-time.Hour),
+		// expired, the appointment is long over
+		"4/2026-01-01T08:00:00Z": time.Now().Add(-48 * time.Hour),
+	}})
+
+	n, err := r.Execute(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, []string{"maria@example.com"}, sent[0].To)
+		assert.Equal(t, "Erinnerung Maria Musterfrau", sent[0].Subject)
+		assert.Contains(t, sent[0].Text, "Guten Tag Maria Musterfrau")
+		assert.Contains(t, sent[0].Text, "Behandler: Dr. Huber")
+		assert.Contains(t, sent[0].HTML, "Dr. Huber")
+		assert.NotEmpty(t, sent[0].RunID)
+	}
+	if assert.NotNil(t, store.saved) {
+		assert.Len(t, store.saved.Notified, 2)
+		assert.Contains(t, store.saved.Notified, c[0].ID())
+		assert.Contains(t, store.saved.Notified, c[2].ID())
+	}
+
+	// every appointment got reminded once
+	n, err = r.Execute(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, sent, 1)
+}
+
+func TestReminders_Execute_DryRun(t *testing.T) {
+	c := upcomingCollector{
+		{Start: time.Now().Add(time.Hour), PatientID: 1, PatientName: "Maria Musterfrau", Email: "maria@example.com"},
+	}
+
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil)
+
+	store := &stateRecorder{}
+	cfg := newTestReminderConfig(t)
+	cfg.StateStore = store
+	cfg.DryRun = true
+	r := NewReminders(cfg, c, m, &State{})
+
+	// dry runs are not remembered, so the reminder is logged again
+	for i := 0; i < 2; i++ {
+		n, err := r.Execute(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	m.AssertNumberOfCalls(t, "SendMessage", 2)
+	assert.Nil(t, store.saved)
+}
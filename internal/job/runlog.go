@@ -0,0 +1,47 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type runIDKey struct{}
+
+type loggerKey struct{}
+
+// WithRunID returns a context carrying the run ID and a logger adding it as run_id to every line
+func WithRunID(ctx context.Context, id string) context.Context {
+	logger := log.With().Str("run_id", id).Logger()
+	ctx = context.WithValue(ctx, runIDKey{}, id)
+	return context.WithValue(ctx, loggerKey{}, &logger)
+}
+
+// RunID returns the run ID of the context, empty outside of runs
+func RunID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// Logger returns the logger of the run, the global logger outside of runs
+func Logger(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
+// newRunID returns a random version 4 UUID
+func newRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// the run ID only correlates log lines, so a fixed ID is good enough
+		return "00000000-0000-4000-8000-000000000000"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,33 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRunID(t *testing.T) {
+	buf := new(bytes.Buffer)
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(buf)
+
+	id := newRunID()
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	assert.NotEqual(t, id, newRunID())
+
+	ctx := WithRunID(context.Background(), id)
+	assert.Equal(t, id, RunID(ctx))
+	Logger(ctx).Info().Msg("in run")
+	assert.Contains(t, buf.String(), `"run_id":"`+id+`"`)
+
+	// outside of runs the global logger is used
+	buf.Reset()
+	assert.Equal(t, "", RunID(context.Background()))
+	Logger(context.Background()).Info().Msg("outside")
+	assert.NotContains(t, buf.String(), "run_id")
+}
@@ -0,0 +1,41 @@
+package job
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of runs by the global tracer provider, spans are no-ops unless one got registered
+var tracer = otel.Tracer("github.com/emed-appts/emed-mailer/internal/job")
+
+// startSpan starts a span as child of the span in ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks the span as failed by err, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// changeType returns the type of all changes, or mixed if there are bookings and cancellations
+func changeType(changes []*ApptChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	t := changes[0].ChangeType()
+	for _, change := range changes[1:] {
+		if change.ChangeType() != t {
+			return "mixed"
+		}
+	}
+	return t
+}
@@ -0,0 +1,62 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestChangedApptsJob_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	c := &MockCollector{}
+	c.
+		On("CollectChangedAppts", mock.Anything, mock.AnythingOfType("time.Time")).
+		Return([]*ApptChange{
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 1, IsBooking: true},
+			{Time: time.Now(), Appointment: time.Now(), PatientID: 2, IsBooking: true},
+		}, nil)
+
+	m := &MockMailer{}
+	m.
+		On("SendMessage", mock.AnythingOfType("*job.Message")).
+		Return(&Receipt{}, nil)
+
+	subjectTmpl, err := template.Inline("subject", "changes")
+	assert.NoError(t, err)
+	textTmpl, err := template.Text("changedappts.txt.tmpl", "")
+	assert.NoError(t, err)
+
+	job := New(Config{}, c, []Notifier{NewMailNotifier(MailConfig{
+		SubjectTemplate: subjectTmpl,
+		TextTemplate:    textTmpl,
+		Digest:          true,
+	}, m)}, &State{})
+	assert.NoError(t, job.Execute(context.Background()).Err)
+
+	// spans end bottom up
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	send, notify, run := spans[0], spans[1], spans[2]
+	assert.Equal(t, "mail.send", send.Name())
+	assert.Equal(t, "job.notify", notify.Name())
+	assert.Equal(t, "job.run", run.Name())
+	assert.Equal(t, notify.SpanContext().SpanID(), send.Parent().SpanID())
+	assert.Equal(t, run.SpanContext().SpanID(), notify.Parent().SpanID())
+	assert.Contains(t, send.Attributes(), attribute.Int("appointments.count", 2))
+	assert.Contains(t, send.Attributes(), attribute.String("change.type", "booked"))
+	assert.Contains(t, run.Attributes(), attribute.Int("appointments.collected", 2))
+}
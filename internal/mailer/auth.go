@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"bytes"
+	"net/smtp"
+
+	"github.com/pkg/errors"
+)
+
+// loginAuth implements the LOGIN authentication mechanism
+// which is not provided by net/smtp
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing LOGIN authentication over unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch {
+	case bytes.EqualFold(fromServer, []byte("Username:")):
+		return []byte(a.username), nil
+	case bytes.EqualFold(fromServer, []byte("Password:")):
+		return []byte(a.password), nil
+	default:
+		return nil, errors.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+// latin9 maps the characters of ISO-8859-15 which differ from ISO-8859-1
+var latin9 = map[rune]byte{
+	'€': 0xA4, 'Š': 0xA6, 'š': 0xA8, 'Ž': 0xB4, 'ž': 0xB8, 'Œ': 0xBC, 'œ': 0xBD, 'Ÿ': 0xBE,
+}
+
+// charsets maps the supported charsets to the encoders of the body text, nil keeps the text as UTF-8
+var charsets = map[string]func(string) string{
+	CharsetUTF8: nil,
+	CharsetASCII: func(text string) string {
+		return encodeBytes(text, func(r rune) (byte, bool) {
+			return byte(r), r < 0x80
+		})
+	},
+	CharsetLatin1: func(text string) string {
+		return encodeBytes(text, func(r rune) (byte, bool) {
+			return byte(r), r < 0x100
+		})
+	},
+	CharsetLatin9: func(text string) string {
+		return encodeBytes(text, func(r rune) (byte, bool) {
+			if b, ok := latin9[r]; ok {
+				return b, true
+			}
+			switch r {
+			case '¤', '¦', '¨', '´', '¸', '¼', '½', '¾':
+				// replaced by the characters above
+				return 0, false
+			}
+			return byte(r), r < 0x100
+		})
+	},
+}
+
+// encodeBytes converts the text to a single byte charset, characters not contained in it are replaced by ?
+func encodeBytes(text string, encode func(rune) (byte, bool)) string {
+	b := make([]byte, 0, len(text))
+	for _, r := range text {
+		c, ok := encode(r)
+		if !ok {
+			c = '?'
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// bodyEncoding returns the charset and the transfer encoding of message bodies
+// unsupported values default to UTF-8 and quoted-printable
+func bodyEncoding(charset, transferEncoding string) (string, gomail.Encoding) {
+	charset = strings.ToUpper(charset)
+	if _, ok := charsets[charset]; !ok {
+		charset = CharsetUTF8
+	}
+
+	switch enc := gomail.Encoding(strings.ToLower(transferEncoding)); enc {
+	case gomail.Base64, gomail.Unencoded:
+		return charset, enc
+	default:
+		return charset, gomail.QuotedPrintable
+	}
+}
+
+// encodeBody converts the body text to the charset
+func encodeBody(charset, text string) string {
+	if encode := charsets[charset]; encode != nil {
+		return encode(text)
+	}
+	return text
+}
@@ -0,0 +1,273 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// dialer opens authenticated connections to the configured smtp server
+type dialer struct {
+	cfg Config
+	// tokens provides access tokens for AuthXOAUTH2, shared by all dialers of a mailer
+	tokens *tokenSource
+}
+
+func newDialer(cfg Config, tokens *tokenSource) *dialer {
+	return &dialer{cfg, tokens}
+}
+
+// Dial connects and authenticates to the smtp server
+// the returned sender has to be closed by the caller
+func (d *dialer) Dial() (*sender, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext is like Dial, the deadline of ctx also bounds the handshake
+func (d *dialer) DialContext(ctx context.Context) (*sender, error) {
+	dialTimeout := d.cfg.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	nd, err := proxyDialer(d.cfg.Proxy, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// the timeout also bounds the handshake of the proxy, tls is applied within the tunnel
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	conn, err := nd.DialContext(dialCtx, "tcp", fmt.Sprintf("%s:%d", d.cfg.Server, d.cfg.Port))
+	cancel()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to smtp server")
+	}
+
+	timeout := d.cfg.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	// the whole handshake including tls and auth has to finish in time
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	tcpConn := conn
+
+	encryption := d.cfg.Encryption
+	if encryption == "" || encryption == EncryptionAuto {
+		// implicit tls on the smtps port
+		if d.cfg.Port == 465 {
+			encryption = EncryptionTLS
+		} else {
+			encryption = EncryptionAuto
+		}
+	}
+
+	if encryption == EncryptionTLS {
+		conn = tls.Client(conn, d.tlsConfig())
+	}
+
+	c, err := smtp.NewClient(conn, d.cfg.Server)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not create smtp client")
+	}
+
+	// the greeting must precede any other command
+	if d.cfg.HeloHost != "" {
+		if err := c.Hello(d.cfg.HeloHost); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "smtp EHLO/HELO command failed")
+		}
+	}
+
+	if encryption == EncryptionAuto || encryption == EncryptionStartTLS {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && encryption == EncryptionStartTLS {
+			c.Close()
+			return nil, errors.Errorf("smtp server %s does not advertise STARTTLS extension", d.cfg.Server)
+		}
+		if ok {
+			if err := c.StartTLS(d.tlsConfig()); err != nil {
+				c.Close()
+				return nil, errors.Wrap(err, "could not upgrade connection with STARTTLS")
+			}
+		}
+	}
+
+	if d.cfg.User != "" {
+		ok, mechs := c.Extension("AUTH")
+		if ok {
+			auth, err := d.auth(mechs)
+			if err != nil {
+				c.Close()
+				return nil, errors.WithStack(err)
+			}
+			if err := c.Auth(auth); err != nil {
+				c.Close()
+				return nil, errors.Wrap(err, "could not authenticate to smtp server")
+			}
+		} else if d.cfg.AuthType != "" && d.cfg.AuthType != AuthAuto {
+			c.Close()
+			return nil, errors.Errorf("smtp server %s does not advertise AUTH extension", d.cfg.Server)
+		} else {
+			log.Warn().
+				Str("server", d.cfg.Server).
+				Msg("smtp server does not advertise AUTH extension, sending unauthenticated")
+		}
+	}
+
+	return &sender{client: c, conn: tcpConn, timeout: timeout}, nil
+}
+
+func (d *dialer) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         d.cfg.Server,
+		InsecureSkipVerify: d.cfg.InsecureSkipVerify,
+	}
+}
+
+// auth returns the configured auth mechanism, if advertised by the server
+// AuthAuto picks one out of the advertised mechanisms
+func (d *dialer) auth(mechs string) (smtp.Auth, error) {
+	authType := d.cfg.AuthType
+	if authType == "" || authType == AuthAuto {
+		switch {
+		case hasMech(mechs, "CRAM-MD5"):
+			authType = AuthCRAMMD5
+		case hasMech(mechs, "PLAIN"):
+			authType = AuthPlain
+		case hasMech(mechs, "LOGIN"):
+			authType = AuthLogin
+		default:
+			return nil, errors.Errorf("smtp server offers no supported auth mechanism, it supports: %s", mechs)
+		}
+	}
+
+	if !hasMech(mechs, authType) {
+		return nil, errors.Errorf("smtp server does not offer %s authentication, it supports: %s", strings.ToUpper(authType), mechs)
+	}
+
+	switch authType {
+	case AuthPlain:
+		return smtp.PlainAuth("", d.cfg.User, d.cfg.Password, d.cfg.Server), nil
+	case AuthLogin:
+		return &loginAuth{d.cfg.User, d.cfg.Password}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(d.cfg.User, d.cfg.Password), nil
+	case AuthXOAUTH2:
+		token, err := d.tokens.Token()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &xoauth2Auth{d.cfg.User, token}, nil
+	}
+	return nil, errors.Errorf("unknown auth type %q", d.cfg.AuthType)
+}
+
+// hasMech reports whether the space separated mechanisms advertised by the server contain mech
+func hasMech(mechs, mech string) bool {
+	for _, m := range strings.Fields(mechs) {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// sender implements gomail.SendCloser on top of a smtp client
+type sender struct {
+	client *smtp.Client
+	// conn is the underlying tcp connection, its deadline bounds every exchange
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// extend moves the deadline of the connection, so a hung server fails the current exchange
+func (s *sender) extend() {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+}
+
+// Send transmits a single message to the given recipients
+// it returns the reply of the server accepting the message, e.g. 2.0.0 Ok: queued as 4C3F1
+func (s *sender) Send(from string, to []string, msg io.WriterTo) (string, error) {
+	if len(to) == 0 {
+		return "", errors.New("message has no recipients")
+	}
+
+	s.extend()
+	if err := s.client.Mail(from); err != nil {
+		return "", errors.Wrap(err, "smtp MAIL command failed")
+	}
+
+	// a rejected recipient must not prevent delivery to the others
+	var rcptErr error
+	accepted := 0
+	for _, addr := range to {
+		if err := s.client.Rcpt(addr); err != nil {
+			rcptErr = err
+			log.Error().
+				Err(err).
+				Str("recipient", addr).
+				Msg("smtp server rejected recipient")
+
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return "", errors.Wrap(rcptErr, "smtp server rejected all recipients")
+	}
+
+	// smtp.Client.Data discards the final reply, so DATA is sent by the underlying text connection
+	s.extend()
+	id, err := s.client.Text.Cmd("DATA")
+	if err != nil {
+		return "", errors.Wrap(err, "smtp DATA command failed")
+	}
+	s.client.Text.StartResponse(id)
+	_, _, err = s.client.Text.ReadResponse(354)
+	s.client.Text.EndResponse(id)
+	if err != nil {
+		return "", errors.Wrap(err, "smtp DATA command failed")
+	}
+
+	w := s.client.Text.DotWriter()
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return "", errors.Wrap(err, "could not write message")
+	}
+
+	s.extend()
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "could not finish message")
+	}
+	_, response, err := s.client.Text.ReadResponse(250)
+	return response, errors.Wrap(err, "could not finish message")
+}
+
+// Reset aborts the current mail transaction
+func (s *sender) Reset() error {
+	s.extend()
+	return s.client.Reset()
+}
+
+// Noop checks that the session is still alive
+func (s *sender) Noop() error {
+	s.extend()
+	return s.client.Noop()
+}
+
+// Close terminates the smtp session
+func (s *sender) Close() error {
+	s.extend()
+	return s.client.Quit()
+}
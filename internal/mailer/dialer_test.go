@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialer_Auth(t *testing.T) {
+	tests := []struct {
+		authType string
+		mechs    string
+		want     string
+		err      string
+	}{
+		{AuthAuto, "LOGIN PLAIN CRAM-MD5", "CRAM-MD5", ""},
+		{AuthAuto, "LOGIN PLAIN", "PLAIN", ""},
+		{"", "LOGIN", "LOGIN", ""},
+		{AuthAuto, "XOAUTH2", "", "offers no supported auth mechanism, it supports: XOAUTH2"},
+		{AuthLogin, "LOGIN PLAIN", "LOGIN", ""},
+		{AuthCRAMMD5, "LOGIN PLAIN", "", "does not offer CRAM-MD5 authentication, it supports: LOGIN PLAIN"},
+		{"ntlm", "NTLM", "", "unknown auth type"},
+	}
+
+	for _, tt := range tests {
+		d := newDialer(Config{Server: "localhost", User: "user", Password: "secret", AuthType: tt.authType}, nil)
+		auth, err := d.auth(tt.mechs)
+		if tt.err != "" {
+			if assert.Error(t, err, tt.authType) {
+				assert.Contains(t, err.Error(), tt.err, tt.authType)
+			}
+			continue
+		}
+		if !assert.NoError(t, err, tt.authType) {
+			continue
+		}
+
+		mech, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost", TLS: true, Auth: strings.Fields(tt.mechs)})
+		assert.NoError(t, err, tt.authType)
+		assert.Equal(t, tt.want, mech, tt.authType)
+	}
+}
+
+func TestDialer_HeloHost(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.HeloHost = "mailer.example.com"
+
+	s, err := newDialer(cfg, nil).Dial()
+	if assert.NoError(t, err) {
+		assert.NoError(t, s.Close())
+	}
+	assert.Equal(t, "EHLO mailer.example.com", srv.Commands()[0])
+}
+
+func TestDialer_Timeout(t *testing.T) {
+	// the server accepts connections, but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	start := time.Now()
+	_, err = newDialer(Config{Server: "127.0.0.1", Port: p, Encryption: EncryptionNone, Timeout: 100 * time.Millisecond}, nil).Dial()
+	if assert.Error(t, err) {
+		assert.True(t, isTemporary(err), "timeouts get retried")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestDialer_StartTLS(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.startTLS, srv.requireTLS = true, true
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.Encryption, cfg.InsecureSkipVerify = EncryptionStartTLS, true
+
+	s, err := newDialer(cfg, nil).Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.Send("from@example.com", []string{"to@example.com"}, strings.NewReader("Subject: test\r\n\r\ntest\r\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	if assert.Len(t, srv.Received(), 1) {
+		assert.True(t, srv.Received()[0].TLS)
+	}
+
+	// the self-signed certificate is rejected unless verification is skipped
+	cfg.InsecureSkipVerify = false
+	_, err = newDialer(cfg, nil).Dial()
+	assert.Error(t, err)
+
+	// the server refuses unencrypted mail
+	cfg.Encryption = EncryptionNone
+	s, err = newDialer(cfg, nil).Dial()
+	if assert.NoError(t, err) {
+		_, err = s.Send("from@example.com", []string{"to@example.com"}, strings.NewReader("Subject: test\r\n\r\ntest\r\n"))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "530")
+		}
+		s.Close()
+	}
+}
+
+func TestDialer_AuthExchange(t *testing.T) {
+	for _, authType := range []string{AuthPlain, AuthLogin, AuthCRAMMD5} {
+		srv := newFakeServer(t, "AUTH PLAIN LOGIN CRAM-MD5")
+		srv.startTLS, srv.requireAuth = true, true
+
+		// LOGIN refuses unencrypted connections
+		cfg := srv.config()
+		cfg.Encryption, cfg.InsecureSkipVerify = EncryptionStartTLS, true
+		cfg.User, cfg.Password, cfg.AuthType = "user", "secret", authType
+
+		s, err := newDialer(cfg, nil).Dial()
+		if assert.NoError(t, err, authType) {
+			_, err = s.Send("from@example.com", []string{"to@example.com"}, strings.NewReader("Subject: test\r\n\r\ntest\r\n"))
+			assert.NoError(t, err, authType)
+			s.Close()
+		}
+		if assert.Len(t, srv.Received(), 1, authType) {
+			received := srv.Received()[0]
+			assert.Equal(t, strings.ToUpper(authType), received.Auth)
+			assert.Equal(t, "user", received.User, authType)
+			assert.True(t, received.TLS, authType)
+		}
+		srv.Close()
+	}
+}
@@ -1,6 +1,12 @@
 package mailer
 
-import "github.com/pkg/errors"
+import (
+	"io"
+	"net"
+	"net/textproto"
+
+	"github.com/pkg/errors"
+)
 
 type notRunning interface {
 	NotRunning() bool
@@ -51,3 +57,73 @@ func (err *alreadyRunningError) Error() string {
 func (err *alreadyRunningError) AlreadyRunning() bool {
 	return true
 }
+
+type circuitOpen interface {
+	CircuitOpen() bool
+}
+
+// IsCircuitOpen checks if the error cause is a circuitOpen error
+// returned if the circuit breakers of all servers are open, so the message did not get sent
+func IsCircuitOpen(err error) bool {
+	co, ok := errors.Cause(err).(circuitOpen)
+	return ok && co.CircuitOpen()
+}
+
+type circuitOpenError struct{}
+
+func newCircuitOpenError() error {
+	return errors.WithStack(&circuitOpenError{})
+}
+
+func (err *circuitOpenError) Error() string {
+	return "smtp circuit breaker open for all servers"
+}
+
+func (err *circuitOpenError) CircuitOpen() bool {
+	return true
+}
+
+// isTemporary checks if a send failure is worth retrying
+// that is a 4xx smtp reply or a failing connection
+func isTemporary(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *textproto.Error:
+		return cause.Code >= 400 && cause.Code < 500
+	case net.Error:
+		return true
+	}
+
+	cause := errors.Cause(err)
+	return cause == io.EOF || cause == io.ErrUnexpectedEOF
+}
+
+// connectError marks a failure to establish the smtp session, in contrast to a failure of the message transaction
+type connectError struct {
+	err error
+}
+
+func (err *connectError) Error() string {
+	return err.err.Error()
+}
+
+func (err *connectError) Cause() error {
+	return err.err
+}
+
+func (err *connectError) Unwrap() error {
+	return err.err
+}
+
+// isConnectFailure checks if no session got established or the session broke
+// rejections of the message within an established session are no connection failures
+func isConnectFailure(err error) bool {
+	var ce *connectError
+	return errors.As(err, &ce) || !isProtocolError(err)
+}
+
+// isProtocolError checks if the smtp server replied with an error code
+// in contrast to a broken connection
+func isProtocolError(err error) bool {
+	_, ok := errors.Cause(err).(*textproto.Error)
+	return ok
+}
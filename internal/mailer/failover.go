@@ -0,0 +1,157 @@
+package mailer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// breakerState is the state of the circuit breaker of a server
+type breakerState int
+
+const (
+	// breakerClosed passes every message
+	breakerClosed breakerState = iota
+	// breakerOpen fails every message right away until the cooldown elapsed
+	breakerOpen
+	// breakerHalfOpen passes a single message probing whether the server recovered
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// server tracks the health of a smtp server by a circuit breaker
+// the breaker opens after `threshold` consecutive connection failures, so messages fail fast instead of retrying a server which is down
+type server struct {
+	dialer *dialer
+	addr   string
+	// threshold is zero if the breaker is disabled
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the probe of a half-open breaker is in progress
+	probing bool
+}
+
+// newServers returns the primary server followed by the fallbacks
+func newServers(cfg Config, tokens *tokenSource) []*server {
+	servers := []*server{{
+		dialer:    newDialer(cfg, tokens),
+		addr:      fmt.Sprintf("%s:%d", cfg.Server, cfg.Port),
+		threshold: cfg.BreakerThreshold,
+		cooldown:  cfg.BreakerCooldown,
+	}}
+	for _, fallback := range cfg.Fallbacks {
+		c := cfg
+		c.Server, c.Port, c.User, c.Password = fallback.Server, fallback.Port, fallback.User, fallback.Password
+		servers = append(servers, &server{
+			dialer:    newDialer(c, tokens),
+			addr:      fmt.Sprintf("%s:%d", c.Server, c.Port),
+			threshold: c.BreakerThreshold,
+			cooldown:  c.BreakerCooldown,
+		})
+	}
+	return servers
+}
+
+// healthy reports whether the breaker is closed
+func (srv *server) healthy() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.state == breakerClosed
+}
+
+// allow reports whether a message may be sent by the server
+// an open breaker turns half-open once the cooldown elapsed and passes a single probe, every other message is short-circuited
+func (srv *server) allow(now time.Time) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch srv.state {
+	case breakerOpen:
+		if now.Sub(srv.openedAt) < srv.cooldown {
+			return false
+		}
+		srv.transition(breakerHalfOpen)
+	case breakerHalfOpen:
+		if srv.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	srv.probing = true
+	return true
+}
+
+// succeeded closes the breaker, the server replied
+func (srv *server) succeeded() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.failures = 0
+	srv.probing = false
+	if srv.state != breakerClosed {
+		srv.transition(breakerClosed)
+	}
+}
+
+// failed counts a connection failure, opening the breaker at the threshold or if the probe failed
+func (srv *server) failed() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.failures++
+	srv.probing = false
+	if srv.threshold > 0 && (srv.state == breakerHalfOpen || (srv.state == breakerClosed && srv.failures >= srv.threshold)) {
+		srv.openedAt = time.Now()
+		srv.transition(breakerOpen)
+	}
+}
+
+// transition logs and changes the state of the breaker, the caller holds mu
+func (srv *server) transition(state breakerState) {
+	event := log.Info()
+	if state == breakerOpen {
+		event = log.Warn()
+	}
+	event.
+		Str("server", srv.addr).
+		Str("from", srv.state.String()).
+		Str("to", state.String()).
+		Int("failures", srv.failures).
+		Dur("cooldown", srv.cooldown).
+		Msg("smtp circuit breaker changed state")
+
+	srv.state = state
+}
+
+// order returns the servers with closed breakers followed by the others, each in configured order
+func order(servers []*server) []*server {
+	ordered := make([]*server, 0, len(servers))
+	var unhealthy []*server
+	for _, srv := range servers {
+		if srv.healthy() {
+			ordered = append(ordered, srv)
+		} else {
+			unhealthy = append(unhealthy, srv)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailover(t *testing.T) {
+	backup := newFakeServer(t)
+	defer backup.Close()
+
+	// the primary server is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	cfg := backup.config()
+	fallback := Fallback{Server: cfg.Server, Port: cfg.Port}
+	cfg.Port, _ = strconv.Atoi(port)
+	cfg.Fallbacks = []Fallback{fallback}
+	cfg.BreakerThreshold, cfg.BreakerCooldown = 3, 5*time.Minute
+
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	for i := 0; i < cfg.BreakerThreshold+1; i++ {
+		_, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, cfg.BreakerThreshold+1, backup.Messages())
+
+	// the breaker of the failing primary is open
+	assert.False(t, m.servers[0].healthy())
+	assert.Equal(t, m.servers[1], order(m.servers)[0])
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// the server is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	l.Close()
+
+	p, _ := strconv.Atoi(port)
+	cfg := Config{
+		Server:           "127.0.0.1",
+		Port:             p,
+		Encryption:       EncryptionNone,
+		From:             "from@example.com",
+		To:               []string{"to@example.com"},
+		ConnectRetries:   5,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  100 * time.Millisecond,
+	}
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	// the breaker opens after the second attempt, stopping the retries
+	_, err = m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.True(t, IsCircuitOpen(err))
+	// later messages fail fast
+	_, err = m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.True(t, IsCircuitOpen(err))
+
+	// the server recovered, the probe after the cooldown closes the breaker
+	l, err = net.Listen("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &fakeServer{listener: l}
+	go srv.serve()
+	defer srv.Close()
+
+	time.Sleep(cfg.BreakerCooldown)
+	_, err = m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.NoError(t, err)
+	assert.True(t, m.servers[0].healthy())
+	assert.Equal(t, 1, srv.Messages())
+}
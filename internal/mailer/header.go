@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEncodedWord limits the length of the encoded-words of encodeHeader
+// short words let gomail fold the header within 78 characters per line
+const maxEncodedWord = 50
+
+// encodeHeader encodes a header value containing non-ASCII characters as sequence of encoded-words (RFC 2047)
+// the words are separated by spaces, which are ignored when decoding, so gomail folds the header between them
+// unlike mime.QEncoding every word gets encoded, even if ASCII only, otherwise the spaces would be decoded
+func encodeHeader(value string) string {
+	return encodeWords(value, isText)
+}
+
+// encodeName encodes the display name of an address like encodeHeader
+// encoded-words within names are restricted to fewer plain characters
+func encodeName(name string) string {
+	return encodeWords(name, isPhrase)
+}
+
+func encodeWords(value string, plain func(rune) bool) string {
+	if !needsEncoding(value) {
+		return value
+	}
+
+	var words []string
+	word := new(strings.Builder)
+	for _, r := range value {
+		n := 3 * utf8.RuneLen(r)
+		if plain(r) {
+			n = 1
+		}
+		if word.Len() > 0 && word.Len()+n > maxEncodedWord-len("?=") {
+			words = append(words, word.String()+"?=")
+			word.Reset()
+		}
+		if word.Len() == 0 {
+			word.WriteString("=?UTF-8?q?")
+		}
+		writeQ(word, r, plain(r))
+	}
+	words = append(words, word.String()+"?=")
+
+	return strings.Join(words, " ")
+}
+
+// writeQ writes the rune in Q encoding
+func writeQ(w *strings.Builder, r rune, plain bool) {
+	switch {
+	case r == ' ':
+		w.WriteByte('_')
+	case plain:
+		w.WriteRune(r)
+	default:
+		buf := make([]byte, utf8.UTFMax)
+		for _, b := range buf[:utf8.EncodeRune(buf, r)] {
+			fmt.Fprintf(w, "=%02X", b)
+		}
+	}
+}
+
+// isText reports whether the rune is written as it is to encoded-words of unstructured headers
+func isText(r rune) bool {
+	return r >= ' ' && r <= '~' && r != '=' && r != '?' && r != '_'
+}
+
+// isPhrase reports whether the rune is written as it is to encoded-words of display names (RFC 2047 section 5)
+func isPhrase(r rune) bool {
+	return r == ' ' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("!*+-/", r)
+}
+
+func needsEncoding(value string) bool {
+	for _, r := range value {
+		if (r < ' ' || r > '~') && r != '\t' {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,24 @@
 package mailer
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	netmail "net/mail"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/metrics"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/gomail.v2"
 )
@@ -19,15 +33,44 @@ var (
 // TextMailer implements Mailer interface
 // it runs a daemon waiting for text messages to send to a predefined address
 type TextMailer struct {
+	// cfgMu guards the recipients of cfg, which change on reload
+	cfgMu    sync.RWMutex
 	cfg      Config
-	messages chan *gomail.Message
+	messages chan *envelope
 	running  bool
+	// done gets closed once the daemon stopped
+	done chan struct{}
+	// pending counts messages waiting for delivery
+	pending int32
+	// limiter throttles the workers, nil if unlimited
+	limiter *limiter
+	// tokens caches the access tokens of AuthXOAUTH2
+	tokens *tokenSource
+	// servers are the primary server followed by the fallbacks, shared by all workers
+	servers []*server
+}
+
+// envelope wraps a message together with its smtp envelope addresses
+// the daemon reports the delivery result on the result channel
+type envelope struct {
+	from      string
+	to        []string
+	msg       *gomail.Message
+	messageID string
+	result    chan error
+	// response is the reply of the server accepting the message, set before the result
+	response string
+	// log adds the run ID of the message to every line
+	log *zerolog.Logger
 }
 
 // New returns a Mailer implementation
 func New(cfg Config) *TextMailer {
+	tokens := newTokenSource(cfg)
 	return &TextMailer{
-		cfg: cfg,
+		cfg:     cfg,
+		tokens:  tokens,
+		servers: newServers(cfg, tokens),
 	}
 }
 
@@ -44,9 +87,11 @@ func (mailer *TextMailer) Run(stop <-chan struct{}) error {
 		return newAlreadyRunningError()
 	}
 
-	// create fresh channel
-	mailer.messages = make(chan *gomail.Message)
-	go mailer.daemon(stop)
+	// create fresh channels
+	mailer.messages = make(chan *envelope)
+	mailer.done = make(chan struct{})
+	mailer.limiter = newLimiter(mailer.cfg.RateLimit, mailer.cfg.Burst)
+	go mailer.daemon(stop, mailer.concurrency())
 	// set running state true
 	atomic.StoreUint32(&running, 1)
 	mailer.running = true
@@ -57,69 +102,538 @@ func (mailer *TextMailer) Run(stop <-chan struct{}) error {
 }
 
 // SendMessage prepares new messages and sends them
+// it blocks until the message got delivered or delivery failed and returns the Message-ID and the reply of the server
+// messages with a html body are sent as multipart/alternative
 // Caller is responsible for proper escaping of message in case of e.g. HTML
-func (mailer *TextMailer) SendMessage(contentType, messageText string) error {
+func (mailer *TextMailer) SendMessage(message *job.Message) (*job.Receipt, error) {
 	if !mailer.running {
-		return newNotRunningError()
+		return nil, newNotRunningError()
+	}
+
+	env := mailer.compose(message)
+	env.result = make(chan error, 1)
+
+	if mailer.cfg.DryRun {
+		if err := logMessage(env); err != nil {
+			return nil, err
+		}
+		return &job.Receipt{MessageID: env.messageID}, nil
 	}
 
+	atomic.AddInt32(&mailer.pending, 1)
+	defer atomic.AddInt32(&mailer.pending, -1)
+
+	select {
+	case mailer.messages <- env:
+		if err := <-env.result; err != nil {
+			return nil, err
+		}
+		return &job.Receipt{MessageID: env.messageID, Response: env.response}, nil
+	case <-mailer.done:
+		return nil, newNotRunningError()
+	}
+}
+
+// WriteMessage writes the message in MIME format exactly as it would be sent, without sending it
+func (mailer *TextMailer) WriteMessage(w io.Writer, message *job.Message) error {
+	_, err := mailer.compose(message).msg.WriteTo(w)
+	return errors.Wrap(err, "could not write message")
+}
+
+// compose renders the message into an envelope
+func (mailer *TextMailer) compose(message *job.Message) *envelope {
+	// recipients of the message replace the configured ones as a whole
+	mailer.cfgMu.RLock()
+	rcptTo, rcptCC, rcptBCC := mailer.cfg.To, mailer.cfg.CC, mailer.cfg.BCC
+	mailer.cfgMu.RUnlock()
+	if len(message.To) > 0 {
+		rcptTo, rcptCC, rcptBCC = message.To, message.CC, message.BCC
+	}
+	logger := &log.Logger
+	if message.RunID != "" {
+		l := log.With().Str("run_id", message.RunID).Logger()
+		logger = &l
+	}
+
+	// a malformed recipient must not fail the delivery to the others
+	rcptTo, rcptCC, rcptBCC = validAddresses(logger, "to", rcptTo), validAddresses(logger, "cc", rcptCC), validAddresses(logger, "bcc", rcptBCC)
+
 	// prepare message
-	msg := gomail.NewMessage()
-	msg.SetHeader("From", mailer.cfg.From)
-	msg.SetHeader("To", mailer.cfg.To)
-	msg.SetHeader("Subject", mailer.cfg.Subject)
-	msg.SetBody(contentType, messageText)
+	// text parts are sent in the configured charset and transfer encoding, UTF-8 quoted-printable by default
+	charset, encoding := bodyEncoding(mailer.cfg.Charset, mailer.cfg.TransferEncoding)
+	msg := gomail.NewMessage(gomail.SetCharset(charset), gomail.SetEncoding(encoding))
+	// only the display names of addresses get encoded
+	msg.SetHeader("From", formatAddresses(msg, mailer.from())...)
+	msg.SetHeader("To", formatAddresses(msg, rcptTo...)...)
+	if len(rcptCC) > 0 {
+		msg.SetHeader("Cc", formatAddresses(msg, rcptCC...)...)
+	}
+	if mailer.cfg.ReplyTo != "" {
+		msg.SetHeader("Reply-To", formatAddresses(msg, mailer.cfg.ReplyTo)...)
+	}
+	for name, value := range mailer.cfg.Headers {
+		if value != "" {
+			msg.SetHeader(name, encodeHeader(value))
+		}
+	}
+	subject := message.Subject
+	if subject == "" {
+		subject = mailer.cfg.Subject
+	}
+	msg.SetHeader("Subject", encodeHeader(subject))
+	messageID := mailer.messageID()
+	msg.SetHeader("Message-ID", messageID)
+	msg.SetBody("text/plain", encodeBody(charset, message.Text))
+	if message.HTML != "" {
+		msg.AddAlternative("text/html", encodeBody(charset, message.HTML))
+	}
+	for _, a := range message.Attachments {
+		data := a.Data
+		msg.Attach(a.Name,
+			gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		)
+	}
 
-	mailer.messages <- msg
-	return nil
+	// Bcc recipients are part of the envelope only
+	to := make([]string, 0, len(rcptTo)+len(rcptCC)+len(rcptBCC))
+	to = append(to, envelopeAddresses(rcptTo...)...)
+	to = append(to, envelopeAddresses(rcptCC...)...)
+	to = append(to, envelopeAddresses(rcptBCC...)...)
+
+	return &envelope{
+		from:      envelopeAddresses(mailer.cfg.From)[0],
+		to:        uniqueAddresses(to),
+		msg:       msg,
+		messageID: messageID,
+		log:       logger,
+	}
 }
 
-// daemon listens for messages on the channel and sends them
-func (mailer *TextMailer) daemon(stop <-chan struct{}) {
-	// prepare smpt dialer
-	dialer := gomail.NewDialer(mailer.cfg.Server, mailer.cfg.Port, mailer.cfg.User, mailer.cfg.Password)
+// from returns the From address, with the display name replaced by FromName if set
+func (mailer *TextMailer) from() string {
+	if mailer.cfg.FromName == "" {
+		return mailer.cfg.From
+	}
+	addr := &netmail.Address{Name: mailer.cfg.FromName, Address: envelopeAddresses(mailer.cfg.From)[0]}
+	return addr.String()
+}
+
+// messageID generates a unique Message-ID of the form <random@domain>, the domain defaults to the one of From
+func (mailer *TextMailer) messageID() string {
+	domain := mailer.cfg.MessageIDDomain
+	if domain == "" {
+		from := envelopeAddresses(mailer.cfg.From)[0]
+		if at := strings.LastIndex(from, "@"); at >= 0 {
+			domain = from[at+1:]
+		}
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to the clock, unique enough within a single sender
+		return fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), domain)
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
 
-	var s gomail.SendCloser
+// validAddresses returns the addresses which parse, the others are logged and skipped
+func validAddresses(logger *zerolog.Logger, field string, addresses []string) []string {
+	valid := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if _, err := netmail.ParseAddress(address); err != nil {
+			logger.Warn().
+				Err(err).
+				Str("field", field).
+				Str("address", address).
+				Msg("skipping invalid recipient address")
+
+			continue
+		}
+		valid = append(valid, address)
+	}
+	return valid
+}
+
+// formatAddresses encodes the display names of the addresses as MIME encoded-words
+// addresses which do not parse are returned as they are
+func formatAddresses(msg *gomail.Message, addresses ...string) []string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		addr, err := netmail.ParseAddress(address)
+		if err != nil {
+			formatted[i] = address
+			continue
+		}
+		if needsEncoding(addr.Name) {
+			formatted[i] = encodeName(addr.Name) + " <" + addr.Address + ">"
+		} else {
+			// gomail quotes plain names
+			formatted[i] = msg.FormatAddress(addr.Address, addr.Name)
+		}
+	}
+	return formatted
+}
+
+// envelopeAddresses strips the display names of the addresses for the smtp envelope
+func envelopeAddresses(addresses ...string) []string {
+	bare := make([]string, len(addresses))
+	for i, address := range addresses {
+		if addr, err := netmail.ParseAddress(address); err == nil {
+			address = addr.Address
+		}
+		bare[i] = address
+	}
+	return bare
+}
+
+// uniqueAddresses removes repeated envelope addresses, e.g. a manager listed in TO and BCC, keeping the first one
+// domains are compared case-insensitively, local parts as they are like the smtp rfc says
+func uniqueAddresses(addresses []string) []string {
+	unique := make([]string, 0, len(addresses))
+	seen := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		key := address
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			key = address[:at] + strings.ToLower(address[at:])
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, address)
+	}
+	return unique
+}
+
+// Probe connects, encrypts and authenticates to the smtp servers as for sending and issues NOOP, without sending a message
+// it succeeds if any server does, e.g. to check a wrong password before changes have to be notified
+func (mailer *TextMailer) Probe(ctx context.Context) error {
 	var err error
-	// dialer status: is open or closed
-	open := false
+	for _, srv := range order(mailer.servers) {
+		if err = probe(ctx, srv); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probe checks a single server
+func probe(ctx context.Context, srv *server) error {
+	s, err := srv.dialer.DialContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "could not probe %s", srv.addr)
+	}
+	defer s.client.Close()
+
+	if err := s.Noop(); err != nil {
+		return errors.Wrapf(err, "smtp NOOP command to %s failed", srv.addr)
+	}
+	return errors.Wrapf(s.Close(), "could not quit smtp session with %s", srv.addr)
+}
+
+// SetRecipients replaces the configured recipients of later messages
+func (mailer *TextMailer) SetRecipients(to, cc, bcc []string) {
+	mailer.cfgMu.Lock()
+	defer mailer.cfgMu.Unlock()
+
+	mailer.cfg.To, mailer.cfg.CC, mailer.cfg.BCC = to, cc, bcc
+}
+
+// Done returns a channel which gets closed once the daemon stopped
+// after it delivered all messages submitted before stop
+func (mailer *TextMailer) Done() <-chan struct{} {
+	return mailer.done
+}
+
+// Pending returns the number of messages waiting for delivery
+func (mailer *TextMailer) Pending() int {
+	return int(atomic.LoadInt32(&mailer.pending))
+}
+
+// logMessage logs the fully rendered message instead of sending it
+func logMessage(env *envelope) error {
+	buf := new(bytes.Buffer)
+	if _, err := env.msg.WriteTo(buf); err != nil {
+		return errors.Wrap(err, "could not render message")
+	}
+
+	subject := env.msg.GetHeader("Subject")[0]
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+
+	env.log.Info().
+		Str("from", env.from).
+		Strs("to", env.to).
+		Str("subject", subject).
+		Str("messageID", env.messageID).
+		Str("message", buf.String()).
+		Msg("dry run, message not sent")
+
+	return nil
+}
+
+// concurrency returns the number of workers
+func (mailer *TextMailer) concurrency() int {
+	switch {
+	case mailer.cfg.Concurrency < 1:
+		return 1
+	case mailer.cfg.Concurrency > MaxConcurrency:
+		return MaxConcurrency
+	}
+	return mailer.cfg.Concurrency
+}
+
+// daemon runs the workers and marks the mailer stopped once all of them finished
+func (mailer *TextMailer) daemon(stop <-chan struct{}, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailer.worker(stop)
+		}()
+	}
+	wg.Wait()
+
+	runMu.Lock()
+
+	// set running state false
+	atomic.StoreUint32(&running, 0)
+	mailer.running = false
+	close(mailer.done)
+
+	runMu.Unlock()
+}
+
+// worker listens for messages on the channel and sends them by its own smtp session
+func (mailer *TextMailer) worker(stop <-chan struct{}) {
+	conn := &connection{servers: mailer.servers}
+
+	idleTimeout := mailer.cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 30 * time.Second
+	}
+
+	idleSince := time.Now()
 	for {
+		// an open session is kept alive by NOOP until it was idle for the idle timeout
+		wait := idleTimeout - time.Since(idleSince)
+		keepAlive := conn.sender != nil && mailer.cfg.KeepAlive > 0 && mailer.cfg.KeepAlive < wait
+		if keepAlive {
+			wait = mailer.cfg.KeepAlive
+		}
+
 		select {
-		case msg := <-mailer.messages:
-			if !open {
-				if s, err = dialer.Dial(); err != nil {
-					log.Error().
-						Err(err).
-						Msg("could not dial smtp server")
-				}
-				open = true
-			}
-			if err := gomail.Send(s, msg); err != nil {
-				log.Error().
-					Err(err).
-					Msg("could not send mail")
+		case env := <-mailer.messages:
+			mailer.limiter.Wait()
+			env.result <- mailer.deliver(conn, env, stop)
+			idleSince = time.Now()
+		case <-time.After(wait):
+			if keepAlive {
+				conn.keepAlive()
+				continue
 			}
-			// Close the connection to the SMTP server if no email was sent in
-			// the last 30 seconds.
-		case <-time.After(30 * time.Second):
-			if open {
-				if err := s.Close(); err != nil {
-					log.Error().
-						Err(err).
-						Msg("could not close sender")
+			// Close the connection to the SMTP server if no email was sent
+			// within the idle timeout.
+			conn.close()
+			idleSince = time.Now()
+		case <-stop:
+			// finish messages already waiting for delivery
+		drain:
+			for {
+				select {
+				case env := <-mailer.messages:
+					mailer.limiter.Wait()
+					env.result <- mailer.deliver(conn, env, stop)
+				default:
+					break drain
 				}
-				open = false
 			}
+			conn.close()
+			return
+		}
+
+	}
+}
+
+// deliver sends the message and retries temporary failures with exponential backoff
+// connection failures and rejections of the message are retried up to ConnectRetries and SendRetries times each
+// a stop gives up waiting for the next retry, so a failing server does not hold up the shutdown
+func (mailer *TextMailer) deliver(conn *connection, env *envelope, stop <-chan struct{}) error {
+	backoff := mailer.cfg.RetryBackoff
+	var connectFailures, sendFailures int
+	for attempt := 1; ; attempt++ {
+		err := conn.send(env)
+		if err == nil {
+			metrics.EmailsSent.Inc()
+			return nil
+		}
+
+		connecting := isConnectFailure(err)
+		// an open circuit breaker fails fast, the message gets queued by the caller
+		retry := isTemporary(err) && !IsCircuitOpen(err)
+		if connecting {
+			connectFailures++
+			retry = retry && connectFailures <= mailer.cfg.ConnectRetries
+		} else {
+			sendFailures++
+			retry = retry && sendFailures <= mailer.cfg.SendRetries
+		}
+		if !retry {
+			metrics.EmailsFailed.Inc()
+			env.log.Error().
+				Err(err).
+				Int("attempt", attempt).
+				Bool("connecting", connecting).
+				Msg("could not send mail")
+
+			return err
+		}
+
+		env.log.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Bool("connecting", connecting).
+			Dur("backoff", backoff).
+			Msg("could not send mail, retrying")
+
+		select {
+		case <-time.After(backoff):
 		case <-stop:
-			runMu.Lock()
+			metrics.EmailsFailed.Inc()
+			env.log.Error().
+				Err(err).
+				Int("attempt", attempt).
+				Msg("could not send mail, mailer stopped before retrying")
 
-			// set running state false
-			atomic.StoreUint32(&running, 0)
-			mailer.running = false
+			return err
+		}
+		backoff *= 2
+	}
+}
 
-			runMu.Unlock()
-			return
+// connection lazily dials the smtp servers and keeps the session open between messages
+type connection struct {
+	servers []*server
+	// sender is the session to current
+	sender  *sender
+	current *server
+}
+
+// send transmits the message by the first server accepting it, skipping servers whose circuit breaker is open
+// it fails right away if the breakers of all servers are open
+func (conn *connection) send(env *envelope) error {
+	var err error
+	now := time.Now()
+	for _, srv := range order(conn.servers) {
+		if !srv.allow(now) {
+			continue
+		}
+		if err = conn.sendVia(srv, env); err == nil {
+			srv.succeeded()
+			env.log.Info().
+				Str("server", srv.addr).
+				Strs("to", env.to).
+				Str("messageID", env.messageID).
+				Str("response", env.response).
+				Msg("mail sent")
+
+			return nil
+		}
+
+		// a rejection of the message is a reply, so the server is reachable
+		if isProtocolError(err) {
+			srv.succeeded()
+		} else {
+			srv.failed()
+		}
+		if len(conn.servers) > 1 {
+			env.log.Warn().
+				Err(err).
+				Str("server", srv.addr).
+				Msg("could not send mail, failing over to next server")
+		}
+	}
+	if err == nil {
+		return newCircuitOpenError()
+	}
+	return err
+}
+
+// sendVia transmits the message by the given server, dialing it if necessary
+func (conn *connection) sendVia(srv *server, env *envelope) error {
+	if conn.sender != nil && conn.current != srv {
+		conn.close()
+	}
+	if conn.sender != nil {
+		// the server may have dropped the idle session, RSET checks it before reuse
+		if err := conn.sender.Reset(); err != nil {
+			log.Debug().
+				Err(err).
+				Msg("smtp session broke, reconnecting")
+
+			conn.sender.client.Close()
+			conn.sender = nil
+		}
+	}
+	if conn.sender == nil {
+		s, err := srv.dialer.Dial()
+		if err != nil {
+			return &connectError{err}
+		}
+		conn.sender = s
+		conn.current = srv
+	}
+
+	response, err := conn.sender.Send(env.from, env.to, env.msg)
+	env.response = response
+	if err != nil {
+		if isProtocolError(err) {
+			// the session is still usable, reset the transaction
+			conn.sender.Reset()
+		} else {
+			// connection broke, dial again on next attempt
+			conn.sender.client.Close()
+			conn.sender = nil
 		}
+	}
+	return err
+}
+
+// keepAlive sends NOOP on an open smtp session, so the server does not drop it as idle
+// a broken session is discarded, the next message dials again
+func (conn *connection) keepAlive() {
+	if conn.sender == nil {
+		return
+	}
+	if err := conn.sender.Noop(); err != nil {
+		log.Debug().
+			Err(err).
+			Str("server", conn.current.addr).
+			Msg("smtp session broke on keepalive")
 
+		conn.sender.client.Close()
+		conn.sender = nil
+	}
+}
+
+// close terminates an open smtp session
+func (conn *connection) close() {
+	if conn.sender == nil {
+		return
+	}
+	if err := conn.sender.Close(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not close sender")
 	}
+	conn.sender = nil
 }
@@ -0,0 +1,487 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompose_Headers(t *testing.T) {
+	m := New(Config{
+		From:    "noreply@example.com",
+		To:      []string{"to@example.com"},
+		ReplyTo: "Empfang Praxis Müller <empfang@example.com>",
+		Headers: map[string]string{
+			"X-Clinic-ID": "42",
+			"X-Empty":     "",
+			"X-Note":      strings.Repeat("Terminänderung ", 8),
+		},
+	})
+
+	msg := m.compose(&job.Message{Subject: "test", Text: "test"}).msg
+	buf := new(bytes.Buffer)
+	_, err := msg.WriteTo(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	header := buf.String()[:strings.Index(buf.String(), "\r\n\r\n")+2]
+
+	assert.Contains(t, header, "Reply-To: =?UTF-8?q?Empfang_Praxis_M=C3=BCller?= <empfang@example.com>\r\n")
+	assert.Contains(t, header, "X-Clinic-ID: 42\r\n")
+	assert.NotContains(t, header, "X-Empty")
+	assert.Contains(t, header, "X-Note: =?UTF-8?q?Termin=C3=A4nderung_")
+	for _, line := range strings.Split(header, "\r\n") {
+		assert.True(t, len(line) <= 78, "line too long: %q", line)
+	}
+
+	// folded encoded-words decode to the original value
+	note := msg.GetHeader("X-Note")[0]
+	decoded, err := new(mime.WordDecoder).DecodeHeader(note)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("Terminänderung ", 8), decoded)
+}
+
+func TestCompose_From(t *testing.T) {
+	for _, tc := range []struct {
+		from, name string
+		header     string
+	}{
+		{"eMed Clinic Reception <noreply@example.com>", "", "From: \"eMed Clinic Reception\" <noreply@example.com>\r\n"},
+		{"\"Reception, eMed\" <noreply@example.com>", "", "From: \"Reception, eMed\" <noreply@example.com>\r\n"},
+		{"Ignored <noreply@example.com>", `Reception "Main", eMed`, "From: \"Reception \\\"Main\\\", eMed\" <noreply@example.com>\r\n"},
+		{"noreply@example.com", "Empfang Müller", "From: =?UTF-8?q?Empfang_M=C3=BCller?= <noreply@example.com>\r\n"},
+	} {
+		m := New(Config{
+			From:     tc.from,
+			FromName: tc.name,
+			To:       []string{"to@example.com"},
+		})
+
+		env := m.compose(&job.Message{Subject: "test", Text: "test"})
+		buf := new(bytes.Buffer)
+		if _, err := env.msg.WriteTo(buf); !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Contains(t, buf.String(), tc.header, tc.from)
+		// MAIL FROM gets the bare address
+		assert.Equal(t, "noreply@example.com", env.from, tc.from)
+	}
+}
+
+func TestCompose_DuplicateRecipients(t *testing.T) {
+	m := New(Config{
+		From: "noreply@example.com",
+		To:   []string{"Empfang <empfang@example.com>", "manager@example.com"},
+		CC:   []string{"Manager <manager@EXAMPLE.com>"},
+		BCC:  []string{"manager@example.com", "Manager@example.com"},
+	})
+
+	env := m.compose(&job.Message{Subject: "test", Text: "test"})
+
+	// a single envelope recipient per address, local parts are case-sensitive
+	assert.Equal(t, []string{"empfang@example.com", "manager@example.com", "Manager@example.com"}, env.to)
+
+	// the headers list the recipients as configured
+	assert.Equal(t, []string{"\"Empfang\" <empfang@example.com>", "manager@example.com"}, env.msg.GetHeader("To"))
+	assert.Equal(t, []string{"\"Manager\" <manager@EXAMPLE.com>"}, env.msg.GetHeader("Cc"))
+}
+
+func TestCompose_Alternative(t *testing.T) {
+	m := New(Config{From: "noreply@example.com", To: []string{"to@example.com"}})
+
+	env := m.compose(&job.Message{Subject: "test", Text: "Grüße aus der Ordination", HTML: "<p>Grüße aus der <b>Ordination</b></p>"})
+	buf := new(bytes.Buffer)
+	if _, err := env.msg.WriteTo(buf); !assert.NoError(t, err) {
+		return
+	}
+
+	msg, err := netmail.ReadMessage(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "1.0", msg.Header.Get("Mime-Version"))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	assert.NotEmpty(t, params["boundary"])
+
+	// clients prefer the last part they can show, so plain text comes first
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", "Grüße aus der Ordination"},
+		{"text/html; charset=UTF-8", "<p>Grüße aus der <b>Ordination</b></p>"},
+	} {
+		part, err := r.NextRawPart()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want.contentType, part.Header.Get("Content-Type"))
+		assert.Equal(t, "quoted-printable", part.Header.Get("Content-Transfer-Encoding"))
+
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		assert.NoError(t, err)
+		assert.Equal(t, want.body, string(body))
+	}
+	_, err = r.NextRawPart()
+	assert.Error(t, err)
+}
+
+func TestCompose_Encoding(t *testing.T) {
+	m := New(Config{
+		From: "Praxis Dr. Jürgen Größ <praxis@example.com>",
+		To:   []string{"Empfang <empfang@example.com>", "team@example.com"},
+	})
+
+	env := m.compose(&job.Message{Subject: "Terminänderung für Frau Müller", Text: "Grüße"})
+	buf := new(bytes.Buffer)
+	_, err := env.msg.WriteTo(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	message := buf.String()
+
+	// long headers are folded between encoded-words
+	assert.Contains(t, message, "Subject: =?UTF-8?q?Termin=C3=A4nderung_f=C3=BCr_Frau_M?=\r\n =?UTF-8?q?=C3=BCller?=\r\n")
+	assert.Contains(t, message, "From: =?UTF-8?q?Praxis_Dr=2E_J=C3=BCrgen_Gr=C3=B6?= =?UTF-8?q?=C3=9F?=\r\n <praxis@example.com>\r\n")
+	assert.Contains(t, message, "To: \"Empfang\" <empfang@example.com>, team@example.com\r\n")
+	assert.Contains(t, message, "Content-Type: text/plain; charset=UTF-8\r\n")
+	assert.Contains(t, message, "Content-Transfer-Encoding: quoted-printable\r\n")
+	assert.Contains(t, message, "Gr=C3=BC=C3=9Fe")
+
+	// the envelope takes the bare addresses
+	assert.Equal(t, "praxis@example.com", env.from)
+	assert.Equal(t, []string{"empfang@example.com", "team@example.com"}, env.to)
+}
+
+func TestCompose_Charset(t *testing.T) {
+	for _, tc := range []struct {
+		charset, encoding string
+		header            string
+		body              string
+	}{
+		{CharsetLatin1, EncodingQuotedPrintable, "quoted-printable", "Gr=FC=DFe ? 5"},
+		{CharsetLatin9, EncodingBase64, "base64", base64.StdEncoding.EncodeToString([]byte("Gr\xfc\xdfe \xa4 5"))},
+		{CharsetASCII, EncodingQuotedPrintable, "quoted-printable", "Gr??e ? 5"},
+		{"utf-8", Encoding8Bit, "8bit", "Grüße € 5"},
+	} {
+		m := New(Config{
+			From:             "noreply@example.com",
+			To:               []string{"to@example.com"},
+			Charset:          tc.charset,
+			TransferEncoding: tc.encoding,
+		})
+
+		env := m.compose(&job.Message{Subject: "test", Text: "Grüße € 5"})
+		buf := new(bytes.Buffer)
+		if _, err := env.msg.WriteTo(buf); !assert.NoError(t, err) {
+			return
+		}
+		message := buf.String()
+
+		assert.Contains(t, message, "Content-Type: text/plain; charset="+strings.ToUpper(tc.charset)+"\r\n", tc.charset)
+		assert.Contains(t, message, "Content-Transfer-Encoding: "+tc.header+"\r\n", tc.charset)
+		assert.Contains(t, message, "\r\n\r\n"+tc.body, tc.charset)
+	}
+}
+
+func TestCompose_InvalidRecipients(t *testing.T) {
+	m := New(Config{
+		From: "noreply@example.com",
+		To:   []string{"to@example.com"},
+	})
+
+	// malformed recipients of a message are skipped, the others still get it
+	env := m.compose(&job.Message{
+		Subject: "test",
+		Text:    "test",
+		To:      []string{"frontdesk@example.com", "frontdesk@@example.com"},
+		CC:      []string{"manager example.com"},
+		BCC:     []string{"Archiv <archiv@example.com>"},
+	})
+	assert.Equal(t, []string{"frontdesk@example.com", "archiv@example.com"}, env.to)
+	assert.Equal(t, []string{"frontdesk@example.com"}, env.msg.GetHeader("To"))
+	assert.Empty(t, env.msg.GetHeader("Cc"))
+}
+
+func TestCompose_MessageID(t *testing.T) {
+	m := New(Config{From: "Praxis <praxis@example.com>", To: []string{"to@example.com"}})
+
+	first := m.compose(&job.Message{Subject: "test", Text: "test"})
+	second := m.compose(&job.Message{Subject: "test", Text: "test"})
+	assert.Regexp(t, `^<[0-9a-f]{32}@example\.com>$`, first.messageID)
+	assert.Equal(t, []string{first.messageID}, first.msg.GetHeader("Message-ID"))
+	assert.NotEqual(t, first.messageID, second.messageID)
+
+	m = New(Config{From: "praxis@example.com", To: []string{"to@example.com"}, MessageIDDomain: "mailer.example.org"})
+	assert.Regexp(t, `@mailer\.example\.org>$`, m.compose(&job.Message{Subject: "test", Text: "test"}).messageID)
+}
+
+func TestSendMessage_Receipt(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+
+	m := New(srv.config())
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	receipt, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	if assert.NoError(t, err) {
+		assert.Regexp(t, `^<[0-9a-f]{32}@example\.com>$`, receipt.MessageID)
+		assert.Equal(t, "queued", receipt.Response)
+	}
+}
+
+func TestWorker_KeepAlive(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.IdleTimeout, cfg.KeepAlive = time.Minute, 20*time.Millisecond
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	count := func(cmd string) int {
+		n := 0
+		for _, c := range srv.Commands() {
+			if strings.HasPrefix(c, cmd) {
+				n++
+			}
+		}
+		return n
+	}
+
+	_, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return count("NOOP") >= 2 }, time.Second, 10*time.Millisecond)
+
+	// the idle session is kept and reused
+	_, err = m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count("EHLO"))
+
+	// a session broken on keepalive is dialed again by the next message
+	srv.Script("NOOP", "421 idle timeout")
+	time.Sleep(100 * time.Millisecond)
+	_, err = m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count("EHLO"))
+	assert.Equal(t, 3, srv.Messages())
+}
+
+func TestProbe(t *testing.T) {
+	srv := newFakeServer(t, "AUTH PLAIN")
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.User, cfg.Password, cfg.AuthType = "user", "secret", AuthPlain
+
+	assert.NoError(t, New(cfg).Probe(context.Background()))
+	assert.Contains(t, srv.Commands(), "NOOP")
+	assert.Equal(t, 0, srv.Messages())
+
+	// a wrong password fails the probe
+	srv.rejectAuth = true
+	err := New(cfg).Probe(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not authenticate to smtp server")
+	}
+}
+
+func TestDeliver_Retries(t *testing.T) {
+	tests := []struct {
+		name   string
+		script map[string][]string
+		// connectRetries and sendRetries configure the mailer
+		connectRetries int
+		sendRetries    int
+		wantErr        bool
+		// wantRcpt is the number of RCPT commands received, i.e. the attempts reaching the transaction
+		wantRcpt int
+	}{
+		{
+			name:           "busy server is connected again",
+			script:         map[string][]string{"GREETING": {"421 busy", "421 busy"}},
+			connectRetries: 2,
+			wantRcpt:       1,
+		},
+		{
+			name:           "connect retries are exhausted",
+			script:         map[string][]string{"GREETING": {"421 busy", "421 busy"}},
+			connectRetries: 1,
+			sendRetries:    5,
+			wantErr:        true,
+		},
+		{
+			name:        "temporary rejection is sent again",
+			script:      map[string][]string{"RCPT": {"451 4.7.1 greylisted"}},
+			sendRetries: 1,
+			wantRcpt:    2,
+		},
+		{
+			name:           "send retries are exhausted",
+			script:         map[string][]string{"RCPT": {"451 4.7.1 greylisted", "451 4.7.1 greylisted"}},
+			connectRetries: 5,
+			sendRetries:    1,
+			wantErr:        true,
+			wantRcpt:       2,
+		},
+		{
+			name:           "permanent rejection is not sent again",
+			script:         map[string][]string{"RCPT": {"550 5.1.1 no such user"}},
+			connectRetries: 5,
+			sendRetries:    5,
+			wantErr:        true,
+			wantRcpt:       1,
+		},
+		{
+			name:           "rejected authentication is not retried",
+			script:         map[string][]string{"AUTH": {"535 5.7.8 authentication credentials invalid"}},
+			connectRetries: 5,
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeServer(t, "AUTH PLAIN")
+			defer srv.Close()
+			for cmd, replies := range tt.script {
+				srv.Script(cmd, replies...)
+			}
+
+			cfg := srv.config()
+			cfg.User, cfg.Password, cfg.AuthType = "user", "secret", AuthPlain
+			cfg.ConnectRetries, cfg.SendRetries = tt.connectRetries, tt.sendRetries
+			cfg.RetryBackoff = time.Millisecond
+
+			m := New(cfg)
+			stop := make(chan struct{})
+			if !assert.NoError(t, m.Run(stop)) {
+				return
+			}
+			defer func() {
+				close(stop)
+				<-m.Done()
+			}()
+
+			_, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+
+			var rcpt int
+			for _, cmd := range srv.Commands() {
+				if strings.HasPrefix(cmd, "RCPT") {
+					rcpt++
+				}
+			}
+			assert.Equal(t, tt.wantRcpt, rcpt)
+		})
+	}
+}
+
+func TestDeliver_StopInterruptsRetry(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+	srv.Script("MAIL", "451 try again later")
+
+	cfg := srv.config()
+	cfg.SendRetries, cfg.RetryBackoff = 3, time.Hour
+
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+		sent <- err
+	}()
+	assert.Eventually(t, func() bool {
+		for _, cmd := range srv.Commands() {
+			if strings.HasPrefix(cmd, "MAIL") {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// the pending retry is given up instead of waiting for the backoff
+	close(stop)
+	select {
+	case err := <-sent:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not interrupt the retry")
+	}
+	<-m.Done()
+}
+
+func TestSendMessage_Envelope(t *testing.T) {
+	srv := newFakeServer(t, "AUTH PLAIN")
+	srv.requireAuth = true
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.User, cfg.Password, cfg.AuthType = "user", "secret", AuthPlain
+	cfg.CC, cfg.BCC = []string{"cc@example.com"}, []string{"bcc@example.com"}
+
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	_, err := m.SendMessage(&job.Message{Subject: "Termine", Text: "Grüße\r\n.hidden\r\n"})
+	if !assert.NoError(t, err) || !assert.Len(t, srv.Received(), 1) {
+		return
+	}
+
+	received := srv.Received()[0]
+	assert.Equal(t, "from@example.com", received.From)
+	assert.Equal(t, []string{"to@example.com", "cc@example.com", "bcc@example.com"}, received.To)
+	assert.Equal(t, "PLAIN", received.Auth)
+	assert.Equal(t, "user", received.User)
+	assert.Equal(t, "secret", received.Password)
+
+	// blind copies are not disclosed by the headers
+	msg, err := netmail.ReadMessage(bytes.NewReader(received.Data))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Termine", msg.Header.Get("Subject"))
+		assert.Equal(t, "cc@example.com", msg.Header.Get("Cc"))
+		assert.Empty(t, msg.Header.Get("Bcc"))
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+		assert.NoError(t, err)
+		assert.Equal(t, "Grüße\r\n.hidden\r\n", string(body))
+	}
+}
@@ -0,0 +1,95 @@
+package mailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tokenSource fetches OAuth2 access tokens by the client credentials grant
+// tokens are cached and refreshed shortly before they expire
+type tokenSource struct {
+	cfg    Config
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newTokenSource(cfg Config) *tokenSource {
+	return &tokenSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Token returns a valid access token
+func (ts *tokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// refresh a minute early, so the token does not expire during authentication
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", ts.cfg.OAuthClientID)
+	form.Set("client_secret", ts.cfg.OAuthClientSecret)
+	if ts.cfg.OAuthScope != "" {
+		form.Set("scope", ts.cfg.OAuthScope)
+	}
+
+	resp, err := ts.client.PostForm(ts.cfg.OAuthTokenURL, form)
+	if err != nil {
+		return "", errors.Wrap(err, "could not request oauth token")
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrapf(err, "could not decode oauth token response (%s)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", errors.Errorf("oauth token request failed (%s): %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	ts.token = body.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// xoauth2Auth implements the XOAUTH2 authentication mechanism of Office 365 and Gmail
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing XOAUTH2 authentication over unencrypted connection")
+	}
+	return "XOAUTH2", []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// the server sends a json error as challenge, an empty response gets the final error reply
+	return []byte{}, errors.Errorf("xoauth2 authentication failed: %s", strings.TrimSpace(string(fromServer)))
+}
@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenSource(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "secret", r.FormValue("client_secret"))
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, n)
+	}))
+	defer srv.Close()
+
+	ts := newTokenSource(Config{OAuthTokenURL: srv.URL, OAuthClientID: "id", OAuthClientSecret: "secret"})
+
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+
+	// cached until shortly before expiry
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// refreshed within a minute before expiry
+	ts.expiry = time.Now().Add(30 * time.Second)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token2", token)
+}
+
+func TestTokenSource_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad secret"}`)
+	}))
+	defer srv.Close()
+
+	_, err := newTokenSource(Config{OAuthTokenURL: srv.URL}).Token()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid_client bad secret")
+	}
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	a := &xoauth2Auth{"user@example.com", "token"}
+
+	mech, resp, err := a.Start(&smtp.ServerInfo{TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", mech)
+	assert.Equal(t, "user=user@example.com\x01auth=Bearer token\x01\x01", string(resp))
+
+	_, _, err = a.Start(&smtp.ServerInfo{TLS: false})
+	assert.Error(t, err)
+}
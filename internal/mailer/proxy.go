@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	// x/net/proxy only knows socks5, http proxies tunnel by CONNECT
+	proxy.RegisterDialerType("http", func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return &httpProxy{addr: u.Host, user: u.User, forward: forward}, nil
+	})
+}
+
+// proxyDialer returns the dialer of smtp connections through the proxy given by the url
+// without a url ALL_PROXY and NO_PROXY of the environment apply, connections are direct if none is set
+func proxyDialer(rawurl string, forward *net.Dialer) (proxy.ContextDialer, error) {
+	var d proxy.Dialer
+	if rawurl == "" {
+		d = proxy.FromEnvironmentUsing(forward)
+	} else {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse smtp proxy url")
+		}
+		if d, err = proxy.FromURL(u, forward); err != nil {
+			return nil, errors.Wrap(err, "could not create smtp proxy dialer")
+		}
+	}
+
+	// the socks5, per host and direct dialers support contexts
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd, nil
+	}
+	return nil, errors.Errorf("smtp proxy dialer %T does not support contexts", d)
+}
+
+// httpProxy tunnels connections through an http proxy by CONNECT
+type httpProxy struct {
+	addr    string
+	user    *url.Userinfo
+	forward proxy.Dialer
+}
+
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the proxy and requests a tunnel to addr, the deadline of ctx bounds the handshake
+func (p *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if cd, ok := p.forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, network, p.addr)
+	} else {
+		conn, err = p.forward.Dial(network, p.addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to http proxy")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.user != nil {
+		password, _ := p.user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not request http proxy tunnel")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not read http proxy response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("http proxy refused tunnel to %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// the greeting of the smtp server may have been read along with the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what got buffered before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
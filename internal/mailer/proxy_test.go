@@ -0,0 +1,163 @@
+package mailer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy tunnels every connection to the smtp server, recording the requested addresses
+type fakeProxy struct {
+	listener net.Listener
+	target   string
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func newFakeProxy(t *testing.T, target string, handshake func(*fakeProxy, net.Conn) error) *fakeProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	p := &fakeProxy{listener: l, target: target}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := handshake(p, conn); err != nil {
+					return
+				}
+				upstream, err := net.Dial("tcp", p.target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) request(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requested = append(p.requested, addr)
+}
+
+func (p *fakeProxy) Requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.requested...)
+}
+
+// socks5Handshake accepts a connect request without authentication like rfc 1928 describes
+func socks5Handshake(p *fakeProxy, conn net.Conn) error {
+	buf := make([]byte, 256)
+	// version, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+
+	// version, command, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return err
+		}
+		host = string(buf[:n])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	p.request(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))))
+
+	_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// connectHandshake accepts an http CONNECT request
+func connectHandshake(p *fakeProxy, conn net.Conn) error {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	p.request(req.Method + " " + req.Host + " " + req.Header.Get("Proxy-Authorization"))
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return err
+}
+
+func TestDialer_Proxy(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.startTLS, srv.requireTLS = true, true
+	defer srv.Close()
+
+	socks := newFakeProxy(t, srv.listener.Addr().String(), socks5Handshake)
+	defer socks.listener.Close()
+	connect := newFakeProxy(t, srv.listener.Addr().String(), connectHandshake)
+	defer connect.listener.Close()
+
+	for _, proxyURL := range []string{
+		"socks5://" + socks.listener.Addr().String(),
+		"http://user:secret@" + connect.listener.Addr().String(),
+	} {
+		// the name only resolves at the proxy, so connecting directly would fail
+		cfg := srv.config()
+		cfg.Server, cfg.Port = "smtp.invalid", 587
+		cfg.Encryption, cfg.InsecureSkipVerify = EncryptionStartTLS, true
+		cfg.Proxy = proxyURL
+
+		s, err := newDialer(cfg, nil).Dial()
+		if !assert.NoError(t, err, proxyURL) {
+			continue
+		}
+		_, err = s.Send("from@example.com", []string{"to@example.com"}, strings.NewReader("Subject: test\r\n\r\ntest\r\n"))
+		assert.NoError(t, err, proxyURL)
+		assert.NoError(t, s.Close(), proxyURL)
+	}
+
+	assert.Equal(t, []string{"smtp.invalid:587"}, socks.Requested())
+	assert.Equal(t, []string{"CONNECT smtp.invalid:587 Basic dXNlcjpzZWNyZXQ="}, connect.Requested())
+	// tls got applied within the tunnels
+	if assert.Len(t, srv.Received(), 2) {
+		assert.True(t, srv.Received()[0].TLS)
+		assert.True(t, srv.Received()[1].TLS)
+	}
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket shared by all workers
+// the bucket holds up to burst tokens and refills at rate tokens per second
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter starting with a full bucket, nil if rate is not positive
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available, a nil limiter never blocks
+func (l *limiter) Wait() {
+	if l == nil {
+		return
+	}
+	time.Sleep(l.reserve(time.Now()))
+}
+
+// reserve takes a token and returns how long to wait until it is available
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// tokens go negative for waiting reservations, so later callers queue up behind them
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
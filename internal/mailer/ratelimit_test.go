@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+
+	cfg := srv.config()
+	cfg.RateLimit = 20
+	cfg.Burst = 2
+
+	m := New(cfg)
+	stop := make(chan struct{})
+	if !assert.NoError(t, m.Run(stop)) {
+		return
+	}
+	defer func() {
+		close(stop)
+		<-m.Done()
+	}()
+
+	// the burst is sent at once, the remaining messages at the rate
+	const n = 6
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		_, err := m.SendMessage(&job.Message{Subject: "test", Text: "test"})
+		assert.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+
+	assert.Equal(t, n, srv.Messages())
+	assert.True(t, elapsed >= time.Duration(n-cfg.Burst)*time.Second/20, "elapsed %s", elapsed)
+}
+
+func TestLimiter_Reserve(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(2, 1)
+	l.last = now
+
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	// waiting reservations queue up
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now))
+	assert.Equal(t, time.Second, l.reserve(now))
+	// the bucket refills over time, but never beyond the burst
+	assert.Equal(t, time.Duration(0), l.reserve(now.Add(10*time.Second)))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now.Add(10*time.Second)))
+
+	assert.Nil(t, newLimiter(0, 1))
+}
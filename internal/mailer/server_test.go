@@ -0,0 +1,386 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal smtp server accepting every message
+// it captures the envelope, the data and the authentication of every message, so tests can assert what has been sent
+type fakeServer struct {
+	listener net.Listener
+	// extensions are advertised in the EHLO reply
+	extensions []string
+	// rejectAuth fails every AUTH command like a wrong password
+	rejectAuth bool
+	// startTLS advertises STARTTLS and upgrades the connection by a self-signed certificate
+	startTLS bool
+	// requireTLS and requireAuth reject MAIL before STARTTLS or a successful AUTH
+	requireTLS  bool
+	requireAuth bool
+
+	mu       sync.Mutex
+	received []*fakeMessage
+	commands []string
+	// script holds replies replacing the usual ones, consumed in order per command
+	script map[string][]string
+}
+
+// fakeMessage is a message received by the fake server
+type fakeMessage struct {
+	From string
+	To   []string
+	// Data is the message as sent after DATA, with dot-stuffing removed
+	Data []byte
+	// Auth is the mechanism the session authenticated by, empty if unauthenticated
+	// User and Password are the credentials sent, Password is empty for CRAM-MD5
+	Auth     string
+	User     string
+	Password string
+	// TLS is set if the session got upgraded by STARTTLS
+	TLS bool
+}
+
+// fakeSession holds the state of a connection
+type fakeSession struct {
+	tls  bool
+	auth string
+	user string
+	pass string
+	msg  *fakeMessage
+}
+
+func newFakeServer(t *testing.T, extensions ...string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	srv := &fakeServer{listener: l, extensions: extensions}
+	go srv.serve()
+	return srv
+}
+
+// config returns a mailer config sending to the server
+func (srv *fakeServer) config() Config {
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	return Config{
+		Server:     "127.0.0.1",
+		Port:       p,
+		Encryption: EncryptionNone,
+		From:       "from@example.com",
+		To:         []string{"to@example.com"},
+	}
+}
+
+func (srv *fakeServer) Close() {
+	srv.listener.Close()
+}
+
+// Messages returns the number of accepted messages
+func (srv *fakeServer) Messages() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return len(srv.received)
+}
+
+// Received returns the accepted messages in order
+func (srv *fakeServer) Received() []*fakeMessage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return append([]*fakeMessage(nil), srv.received...)
+}
+
+// Script replies to the next commands by the given replies instead of the usual ones
+// "GREETING" scripts the greeting of the next connections, the connection is closed after a 4xx or 5xx greeting
+func (srv *fakeServer) Script(cmd string, replies ...string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.script == nil {
+		srv.script = make(map[string][]string)
+	}
+	srv.script[cmd] = append(srv.script[cmd], replies...)
+}
+
+// scripted returns the next scripted reply of the command
+func (srv *fakeServer) scripted(cmd string) (string, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	replies := srv.script[cmd]
+	if len(replies) == 0 {
+		return "", false
+	}
+	srv.script[cmd] = replies[1:]
+	return replies[0], true
+}
+
+// Commands returns the received commands
+func (srv *fakeServer) Commands() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return append([]string(nil), srv.commands...)
+}
+
+func (srv *fakeServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *fakeServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+
+	if greeting, ok := srv.scripted("GREETING"); ok {
+		reply(greeting)
+		if !strings.HasPrefix(greeting, "2") {
+			return
+		}
+	} else {
+		reply("220 localhost ESMTP")
+	}
+
+	session := &fakeSession{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		cmd := ""
+		if len(fields) > 0 {
+			cmd = strings.ToUpper(fields[0])
+		}
+
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, line)
+		srv.mu.Unlock()
+
+		if scripted, ok := srv.scripted(cmd); ok {
+			reply(scripted)
+			continue
+		}
+
+		switch cmd {
+		case "EHLO":
+			lines := []string{"250-localhost"}
+			if srv.startTLS && !session.tls {
+				lines = append(lines, "250-STARTTLS")
+			}
+			for _, ext := range srv.extensions {
+				lines = append(lines, "250-"+ext)
+			}
+			reply(append(lines, "250 8BITMIME")...)
+		case "STARTTLS":
+			if !srv.startTLS || session.tls {
+				reply("502 5.5.1 STARTTLS not available")
+				continue
+			}
+			reply("220 2.0.0 ready to start TLS")
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{fakeCertificate()}})
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			// the session starts over after the upgrade
+			conn, r = tlsConn, bufio.NewReader(tlsConn)
+			session = &fakeSession{tls: true}
+		case "AUTH":
+			if srv.rejectAuth {
+				reply("535 5.7.8 authentication credentials invalid")
+				continue
+			}
+			if !srv.authenticate(session, fields[1:], r, reply) {
+				return
+			}
+		case "MAIL":
+			if srv.requireTLS && !session.tls {
+				reply("530 5.7.0 must issue a STARTTLS command first")
+				continue
+			}
+			if srv.requireAuth && session.auth == "" {
+				reply("530 5.7.0 authentication required")
+				continue
+			}
+			session.msg = &fakeMessage{
+				From:     fakeAddress(line),
+				Auth:     session.auth,
+				User:     session.user,
+				Password: session.pass,
+				TLS:      session.tls,
+			}
+			reply("250 ok")
+		case "RCPT":
+			if session.msg == nil {
+				reply("503 5.5.1 MAIL first")
+				continue
+			}
+			session.msg.To = append(session.msg.To, fakeAddress(line))
+			reply("250 ok")
+		case "DATA":
+			if session.msg == nil || len(session.msg.To) == 0 {
+				reply("503 5.5.1 RCPT first")
+				continue
+			}
+			reply("354 go ahead")
+			data := new(bytes.Buffer)
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			session.msg.Data = data.Bytes()
+			srv.mu.Lock()
+			srv.received = append(srv.received, session.msg)
+			srv.mu.Unlock()
+			session.msg = nil
+			reply("250 queued")
+		case "RSET":
+			session.msg = nil
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// authenticate runs the AUTH exchange of the mechanism, it returns false if the connection broke
+func (srv *fakeServer) authenticate(session *fakeSession, args []string, r *bufio.Reader, reply func(...string)) bool {
+	if len(args) == 0 {
+		reply("501 5.5.4 mechanism required")
+		return true
+	}
+
+	// response returns the initial response of the AUTH command once, then asks for the next one by the challenge
+	initial := args[1:]
+	response := func(challenge string) (string, bool) {
+		if len(initial) > 0 {
+			b, _ := base64.StdEncoding.DecodeString(initial[0])
+			initial = nil
+			return string(b), true
+		}
+		reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", false
+		}
+		b, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		return string(b), true
+	}
+
+	mech := strings.ToUpper(args[0])
+	switch mech {
+	case "PLAIN":
+		resp, ok := response("")
+		if !ok {
+			return false
+		}
+		// authorization identity, user and password separated by NUL
+		parts := strings.SplitN(resp, "\x00", 3)
+		if len(parts) != 3 {
+			reply("501 5.5.2 malformed PLAIN response")
+			return true
+		}
+		session.user, session.pass = parts[1], parts[2]
+	case "LOGIN":
+		user, ok := response("Username:")
+		if !ok {
+			return false
+		}
+		pass, ok := response("Password:")
+		if !ok {
+			return false
+		}
+		session.user, session.pass = user, pass
+	case "CRAM-MD5":
+		resp, ok := response("<1.1@localhost>")
+		if !ok {
+			return false
+		}
+		// user and hex digest of the challenge, the digest is not verified
+		session.user = strings.SplitN(resp, " ", 2)[0]
+	default:
+		reply("504 5.5.4 unrecognized authentication type")
+		return true
+	}
+
+	session.auth = mech
+	reply("235 2.7.0 authentication successful")
+	return true
+}
+
+// fakeAddress returns the address of a MAIL FROM or RCPT TO command
+func fakeAddress(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+var (
+	fakeCertOnce sync.Once
+	fakeCert     tls.Certificate
+)
+
+// fakeCertificate returns a self-signed certificate of 127.0.0.1, generated once
+func fakeCertificate() tls.Certificate {
+	fakeCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			panic(err)
+		}
+		fakeCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	return fakeCert
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// AppointmentsProcessed counts collected appointment changes
+	AppointmentsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emed_mailer_appointments_processed_total",
+		Help: "Total number of processed appointment changes.",
+	})
+
+	// RowsSkipped counts collected rows skipped as malformed, e.g. a NULL in a required column
+	RowsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emed_mailer_rows_skipped_total",
+		Help: "Total number of collected rows skipped as malformed.",
+	})
+
+	// EmailsSent counts delivered mails
+	EmailsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emed_mailer_emails_sent_total",
+		Help: "Total number of successfully sent emails.",
+	})
+
+	// EmailsFailed counts mails which could not be delivered
+	EmailsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emed_mailer_emails_failed_total",
+		Help: "Total number of emails which could not be sent.",
+	})
+
+	// JobDuration observes the duration of job runs
+	JobDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "emed_mailer_job_duration_seconds",
+		Help:    "Duration of job runs in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
@@ -0,0 +1,166 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mask is the replacement of redacted secrets
+const Mask = "******"
+
+// variants returns the secret as it may appear in text, e.g. escaped within a DSN or a json log line
+// longer variants come first, so a variant containing another one gets masked as a whole
+func variants(secrets []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		for _, variant := range []string{
+			secret,
+			url.QueryEscape(secret),
+			url.PathEscape(secret),
+			jsonEscape(secret, false),
+			jsonEscape(secret, true),
+			jsonMarshal(secret),
+		} {
+			if !seen[variant] {
+				seen[variant] = true
+				result = append(result, variant)
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i]) > len(result[j])
+	})
+	return result
+}
+
+// jsonEscape escapes the secret like zerolog writes strings, ascii escapes non-ASCII characters too
+func jsonEscape(secret string, ascii bool) string {
+	var b strings.Builder
+	for i, r := range secret {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case r == utf8.RuneError && !strings.HasPrefix(secret[i:], string(utf8.RuneError)):
+			// invalid utf-8 gets replaced
+			b.WriteString(`\ufffd`)
+		case ascii && r >= utf8.RuneSelf:
+			// characters beyond the basic plane are written as surrogate pairs
+			if r > 0xffff {
+				r -= 0x10000
+				fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+				continue
+			}
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// jsonMarshal escapes the secret like encoding/json, which escapes html characters too
+func jsonMarshal(secret string) string {
+	quoted, err := json.Marshal(secret)
+	if err != nil {
+		return secret
+	}
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// String replaces all occurrences of the secrets in `s`
+func String(s string, secrets ...string) string {
+	for _, secret := range variants(secrets) {
+		s = strings.Replace(s, secret, Mask, -1)
+	}
+	return s
+}
+
+// Value masks a secret value, empty values stay empty to show they are unset
+func Value(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Mask
+}
+
+// Writer redacts secrets from everything written to the underlying writer
+type Writer struct {
+	w io.Writer
+	// mu guards secrets, which get added on reload
+	mu      sync.RWMutex
+	known   []string
+	secrets [][]byte
+}
+
+// NewWriter wraps `w` redacting the given secrets
+func NewWriter(w io.Writer, secrets ...string) *Writer {
+	rw := &Writer{w: w}
+	rw.AddSecrets(secrets...)
+	return rw
+}
+
+// AddSecrets redacts the secrets in addition to the previous ones, e.g. after the configuration got reloaded
+// previous secrets stay redacted, as connections opened before the reload may still log them
+func (rw *Writer) AddSecrets(secrets ...string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	for _, secret := range secrets {
+		if !contains(rw.known, secret) {
+			rw.known = append(rw.known, secret)
+		}
+	}
+	rw.secrets = nil
+	for _, secret := range variants(rw.known) {
+		rw.secrets = append(rw.secrets, []byte(secret))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes p with all secrets masked
+// it reports len(p) on success, as the caller is not aware of the replacement
+func (rw *Writer) Write(p []byte) (int, error) {
+	rw.mu.RLock()
+	out := p
+	for _, secret := range rw.secrets {
+		out = bytes.Replace(out, secret, []byte(Mask), -1)
+	}
+	rw.mu.RUnlock()
+
+	if _, err := rw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,73 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestString(t *testing.T) {
+	err := errors.New("could not connect to sqlserver://user:p%40ss%2Fword@db:1433 using p@ss/word")
+
+	s := String(fmt.Sprintf("%+v", err), "p@ss/word", "")
+	assert.NotContains(t, s, "p@ss/word")
+	assert.NotContains(t, s, "p%40ss%2Fword")
+	assert.Contains(t, s, Mask)
+}
+
+func TestWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, "secret")
+
+	msg := []byte(`{"level":"error","error":"auth failed for secret"}`)
+	n, err := w.Write(msg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, len(msg), n)
+	assert.Equal(t, `{"level":"error","error":"auth failed for ******"}`, buf.String())
+}
+
+func TestWriter_AddSecrets(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, "old-secret")
+
+	// secrets of a reloaded configuration are redacted alongside the previous ones
+	w.AddSecrets("new-secret")
+	_, err := w.Write([]byte("old-secret new-secret"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "****** ******", buf.String())
+}
+
+func TestWriter_JSONEscaped(t *testing.T) {
+	for _, secret := range []string{`pa"ss`, `pa\ss`, "pa\nss", "pässwörd", "p<a>&ss"} {
+		t.Run(secret, func(t *testing.T) {
+			// the json log escapes quotes, backslashes and control characters of the secret
+			buf := new(bytes.Buffer)
+			logger := zerolog.New(NewWriter(buf, secret))
+			logger.Error().
+				Str("password", secret).
+				Msg("auth failed")
+			assert.Equal(t, `{"level":"error","password":"******","message":"auth failed"}`+"\n", buf.String())
+
+			// encoding/json escapes html characters too
+			buf.Reset()
+			quoted, err := json.Marshal(secret)
+			assert.NoError(t, err)
+			_, err = NewWriter(buf, secret).Write(quoted)
+			assert.NoError(t, err)
+			assert.Equal(t, `"******"`, buf.String())
+
+			// as do encoders escaping non-ASCII characters
+			buf.Reset()
+			_, err = NewWriter(buf, secret).Write([]byte(jsonEscape(secret, true)))
+			assert.NoError(t, err)
+			assert.Equal(t, Mask, buf.String())
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Check reports why a dependency is not ready, nil if it is
+type Check func(context.Context) error
+
+// Status returns the status of the last run served by /status, and why it is unhealthy, nil if it is healthy
+type Status func() (interface{}, error)
+
+// Redact returns the message of the error without secrets, e.g. the token of a webhook url
+type Redact func(error) string
+
+// Server serves the health and metrics endpoints
+// /healthz reports the process is up, /readyz runs the readiness checks
+// and /metrics exposes the prometheus metrics
+type Server struct {
+	srv    *http.Server
+	mux    *http.ServeMux
+	checks map[string]Check
+	status Status
+	redact Redact
+}
+
+// New creates a Server listening on `addr`
+// the endpoints are unauthenticated, so failed checks are reported by the message `redact` returns
+func New(addr string, checks map[string]Check, redact Redact) *Server {
+	mux := http.NewServeMux()
+	s := &Server{
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		},
+		mux:    mux,
+		checks: checks,
+		redact: redact,
+	}
+
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return s
+}
+
+// EnablePprof serves the pprof profiles below /debug/pprof/
+// profiles reveal internals of the process, so the server must not be reachable publicly
+func (s *Server) EnablePprof() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// EnableStatus serves the status of the last run as JSON below /status
+// an unhealthy status responds 503, e.g. to alert on failed or stale runs
+func (s *Server) EnableStatus(status Status) {
+	s.status = status
+	s.mux.HandleFunc("/status", s.runStatus)
+}
+
+// Run starts listening and serves requests in background
+func (s *Server) Run() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on %s", s.srv.Addr)
+	}
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error().
+				Err(err).
+				Msg("http server failed")
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the server gracefully
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errors.Wrap(s.srv.Shutdown(ctx), "could not shutdown http server")
+}
+
+type status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &status{Status: "ok"})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	code := http.StatusOK
+	resp := &status{
+		Status: "ok",
+		Checks: make(map[string]string, len(s.checks)),
+	}
+	for _, name := range names {
+		if err := s.checks[name](ctx); err != nil {
+			log.Warn().
+				Err(err).
+				Str("check", name).
+				Msg("readiness check failed")
+
+			code = http.StatusServiceUnavailable
+			resp.Status = "unavailable"
+			resp.Checks[name] = s.redact(err)
+			continue
+		}
+		resp.Checks[name] = "ok"
+	}
+
+	writeJSON(w, code, resp)
+}
+
+func (s *Server) runStatus(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.status()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("last run is unhealthy")
+
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().
+			Err(err).
+			Msg("could not write response")
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func redactSecret(err error) string {
+	return strings.Replace(err.Error(), "secret", "******", -1)
+}
+
+func serve(s *Server, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestServer_Healthz(t *testing.T) {
+	// the process being up is enough, checks are not run
+	s := New(":0", map[string]Check{
+		"db": func(context.Context) error { return errors.New("down") },
+	}, redactSecret)
+
+	rec := serve(s, "/healthz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestServer_Readyz(t *testing.T) {
+	var order []string
+	check := func(name string, err error) Check {
+		return func(context.Context) error {
+			order = append(order, name)
+			return err
+		}
+	}
+
+	s := New(":0", map[string]Check{
+		"smtp": check("smtp", nil),
+		"db":   check("db", nil),
+	}, redactSecret)
+
+	rec := serve(s, "/readyz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok","checks":{"db":"ok","smtp":"ok"}}`, rec.Body.String())
+	// checks run sorted by name
+	assert.Equal(t, []string{"db", "smtp"}, order)
+
+	order = nil
+	s = New(":0", map[string]Check{
+		"webhook": check("webhook", errors.New("post https://example.com/hook?token=secret failed")),
+		"db":      check("db", nil),
+		"smtp":    check("smtp", errors.New("connection refused")),
+	}, redactSecret)
+
+	// a failing check makes the process unavailable, the others are still reported
+	rec = serve(s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, `{"status":"unavailable","checks":{"db":"ok","smtp":"connection refused","webhook":"post https://example.com/hook?token=****** failed"}}`+"\n", rec.Body.String())
+	assert.Equal(t, []string{"db", "smtp", "webhook"}, order)
+
+	var resp status
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(t, resp.Checks, 3)
+}
+
+func TestServer_Pprof(t *testing.T) {
+	s := New(":0", nil, redactSecret)
+
+	// profiles are only served once enabled
+	assert.Equal(t, http.StatusNotFound, serve(s, "/debug/pprof/").Code)
+	assert.Equal(t, http.StatusNotFound, serve(s, "/debug/pprof/cmdline").Code)
+
+	s.EnablePprof()
+	assert.Equal(t, http.StatusOK, serve(s, "/debug/pprof/").Code)
+	assert.Equal(t, http.StatusOK, serve(s, "/debug/pprof/cmdline").Code)
+}
+
+func TestServer_Status(t *testing.T) {
+	started := time.Now().Add(-time.Hour)
+	lastSuccess := time.Now().Add(-20 * time.Minute)
+	stats := job.Stats{
+		LastRun:     time.Now().Add(-10 * time.Minute),
+		LastResult:  job.RunResult{Collected: 3, Sent: 3, Duration: time.Second},
+		LastSuccess: lastSuccess,
+	}
+
+	s := New(":0", nil, redactSecret)
+	s.EnableStatus(func() (interface{}, error) {
+		return NewRunStatus(stats, started, 30*time.Minute, redactSecret)
+	})
+
+	rec := serve(s, "/status")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp RunStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, 3, resp.Sent)
+	assert.Equal(t, "1s", resp.Duration)
+	if assert.NotNil(t, resp.LastSuccess) {
+		assert.True(t, lastSuccess.Equal(*resp.LastSuccess))
+	}
+
+	// a failed run is unhealthy, its error is redacted
+	stats.LastResult = job.RunResult{Collected: 2, Sent: 1, Failed: 1, Err: errors.New("post https://example.com/hook?token=secret failed")}
+	rec = serve(s, "/status")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	resp = RunStatus{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "failed", resp.Status)
+	assert.Equal(t, 1, resp.Failed)
+	assert.Equal(t, "post https://example.com/hook?token=****** failed", resp.Error)
+	assert.NotContains(t, rec.Body.String(), "secret")
+	// the last success tells since when runs fail
+	assert.Contains(t, rec.Body.String(), `"last_success":`)
+
+	// no run finished within the max age
+	stats.LastRun = time.Now().Add(-time.Hour)
+	stats.LastResult = job.RunResult{}
+	rec = serve(s, "/status")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	resp = RunStatus{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "stale", resp.Status)
+	assert.Empty(t, resp.Error)
+	assert.Contains(t, rec.Body.String(), `"last_success":`)
+}
+
+func TestNewRunStatus_Started(t *testing.T) {
+	// until the first run finished, the start of the process counts
+	resp, err := NewRunStatus(job.Stats{}, time.Now(), time.Minute, redactSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Nil(t, resp.LastRun)
+	assert.Nil(t, resp.LastSuccess)
+
+	resp, err = NewRunStatus(job.Stats{}, time.Now().Add(-time.Hour), time.Minute, redactSecret)
+	assert.EqualError(t, err, "no run finished within 1m0s")
+	assert.Equal(t, "stale", resp.Status)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+)
+
+// RunStatus is the status of the last run served by /status
+type RunStatus struct {
+	// Status is ok, failed if the last run failed, or stale if no run finished within the max age
+	Status      string     `json:"status"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Collected   int        `json:"collected"`
+	Sent        int        `json:"sent"`
+	Failed      int        `json:"failed"`
+	Duration    string     `json:"duration,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// NewRunStatus returns the status of the last run, unhealthy if it failed or no run finished within maxAge
+// started is the start of the process, which counts as last run until the first one finished
+func NewRunStatus(stats job.Stats, started time.Time, maxAge time.Duration, redact Redact) (*RunStatus, error) {
+	resp := &RunStatus{
+		Status:    "ok",
+		Collected: stats.LastResult.Collected,
+		Sent:      stats.LastResult.Sent,
+		Failed:    stats.LastResult.Failed,
+	}
+	if !stats.LastRun.IsZero() {
+		resp.LastRun = &stats.LastRun
+		resp.Duration = stats.LastResult.Duration.String()
+	}
+	if !stats.LastSuccess.IsZero() {
+		resp.LastSuccess = &stats.LastSuccess
+	}
+
+	if err := stats.LastResult.Err; err != nil {
+		resp.Status = "failed"
+		// /status is unauthenticated, and errors of webhooks contain the url with its token
+		resp.Error = redact(err)
+		return resp, errors.Wrap(err, "last run failed")
+	}
+
+	last := stats.LastRun
+	if last.IsZero() {
+		last = started
+	}
+	if age := time.Since(last); age > maxAge {
+		resp.Status = "stale"
+		return resp, errors.Errorf("no run finished within %s", maxAge)
+	}
+
+	return resp, nil
+}
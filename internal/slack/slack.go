@@ -0,0 +1,237 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+	"github.com/emed-appts/emed-mailer/internal/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ColorBooked marks the attachments of bookings
+	ColorBooked = "#2eb67d"
+	// ColorCancelled marks the attachments of cancellations
+	ColorCancelled = "#e01e5a"
+)
+
+// Config struct encapsulate all settings for the slack notifier
+type Config struct {
+	// WebhookURL is the incoming webhook of the channel receiving a message per change
+	WebhookURL string
+	Timeout    time.Duration
+
+	// MaxRetries of temporary failures, waiting RetryBackoff before the first retry and doubling it afterwards
+	// a Retry-After of rate limited requests takes precedence over the backoff
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Interval is the minimum delay between two messages, slack allows about one message per second
+	Interval time.Duration
+
+	// DryRun logs the messages instead of posting them
+	DryRun bool
+}
+
+// Message is the JSON body posted per change, the text is the fallback of notifications
+type Message struct {
+	Text        string        `json:"text"`
+	Attachments []*Attachment `json:"attachments"`
+}
+
+// Attachment shows the blocks with a bar colored by the change type
+type Attachment struct {
+	Color  string   `json:"color"`
+	Blocks []*Block `json:"blocks"`
+}
+
+// Block is a Block Kit layout block, e.g. a header or a section of fields
+type Block struct {
+	Type   string  `json:"type"`
+	Text   *Text   `json:"text,omitempty"`
+	Fields []*Text `json:"fields,omitempty"`
+}
+
+// Text is a Block Kit text object, either plain_text or mrkdwn
+type Text struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type notifier struct {
+	cfg    Config
+	client *http.Client
+	// last is when the previous message got posted
+	last time.Time
+}
+
+// New creates a Notifier posting every change as Block Kit message to the configured webhook
+func New(cfg Config) job.Notifier {
+	return &notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// Name returns slack
+func (notifier *notifier) Name() string {
+	return "slack"
+}
+
+// Notify posts the changes one by one, at most one per Interval
+// if a change fails, the changes posted before are reported by a *job.PartialError
+func (notifier *notifier) Notify(ctx context.Context, lastRun time.Time, changes []*job.ApptChange) error {
+	notified := make([]*job.ApptChange, 0, len(changes))
+	for _, change := range changes {
+		body, err := json.Marshal(message(change))
+		if err != nil {
+			return &job.PartialError{Notified: notified, Err: errors.Wrap(err, "could not encode slack message")}
+		}
+
+		if notifier.cfg.DryRun {
+			job.Logger(ctx).Info().
+				RawJSON("message", body).
+				Msg("dry run, slack message not posted")
+		} else if err := notifier.deliver(ctx, body); err != nil {
+			return &job.PartialError{Notified: notified, Err: err}
+		}
+		notified = append(notified, change)
+	}
+	return nil
+}
+
+// message formats the change as header and fields, colored by the change type
+func message(change *job.ApptChange) *Message {
+	title, color := "Appointment booked", ColorBooked
+	if !change.IsBooking {
+		title, color = "Appointment cancelled", ColorCancelled
+	}
+
+	fields := []*Text{
+		field("Patient", change.PatientName),
+		field("Appointment", template.FormatTime(change.Appointment)),
+	}
+	if change.Provider != "" {
+		fields = append(fields, field("Provider", change.Provider))
+	}
+	if change.Location != "" {
+		fields = append(fields, field("Location", change.Location))
+	}
+	if !change.PreviousAppointment.IsZero() {
+		fields = append(fields, field("Previous appointment", template.FormatTime(change.PreviousAppointment)))
+	}
+
+	return &Message{
+		Text: fmt.Sprintf("%s: %s, %s", title, change.PatientName, template.FormatTime(change.Appointment)),
+		Attachments: []*Attachment{{
+			Color: color,
+			Blocks: []*Block{
+				{Type: "header", Text: &Text{Type: "plain_text", Text: title}},
+				{Type: "section", Fields: fields},
+			},
+		}},
+	}
+}
+
+// field formats a labeled value, escaping the control characters of mrkdwn
+func field(label, value string) *Text {
+	value = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(value)
+	return &Text{Type: "mrkdwn", Text: "*" + label + "*\n" + value}
+}
+
+// deliver posts the body after the interval passed, retrying temporary failures
+func (notifier *notifier) deliver(ctx context.Context, body []byte) error {
+	backoff := notifier.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := notifier.wait(ctx, notifier.cfg.Interval-time.Since(notifier.last)); err != nil {
+			return errors.Wrap(err, "could not post slack message")
+		}
+		err := notifier.post(ctx, body)
+		notifier.last = time.Now()
+		if err == nil {
+			return nil
+		}
+		if !isTemporary(err) || attempt > notifier.cfg.MaxRetries {
+			return errors.Wrap(err, "could not post slack message")
+		}
+
+		delay := backoff
+		if retryAfter := err.(*temporaryError).retryAfter; retryAfter > 0 {
+			delay = retryAfter
+		}
+		job.Logger(ctx).Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Dur("backoff", delay).
+			Msg("could not post slack message, retrying")
+
+		if err := notifier.wait(ctx, delay); err != nil {
+			return errors.Wrap(err, "could not post slack message")
+		}
+		backoff *= 2
+	}
+}
+
+// wait sleeps for d unless ctx is done before
+func (notifier *notifier) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (notifier *notifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, notifier.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifier.client.Do(req)
+	if err != nil {
+		return &temporaryError{error: err}
+	}
+	defer resp.Body.Close()
+	// slack explains rejections in the body, e.g. invalid_blocks
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(reason)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &temporaryError{error: err, retryAfter: time.Duration(seconds) * time.Second}
+	}
+	if resp.StatusCode >= 500 {
+		return &temporaryError{error: err}
+	}
+	return err
+}
+
+// temporaryError marks failures worth a retry, e.g. network errors, server errors or rate limits
+type temporaryError struct {
+	error
+	// retryAfter is the delay requested by a rate limited response
+	retryAfter time.Duration
+}
+
+func isTemporary(err error) bool {
+	_, ok := err.(*temporaryError)
+	return ok
+}
@@ -0,0 +1,88 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	appt := time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)
+
+	msg := message(&job.ApptChange{Appointment: appt, PatientName: "Lastname <Firstname>", IsBooking: true, Provider: "Dr. Huber"})
+	assert.Equal(t, "Appointment booked: Lastname <Firstname>, 12.10.2026 09:30", msg.Text)
+	if assert.Len(t, msg.Attachments, 1) && assert.Len(t, msg.Attachments[0].Blocks, 2) {
+		assert.Equal(t, ColorBooked, msg.Attachments[0].Color)
+		assert.Equal(t, "header", msg.Attachments[0].Blocks[0].Type)
+		assert.Equal(t, []*Text{
+			{Type: "mrkdwn", Text: "*Patient*\nLastname &lt;Firstname&gt;"},
+			{Type: "mrkdwn", Text: "*Appointment*\n12.10.2026 09:30"},
+			{Type: "mrkdwn", Text: "*Provider*\nDr. Huber"},
+		}, msg.Attachments[0].Blocks[1].Fields)
+	}
+
+	msg = message(&job.ApptChange{Appointment: appt, PatientName: "Lastname Firstname"})
+	assert.Equal(t, ColorCancelled, msg.Attachments[0].Color)
+	assert.Equal(t, "Appointment cancelled", msg.Attachments[0].Blocks[0].Text.Text)
+	assert.Len(t, msg.Attachments[0].Blocks[1].Fields, 2)
+}
+
+func TestNotify(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request is rate limited and gets retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		msg := &Message{}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(msg))
+		assert.Contains(t, msg.Text, "Appointment booked")
+	}))
+	defer srv.Close()
+
+	n := New(Config{WebhookURL: srv.URL, Timeout: time.Second, MaxRetries: 1, Interval: 50 * time.Millisecond})
+	start := time.Now()
+	err := n.Notify(context.Background(), time.Now(), []*job.ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1, PatientName: "Firstname Lastname", IsBooking: true},
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 2, PatientName: "Firstname Lastname", IsBooking: true},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	// the messages are posted one interval apart
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestNotify_Rejected(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// client errors are not retried
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid_blocks"))
+	}))
+	defer srv.Close()
+
+	n := New(Config{WebhookURL: srv.URL, Timeout: time.Second, MaxRetries: 3})
+	err := n.Notify(context.Background(), time.Now(), []*job.ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1},
+	})
+
+	if assert.IsType(t, &job.PartialError{}, err) {
+		assert.Empty(t, err.(*job.PartialError).Notified)
+		assert.Contains(t, err.Error(), "400 Bad Request: invalid_blocks")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
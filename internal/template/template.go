@@ -3,8 +3,10 @@
 package template
 
 import (
-	"html/template"
-	"io"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"sync"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/gobuffalo/packr"
@@ -14,25 +16,93 @@ import (
 var (
 	box = packr.NewBox("../../templates")
 
-	funcMap = template.FuncMap{
-		"DateFmt": func(t time.Time) string {
-			return t.Format("02.01.2006 15:04")
-		},
+	funcMap = map[string]interface{}{
+		"formatTime": formatTime,
+		// DateFmt is kept for existing templates
+		"DateFmt": formatTime,
 	}
+
+	// timeMu guards the time format, which changes on reload
+	timeMu     sync.RWMutex
+	timeLayout = "02.01.2006 15:04"
+	timeLoc    *time.Location
 )
 
-// Execute executes the named template
-func Execute(wr io.Writer, name string, data interface{}) error {
-	msgTemplate, err := box.MustString(name)
+// SetTimeFormat sets the layout of FormatTime
+// times are converted to loc, unless loc is nil
+func SetTimeFormat(layout string, loc *time.Location) {
+	timeMu.Lock()
+	defer timeMu.Unlock()
+
+	timeLayout, timeLoc = layout, loc
+}
+
+// formatTime formats time.Time and *time.Time values, nil pointers and missing values as —
+func formatTime(value interface{}) string {
+	switch t := value.(type) {
+	case time.Time:
+		return FormatTime(t)
+	case *time.Time:
+		if t != nil {
+			return FormatTime(*t)
+		}
+	}
+	return "—"
+}
+
+// FormatTime formats the time by the configured layout, zero times as —
+// the collector returns the times of pds6 as instants in Europe/Vienna, so converting them keeps the wall clock right
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+
+	timeMu.RLock()
+	defer timeMu.RUnlock()
+
+	if timeLoc != nil {
+		t = t.In(timeLoc)
+	}
+	return t.Format(timeLayout)
+}
+
+// HTML parses a html template
+// the template file at `path` takes precedence over the embedded template `name`
+func HTML(name, path string) (*htmltemplate.Template, error) {
+	src, err := load(name, path)
 	if err != nil {
-		return errors.Wrap(err, "could not open template file")
+		return nil, errors.WithStack(err)
 	}
 
-	t, err := template.New("message").Funcs(funcMap).Parse(string(msgTemplate))
+	t, err := htmltemplate.New(name).Funcs(funcMap).Parse(src)
+	return t, errors.Wrap(err, "could not parse html template")
+}
+
+// Text parses a plain text template
+// the template file at `path` takes precedence over the embedded template `name`
+func Text(name, path string) (*texttemplate.Template, error) {
+	src, err := load(name, path)
 	if err != nil {
-		return errors.Wrap(err, "could not parse template")
+		return nil, errors.WithStack(err)
+	}
+
+	t, err := texttemplate.New(name).Funcs(funcMap).Parse(src)
+	return t, errors.Wrap(err, "could not parse text template")
+}
+
+// Inline parses a plain text template given as string, e.g. a mail subject
+// strings without template actions render as they are
+func Inline(name, src string) (*texttemplate.Template, error) {
+	t, err := texttemplate.New(name).Funcs(funcMap).Parse(src)
+	return t, errors.Wrapf(err, "could not parse %s template", name)
+}
+
+func load(name, path string) (string, error) {
+	if path != "" {
+		src, err := ioutil.ReadFile(path)
+		return string(src), errors.Wrapf(err, "could not read template file %s", path)
 	}
 
-	err = t.Execute(wr, data)
-	return errors.Wrap(err, "could not execute template")
+	src, err := box.MustString(name)
+	return src, errors.Wrapf(err, "could not open embedded template %s", name)
 }
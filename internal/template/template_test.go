@@ -0,0 +1,29 @@
+package template
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTime(t *testing.T) {
+	defer SetTimeFormat("02.01.2006 15:04", nil)
+
+	appt := time.Date(2026, 10, 5, 7, 30, 0, 0, time.UTC)
+	assert.Equal(t, "05.10.2026 07:30", FormatTime(appt))
+	assert.Equal(t, "—", FormatTime(time.Time{}))
+
+	// times are shown in the configured timezone
+	SetTimeFormat(time.RFC1123, time.FixedZone("CEST", 2*60*60))
+	assert.Equal(t, "Mon, 05 Oct 2026 09:30:00 CEST", FormatTime(appt))
+
+	// null times render like zero times
+	tmpl, err := Inline("subject", "{{ .Appt | formatTime }} {{ .Null | formatTime }} {{ .Missing | formatTime }}")
+	if assert.NoError(t, err) {
+		buf := new(strings.Builder)
+		assert.NoError(t, tmpl.Execute(buf, map[string]interface{}{"Appt": &appt, "Null": (*time.Time)(nil)}))
+		assert.Equal(t, "Mon, 05 Oct 2026 09:30:00 CEST — —", buf.String())
+	}
+}
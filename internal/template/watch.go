@@ -0,0 +1,49 @@
+package template
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watch detects changes of template files by their modification time
+type Watch struct {
+	mu     sync.Mutex
+	mtimes map[string]time.Time
+}
+
+// NewWatch returns a watch of the files at `paths`, empty paths are ignored
+func NewWatch(paths ...string) *Watch {
+	w := &Watch{mtimes: map[string]time.Time{}}
+	for _, path := range paths {
+		if path != "" {
+			w.mtimes[path] = modTime(path)
+		}
+	}
+	return w
+}
+
+// Changed reports whether any file changed since the last check
+// a file which can not be read counts as changed, so loading it reports the error
+func (w *Watch) Changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := false
+	for path, last := range w.mtimes {
+		mtime := modTime(path)
+		if !mtime.Equal(last) {
+			w.mtimes[path] = mtime
+			changed = true
+		}
+	}
+	return changed
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,38 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emed-mailer-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "changedappts.txt.tmpl")
+	if err := ioutil.WriteFile(path, []byte("{{ .PID }}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWatch(path, "")
+	assert.False(t, w.Changed())
+
+	// a change is reported once
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, w.Changed())
+	assert.False(t, w.Changed())
+
+	os.Remove(path)
+	assert.True(t, w.Changed())
+}
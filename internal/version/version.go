@@ -2,6 +2,7 @@ package version
 
 import (
 	"fmt"
+	"runtime"
 
 	"github.com/coreos/go-semver/semver"
 )
@@ -28,6 +29,9 @@ var (
 	// VersionDate indicates the build date.
 	VersionDate = "00000000"
 
+	// BuildTime indicates the build timestamp in RFC 3339.
+	BuildTime = ""
+
 	// Version is the version of the current implementation.
 	Version *semver.Version
 )
@@ -36,3 +40,21 @@ func init() {
 	Version = semver.New(VersionString)
 	Version.Metadata = fmt.Sprintf("git%s.%s", VersionDate, VersionDev)
 }
+
+// Info holds the build metadata of the binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build metadata of the binary
+func Get() Info {
+	return Info{
+		Version:   Version.String(),
+		Commit:    VersionDev,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
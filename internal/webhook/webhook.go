@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/pkg/errors"
+)
+
+// Config struct encapsulate all settings for the webhook notifier
+type Config struct {
+	// URL receives a POST request per change
+	URL     string
+	Timeout time.Duration
+
+	// MaxRetries of temporary failures, waiting RetryBackoff before the first retry and doubling it afterwards
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// DryRun logs the payloads instead of posting them
+	DryRun bool
+}
+
+// Payload is the JSON body posted per change
+type Payload struct {
+	Time        time.Time `json:"time"`
+	Appointment time.Time `json:"appointment"`
+	PatientID   int       `json:"patient_id"`
+	PatientName string    `json:"patient_name"`
+	IsBooking   bool      `json:"is_booking"`
+
+	Provider            string     `json:"provider,omitempty"`
+	Location            string     `json:"location,omitempty"`
+	PreviousAppointment *time.Time `json:"previous_appointment,omitempty"`
+	AppointmentID       string     `json:"appointment_id,omitempty"`
+}
+
+type notifier struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New creates a Notifier posting every change as JSON to the configured URL
+func New(cfg Config) job.Notifier {
+	return &notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// Name returns webhook
+func (notifier *notifier) Name() string {
+	return "webhook"
+}
+
+// Notify posts the changes one by one
+// if a change fails, the changes posted before are reported by a *job.PartialError
+func (notifier *notifier) Notify(ctx context.Context, lastRun time.Time, changes []*job.ApptChange) error {
+	notified := make([]*job.ApptChange, 0, len(changes))
+	for _, change := range changes {
+		payload := &Payload{
+			Time:        change.Time,
+			Appointment: change.Appointment,
+			PatientID:   change.PatientID,
+			PatientName: change.PatientName,
+			IsBooking:   change.IsBooking,
+			Provider:    change.Provider,
+			Location:    change.Location,
+
+			AppointmentID: change.ApptID,
+		}
+		if !change.PreviousAppointment.IsZero() {
+			payload.PreviousAppointment = &change.PreviousAppointment
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return &job.PartialError{Notified: notified, Err: errors.Wrap(err, "could not encode webhook payload")}
+		}
+
+		if notifier.cfg.DryRun {
+			job.Logger(ctx).Info().
+				RawJSON("payload", body).
+				Msg("dry run, webhook not posted")
+		} else if err := notifier.deliver(ctx, body); err != nil {
+			return &job.PartialError{Notified: notified, Err: err}
+		}
+		notified = append(notified, change)
+	}
+	return nil
+}
+
+// deliver posts the body, retrying temporary failures
+func (notifier *notifier) deliver(ctx context.Context, body []byte) error {
+	backoff := notifier.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := notifier.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !isTemporary(err) || attempt > notifier.cfg.MaxRetries {
+			return errors.Wrap(err, "could not post webhook")
+		}
+
+		job.Logger(ctx).Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Dur("backoff", backoff).
+			Msg("could not post webhook, retrying")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "could not post webhook")
+		}
+		backoff *= 2
+	}
+}
+
+func (notifier *notifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, notifier.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifier.client.Do(req)
+	if err != nil {
+		return &temporaryError{err}
+	}
+	defer resp.Body.Close()
+	// drain the body, so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return &temporaryError{err}
+	}
+	return err
+}
+
+// temporaryError marks failures worth a retry, e.g. network errors or server errors
+type temporaryError struct {
+	error
+}
+
+func isTemporary(err error) bool {
+	_, ok := err.(*temporaryError)
+	return ok
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emed-appts/emed-mailer/internal/job"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request fails temporarily and gets retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		payload := &Payload{}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(payload))
+		assert.Equal(t, 1, payload.PatientID)
+		assert.True(t, payload.IsBooking)
+	}))
+	defer srv.Close()
+
+	n := New(Config{URL: srv.URL, Timeout: time.Second, MaxRetries: 1})
+	err := n.Notify(context.Background(), time.Now(), []*job.ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1, PatientName: "Firstname Lastname", IsBooking: true},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestNotify_Rejected(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// client errors are not retried
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	n := New(Config{URL: srv.URL, Timeout: time.Second, MaxRetries: 3})
+	err := n.Notify(context.Background(), time.Now(), []*job.ApptChange{
+		{Time: time.Now(), Appointment: time.Now(), PatientID: 1},
+	})
+
+	if assert.IsType(t, &job.PartialError{}, err) {
+		assert.Empty(t, err.(*job.PartialError).Notified)
+		assert.Contains(t, err.Error(), "400 Bad Request")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}